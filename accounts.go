@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+	"github.com/patrickmn/go-cache"
+)
+
+// Accounts are active, suspended by an admin or expired once their expiration
+// timestamp (unix seconds, 0 for never) is reached. Only active accounts can
+// use the API and run a session. Users are told about the expiry with an
+// AccountStatus webhook some time before it and when it happens.
+
+const (
+	accountActive    = "active"
+	accountSuspended = "suspended"
+	accountExpired   = "expired"
+
+	accountCheckInterval = time.Minute
+
+	// Channel used to tell every replica to drop the cached info of a user
+	userinfoChannel = "wuzapi_userinfo"
+)
+
+var (
+	errAccountSuspended = errors.New("Account suspended")
+	errAccountExpired   = errors.New("Account expired")
+)
+
+// The status of an account from its stored status and expiration. An expired
+// account stays expired until it is reactivated.
+func accountStatus(status string, expiration int64, now time.Time) string {
+	if status == accountSuspended || status == accountExpired {
+		return status
+	}
+	if expiration > 0 && now.Unix() >= expiration {
+		return accountExpired
+	}
+	return accountActive
+}
+
+// Returns an error if the account described by the user info can not use the API
+func checkAccount(userinfo Values) error {
+	expiration, _ := strconv.ParseInt(userinfo.Get("Expiration"), 10, 64)
+	switch accountStatus(userinfo.Get("Status"), expiration, time.Now()) {
+	case accountSuspended:
+		return errAccountSuspended
+	case accountExpired:
+		return errAccountExpired
+	}
+	return nil
+}
+
+// Returns the info of a user, from the cache or the database
+func getUserInfoByID(db *sqlx.DB, userID int) (Values, error) {
+	txtid := strconv.Itoa(userID)
+	if myuserinfo, found := userinfocache.Get(txtid); found {
+		return myuserinfo.(Values), nil
+	}
+
+	var user struct {
+		Jid          string `db:"jid"`
+		Webhook      string `db:"webhook"`
+		Events       string `db:"events"`
+		IncludeToken bool   `db:"webhook_include_token"`
+		Format       string `db:"webhook_format"`
+		Status       string `db:"status"`
+		Expiration   int64  `db:"expiration"`
+		TokenPrefix  string `db:"token_prefix"`
+	}
+	err := db.Get(&user, `SELECT jid,webhook,events,webhook_include_token,webhook_format,status,COALESCE(expiration,0) AS expiration,
+		COALESCE((SELECT prefix FROM user_tokens t WHERE t.user_id=users.id AND t.scopes IS NULL ORDER BY t.created_at DESC LIMIT 1),'') AS token_prefix
+		FROM users WHERE id=$1`, userID)
+	if err != nil {
+		return Values{}, err
+	}
+	v := Values{map[string]string{
+		"Id":            txtid,
+		"Jid":           user.Jid,
+		"Webhook":       user.Webhook,
+		"TokenPrefix":   user.TokenPrefix,
+		"Events":        user.Events,
+		"WebhookToken":  strconv.FormatBool(user.IncludeToken),
+		"WebhookFormat": user.Format,
+		"Status":        user.Status,
+		"Expiration":    strconv.FormatInt(user.Expiration, 10),
+	}}
+	userinfocache.Set(txtid, v, cache.DefaultExpiration)
+	return v, nil
+}
+
+// Drops the cached info and tokens of a user on this replica
+func forgetUserInfo(userID int) {
+	userinfocache.Delete(strconv.Itoa(userID))
+	forgetUserTokens(userID)
+	wsSockets.recheck(userID)
+}
+
+// Drops the cached info of a user on every replica
+func invalidateUserInfo(db *sqlx.DB, userID int) {
+	forgetUserInfo(userID)
+	_, err := db.Exec("SELECT pg_notify($1, $2)", userinfoChannel, strconv.Itoa(userID))
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not notify replicas of user change")
+	}
+}
+
+// Listens for the user changes notified by the replicas until ctx is cancelled
+func listenUserInfo(ctx context.Context, dsn string) {
+	listener := pq.NewListener(dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Error().Err(err).Msg("User change listener problem")
+		}
+	})
+	defer listener.Close()
+	err := listener.Listen(userinfoChannel)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not listen for user changes")
+		return
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case n := <-listener.Notify:
+			if n == nil {
+				// Reconnected, changes may have been missed
+				userinfocache.Flush()
+				tokencache.Flush()
+				wsSockets.recheck(0)
+				continue
+			}
+			if userID, err := strconv.Atoi(n.Extra); err == nil {
+				forgetUserInfo(userID)
+			}
+		case <-time.After(90 * time.Second):
+			go listener.Ping()
+		}
+	}
+}
+
+// Sends an AccountStatus event to the webhooks of a user, whether or not its
+// session is running
+func sendAccountEvent(db *sqlx.DB, userID int, event map[string]interface{}) {
+	var events string
+	err := db.Get(&events, "SELECT events FROM users WHERE id=$1", userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not get user for account event")
+		return
+	}
+	// Account changes are sent even to users that did not subscribe to them
+	subscriptions := append(strings.Split(events, ","), "AccountStatus")
+	mycli := &MyClient{userID: userID, subscriptions: subscriptions, db: db}
+	mycli.dispatchEvent(map[string]interface{}{"type": "AccountStatus", "event": event}, "")
+}
+
+// Warns the accounts about to expire, expires the accounts past their
+// expiration and stops the sessions of accounts that are no longer active
+// until ctx is cancelled
+func (s *server) runAccountWatcher(ctx context.Context, warnBefore time.Duration) {
+	ticker := time.NewTicker(accountCheckInterval)
+	defer ticker.Stop()
+	for {
+		s.checkAccounts(warnBefore)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s *server) checkAccounts(warnBefore time.Duration) {
+	now := time.Now()
+	purgeExpiredTokens(s.db)
+
+	// Each notification is claimed by a single replica
+	var expiring []struct {
+		Id         int   `db:"id"`
+		Expiration int64 `db:"expiration"`
+	}
+	err := s.db.Select(&expiring, `UPDATE users SET expiry_warned_at=NOW()
+		WHERE status=$1 AND expiration>0 AND expiration>$2 AND expiration<=$3 AND expiry_warned_at IS NULL
+		RETURNING id, expiration`, accountActive, now.Unix(), now.Add(warnBefore).Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check expiring accounts")
+	}
+	for _, user := range expiring {
+		log.Info().Str("userid", strconv.Itoa(user.Id)).Int64("expiration", user.Expiration).Msg("Account expiring")
+		sendAccountEvent(s.db, user.Id, map[string]interface{}{"status": "expiring", "expiration": user.Expiration})
+	}
+
+	var expired []struct {
+		Id         int   `db:"id"`
+		Expiration int64 `db:"expiration"`
+	}
+	err = s.db.Select(&expired, `UPDATE users SET status=$1
+		WHERE status=$2 AND expiration>0 AND expiration<=$3
+		RETURNING id, expiration`, accountExpired, accountActive, now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check expired accounts")
+	}
+	for _, user := range expired {
+		log.Info().Str("userid", strconv.Itoa(user.Id)).Int64("expiration", user.Expiration).Msg("Account expired")
+		invalidateUserInfo(s.db, user.Id)
+		sendAccountEvent(s.db, user.Id, map[string]interface{}{"status": accountExpired, "expiration": user.Expiration})
+	}
+
+	// Sessions of accounts suspended or expired, possibly by another replica
+	running := sessions.List()
+	if len(running) == 0 {
+		return
+	}
+	var inactive []int
+	err = s.db.Select(&inactive, "SELECT id FROM users WHERE id = ANY($1) AND (status<>$2 OR (expiration>0 AND expiration<=$3))",
+		pq.Array(running), accountActive, now.Unix())
+	if err != nil {
+		log.Error().Err(err).Msg("Could not check accounts of running sessions")
+		return
+	}
+	for _, userID := range inactive {
+		log.Info().Str("userid", strconv.Itoa(userID)).Msg("Stopping session of inactive account")
+		sessions.Stop(userID)
+	}
+}
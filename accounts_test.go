@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAccountStatus(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name       string
+		status     string
+		expiration int64
+		want       string
+	}{
+		{"active without expiration", accountActive, 0, accountActive},
+		{"active before expiration", accountActive, now.Unix() + 60, accountActive},
+		{"active at expiration", accountActive, now.Unix(), accountExpired},
+		{"active after expiration", accountActive, now.Unix() - 60, accountExpired},
+		{"suspended without expiration", accountSuspended, 0, accountSuspended},
+		{"suspended after expiration", accountSuspended, now.Unix() - 60, accountSuspended},
+		{"expired stays expired", accountExpired, now.Unix() + 60, accountExpired},
+		{"unset status", "", 0, accountActive},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := accountStatus(tt.status, tt.expiration, now); got != tt.want {
+				t.Errorf("accountStatus(%q, %d) = %q, want %q", tt.status, tt.expiration, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckAccount(t *testing.T) {
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name       string
+		status     string
+		expiration string
+		want       error
+	}{
+		{"active", accountActive, "0", nil},
+		{"suspended", accountSuspended, "0", errAccountSuspended},
+		{"expired", accountExpired, "0", errAccountExpired},
+		{"past expiration", accountActive, past, errAccountExpired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userinfo := Values{map[string]string{"Status": tt.status, "Expiration": tt.expiration}}
+			if got := checkAccount(userinfo); got != tt.want {
+				t.Errorf("checkAccount() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Admin actions and the user actions affecting the session, its webhooks, its
+// keys or its groups are recorded in the append-only audit_log table, with
+// who made them, from where, and the state they changed before and after.
+// Forwarded requests are recorded by the replica serving them.
+
+const (
+	auditActorAdmin    = "admin"
+	auditActorUser     = "user"
+	auditActorWhatsapp = "whatsapp"
+
+	// Request bodies larger than this are not recorded
+	auditMaxBody = 64 << 10
+
+	requestIDHeader = "Request-Id"
+	// Address of the client of a forwarded request, set by the forwarding replica
+	clientIPHeader = "X-Wuzapi-Client-Ip"
+)
+
+// Returns the state a route changes, for the user the request acts on
+type auditSnapshot func(s *server, r *http.Request, userID int, body []byte) map[string]interface{}
+
+type auditRoute struct {
+	Action   string
+	Snapshot auditSnapshot
+}
+
+// Audited routes, by method and path template as in routes()
+var auditRoutes = map[string]auditRoute{
+	"POST /admin/users":                         {"user.create", nil},
+	"PATCH /admin/users/{id}":                   {"user.update", (*server).auditUserSnapshot},
+	"DELETE /admin/users/{id}":                  {"user.delete", (*server).auditUserSnapshot},
+	"PUT /admin/users/{id}/proxy":               {"user.proxy", (*server).auditUserSnapshot},
+	"PUT /admin/users/{id}/device":              {"user.device", (*server).auditUserSnapshot},
+	"POST /admin/users/{id}/rotate-token":       {"user.rotate_token", (*server).auditTokensSnapshot},
+	"POST /admin/users/{id}/keys":               {"key.create", (*server).auditTokensSnapshot},
+	"DELETE /admin/users/{id}/keys/{keyid}":     {"key.delete", (*server).auditTokensSnapshot},
+	"POST /admin/users/{id}/suspend":            {"user.suspend", (*server).auditUserSnapshot},
+	"POST /admin/users/{id}/reactivate":         {"user.reactivate", (*server).auditUserSnapshot},
+	"POST /admin/users/{id}/session/connect":    {"session.connect", (*server).auditSessionSnapshot},
+	"POST /admin/users/{id}/session/disconnect": {"session.disconnect", (*server).auditSessionSnapshot},
+	"POST /admin/users/{id}/session/logout":     {"session.logout", (*server).auditSessionSnapshot},
+
+	"POST /session/connect":    {"session.connect", (*server).auditSessionSnapshot},
+	"POST /session/disconnect": {"session.disconnect", (*server).auditSessionSnapshot},
+	"POST /session/logout":     {"session.logout", (*server).auditSessionSnapshot},
+	"POST /session/pairphone":  {"session.pair", (*server).auditSessionSnapshot},
+	"POST /session/proxy":      {"session.proxy", (*server).auditUserSnapshot},
+	"POST /session/device":     {"session.device", (*server).auditUserSnapshot},
+
+	"POST /webhook":                         {"webhook.set", (*server).auditWebhookSnapshot},
+	"DELETE /webhook":                       {"webhook.delete", (*server).auditWebhookSnapshot},
+	"PUT /webhook/update":                   {"webhook.update", (*server).auditWebhookSnapshot},
+	"POST /webhook/endpoints":               {"webhook.endpoint.create", (*server).auditWebhookSnapshot},
+	"PUT /webhook/endpoints/{id:[0-9]+}":    {"webhook.endpoint.update", (*server).auditWebhookSnapshot},
+	"PATCH /webhook/endpoints/{id:[0-9]+}":  {"webhook.endpoint.update", (*server).auditWebhookSnapshot},
+	"DELETE /webhook/endpoints/{id:[0-9]+}": {"webhook.endpoint.delete", (*server).auditWebhookSnapshot},
+
+	"POST /keys":               {"key.create", (*server).auditTokensSnapshot},
+	"DELETE /keys/{id:[0-9]+}": {"key.delete", (*server).auditTokensSnapshot},
+
+	"POST /group/updateparticipants": {"group.participants", (*server).auditGroupSnapshot},
+	"POST /group/announce":           {"group.announce", (*server).auditGroupSnapshot},
+	"POST /group/leave":              {"group.leave", (*server).auditGroupSnapshot},
+}
+
+type auditEntry struct {
+	Id          int64           `json:"id" db:"id"`
+	CreatedAt   time.Time       `json:"createdAt" db:"created_at"`
+	Action      string          `json:"action" db:"action"`
+	Actor       string          `json:"actor" db:"actor"`
+	TokenId     *int            `json:"tokenId" db:"token_id"`
+	TokenPrefix string          `json:"tokenPrefix" db:"token_prefix"`
+	UserId      *int            `json:"userId" db:"user_id"`
+	Ip          string          `json:"ip" db:"ip"`
+	RequestId   string          `json:"requestId" db:"request_id"`
+	Method      string          `json:"method" db:"method"`
+	Path        string          `json:"path" db:"path"`
+	Status      int             `json:"status" db:"status"`
+	Request     json.RawMessage `json:"request" db:"request"`
+	Diff        json.RawMessage `json:"diff" db:"diff"`
+}
+
+func recordAudit(db *sqlx.DB, entry auditEntry) {
+	_, err := db.Exec(`INSERT INTO audit_log (action, actor, token_id, token_prefix, user_id, ip, request_id, method, path, status, request, diff)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		entry.Action, entry.Actor, entry.TokenId, entry.TokenPrefix, entry.UserId, entry.Ip, entry.RequestId,
+		entry.Method, entry.Path, entry.Status, nullJSON(entry.Request), nullJSON(entry.Diff))
+	if err != nil {
+		log.Error().Err(err).Str("action", entry.Action).Msg("Could not record audit entry")
+	}
+}
+
+// Records an action reported by Whatsapp on the session of a user
+func recordSessionAudit(db *sqlx.DB, userID int, action string, details map[string]interface{}) {
+	request, _ := json.Marshal(details)
+	recordAudit(db, auditEntry{Action: action, Actor: auditActorWhatsapp, UserId: &userID, Request: request})
+}
+
+func nullJSON(data json.RawMessage) interface{} {
+	if len(data) == 0 {
+		return nil
+	}
+	return string(data)
+}
+
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Records the requests to the audited routes, it must run on the replica
+// serving the request, after the forwarding middleware
+func (s *server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, ok := auditRoutes[routeKey(r)]
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := auditEntry{Action: route.Action, Method: r.Method, Path: r.URL.Path, Ip: requestIP(r)}
+		if id, ok := hlog.IDFromRequest(r); ok {
+			entry.RequestId = id.String()
+		}
+		if forwarded := r.Header.Get(requestIDHeader); forwarded != "" && verifyForwarded(r) {
+			entry.RequestId = forwarded
+		}
+
+		userID := 0
+		if userinfo, ok := r.Context().Value("userinfo").(Values); ok {
+			userID, _ = strconv.Atoi(userinfo.Get("Id"))
+		} else if id, err := strconv.Atoi(mux.Vars(r)["id"]); err == nil {
+			userID = id
+		}
+		if userID != 0 {
+			entry.UserId = &userID
+		}
+		entry.Actor = auditActorAdmin
+		if token, ok := r.Context().Value("tokeninfo").(tokenEntry); ok && token.TokenID != 0 {
+			entry.Actor = auditActorUser
+			entry.TokenId = &token.TokenID
+			entry.TokenPrefix = token.Prefix
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, auditMaxBody+1))
+		if err == nil {
+			r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+			if len(body) <= auditMaxBody {
+				entry.Request = redactAuditBody(body)
+			}
+		}
+
+		var before map[string]interface{}
+		if route.Snapshot != nil && userID != 0 {
+			before = route.Snapshot(s, r, userID, body)
+		}
+		rw := &auditResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rw, r)
+		entry.Status = rw.status
+
+		if route.Snapshot != nil && userID != 0 {
+			after := route.Snapshot(s, r, userID, body)
+			if diff := auditDiff(before, after); len(diff) > 0 {
+				entry.Diff, _ = json.Marshal(diff)
+			}
+		}
+		recordAudit(s.db, entry)
+	})
+}
+
+// The address hlog.RemoteAddrHandler logs, or the client address a replica
+// signed when it forwarded the request
+func requestIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if ip := r.Header.Get(clientIPHeader); ip != "" && verifyForwarded(r) {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// Replaces the secrets in a JSON body, bodies that are not JSON are dropped
+func redactAuditBody(body []byte) json.RawMessage {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+	var payload interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+	redacted, _ := json.Marshal(redactAuditValue(payload))
+	return redacted
+}
+
+func redactAuditValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			switch strings.ToLower(key) {
+			case "token", "secret", "key", "password":
+				v[key] = "[redacted]"
+			case "proxyurl":
+				if proxyURL, ok := item.(string); ok {
+					v[key] = redactProxyURL(proxyURL)
+				}
+			default:
+				v[key] = redactAuditValue(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactAuditValue(item)
+		}
+	}
+	return value
+}
+
+// The fields that changed between two snapshots, nested maps are compared
+// field by field with dotted names
+func auditDiff(before, after map[string]interface{}) map[string]interface{} {
+	flatBefore := flattenAudit("", before, map[string]interface{}{})
+	flatAfter := flattenAudit("", after, map[string]interface{}{})
+	diff := map[string]interface{}{}
+	for key, value := range flatBefore {
+		if other, ok := flatAfter[key]; !ok || !reflect.DeepEqual(value, other) {
+			diff[key] = map[string]interface{}{"before": value, "after": flatAfter[key]}
+		}
+	}
+	for key, value := range flatAfter {
+		if _, ok := flatBefore[key]; !ok {
+			diff[key] = map[string]interface{}{"before": nil, "after": value}
+		}
+	}
+	return diff
+}
+
+func flattenAudit(prefix string, snapshot map[string]interface{}, flat map[string]interface{}) map[string]interface{} {
+	for key, value := range snapshot {
+		if nested, ok := value.(map[string]interface{}); ok {
+			flattenAudit(prefix+key+".", nested, flat)
+		} else {
+			flat[prefix+key] = value
+		}
+	}
+	return flat
+}
+
+func (s *server) auditUserSnapshot(r *http.Request, userID int, body []byte) map[string]interface{} {
+	var user struct {
+		Name           string `db:"name"`
+		Webhook        string `db:"webhook"`
+		Events         string `db:"events"`
+		Expiration     int64  `db:"expiration"`
+		Status         string `db:"status"`
+		ProxyURL       string `db:"proxy_url"`
+		DeviceName     string `db:"device_name"`
+		DevicePlatform string `db:"device_platform"`
+		DeviceBrowser  string `db:"device_browser"`
+		Jid            string `db:"jid"`
+	}
+	err := s.db.Get(&user, `SELECT name, webhook, events, COALESCE(expiration,0) AS expiration, status, proxy_url,
+		device_name, device_platform, device_browser, jid FROM users WHERE id=$1`, userID)
+	if err != nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"name":       user.Name,
+		"webhook":    user.Webhook,
+		"events":     user.Events,
+		"expiration": user.Expiration,
+		"status":     user.Status,
+		"proxyUrl":   redactProxyURL(user.ProxyURL),
+		"device":     map[string]interface{}{"name": user.DeviceName, "platform": user.DevicePlatform, "browser": user.DeviceBrowser},
+		"jid":        user.Jid,
+	}
+}
+
+func (s *server) auditSessionSnapshot(r *http.Request, userID int, body []byte) map[string]interface{} {
+	var user struct {
+		Jid       string `db:"jid"`
+		Connected int    `db:"connected"`
+	}
+	err := s.db.Get(&user, "SELECT jid, COALESCE(connected,0) AS connected FROM users WHERE id=$1", userID)
+	if err != nil {
+		return nil
+	}
+	state, _ := sessions.State(userID)
+	return map[string]interface{}{
+		"jid":       user.Jid,
+		"connected": user.Connected == 1,
+		"running":   sessions.Running(userID),
+		"state":     state,
+	}
+}
+
+func (s *server) auditWebhookSnapshot(r *http.Request, userID int, body []byte) map[string]interface{} {
+	var user struct {
+		Webhook      string `db:"webhook"`
+		Events       string `db:"events"`
+		Format       string `db:"webhook_format"`
+		IncludeToken bool   `db:"webhook_include_token"`
+		HasSecret    bool   `db:"has_secret"`
+	}
+	err := s.db.Get(&user, "SELECT webhook, events, webhook_format, webhook_include_token, webhook_secret<>'' AS has_secret FROM users WHERE id=$1", userID)
+	if err != nil {
+		return nil
+	}
+	var endpoints []struct {
+		Id      int    `db:"id"`
+		Url     string `db:"url"`
+		Events  string `db:"events"`
+		Enabled bool   `db:"enabled"`
+		Format  string `db:"format"`
+	}
+	err = s.db.Select(&endpoints, "SELECT id, url, events, enabled, format FROM webhooks WHERE user_id=$1", userID)
+	if err != nil {
+		return nil
+	}
+	endpointMap := map[string]interface{}{}
+	for _, endpoint := range endpoints {
+		endpointMap[strconv.Itoa(endpoint.Id)] = map[string]interface{}{
+			"url": endpoint.Url, "events": endpoint.Events, "enabled": endpoint.Enabled, "format": endpoint.Format,
+		}
+	}
+	return map[string]interface{}{
+		"webhook":      user.Webhook,
+		"events":       user.Events,
+		"format":       user.Format,
+		"includeToken": user.IncludeToken,
+		"hasSecret":    user.HasSecret,
+		"endpoints":    endpointMap,
+	}
+}
+
+func (s *server) auditTokensSnapshot(r *http.Request, userID int, body []byte) map[string]interface{} {
+	var tokens []struct {
+		Id        int        `db:"id"`
+		Prefix    string     `db:"prefix"`
+		Label     string     `db:"label"`
+		Scopes    *string    `db:"scopes"`
+		ExpiresAt *time.Time `db:"expires_at"`
+	}
+	err := s.db.Select(&tokens, "SELECT id, prefix, label, scopes, expires_at FROM user_tokens WHERE user_id=$1", userID)
+	if err != nil {
+		return nil
+	}
+	tokenMap := map[string]interface{}{}
+	for _, token := range tokens {
+		scopes := "*"
+		if token.Scopes != nil {
+			scopes = *token.Scopes
+		}
+		var expiresAt interface{}
+		if token.ExpiresAt != nil {
+			expiresAt = token.ExpiresAt.Unix()
+		}
+		tokenMap[strconv.Itoa(token.Id)] = map[string]interface{}{
+			"prefix": token.Prefix, "label": token.Label, "scopes": scopes, "expiresAt": expiresAt,
+		}
+	}
+	return map[string]interface{}{"tokens": tokenMap}
+}
+
+// The participants and settings of the group in the request, as the session sees it
+func (s *server) auditGroupSnapshot(r *http.Request, userID int, body []byte) map[string]interface{} {
+	var t struct {
+		GroupJID string
+	}
+	if json.Unmarshal(body, &t) != nil || t.GroupJID == "" {
+		return nil
+	}
+	group, ok := parseJID(t.GroupJID)
+	client := sessions.Get(userID)
+	if !ok || client == nil {
+		return nil
+	}
+	info, err := client.GetGroupInfo(group)
+	if err != nil {
+		return map[string]interface{}{"member": false}
+	}
+	participants := map[string]interface{}{}
+	for _, participant := range info.Participants {
+		role := "member"
+		if participant.IsSuperAdmin {
+			role = "superadmin"
+		} else if participant.IsAdmin {
+			role = "admin"
+		}
+		participants[participant.JID.String()] = role
+	}
+	return map[string]interface{}{
+		"member":       true,
+		"name":         info.Name,
+		"announce":     info.IsAnnounce,
+		"participants": participants,
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// Every conversation of a user is kept in the chats table. The last activity
+// and unread count follow the stored messages, archive/pin/mute follow the
+// app state sent by the phone.
+
+type storedChat struct {
+	Jid           string         `db:"jid"`
+	Name          string         `db:"name"`
+	UnreadCount   int            `db:"unread_count"`
+	LastMessageAt sql.NullTime   `db:"last_message_at"`
+	Archived      bool           `db:"archived"`
+	Pinned        bool           `db:"pinned"`
+	Muted         bool           `db:"muted"`
+	MutedUntil    sql.NullTime   `db:"muted_until"`
+	LastId        sql.NullString `db:"last_id"`
+	LastSender    sql.NullString `db:"last_sender"`
+	LastFromMe    sql.NullBool   `db:"last_from_me"`
+	LastType      sql.NullString `db:"last_type"`
+	LastText      sql.NullString `db:"last_text"`
+	LastTimestamp sql.NullTime   `db:"last_timestamp"`
+	LastDeleted   sql.NullBool   `db:"last_deleted"`
+}
+
+// Updates the last activity of a chat after a live message. Messages from the
+// contact increase the unread count, sending a message from any device clears it.
+func updateChatActivity(db sqlx.Execer, userID int, info types.MessageInfo, msg *waProto.Message) error {
+	if msg == nil {
+		return nil
+	}
+	msg = unwrapMessage(msg)
+	if msg.GetProtocolMessage() != nil || msg.GetReactionMessage() != nil {
+		return nil
+	}
+	_, err := db.Exec(`INSERT INTO chats (user_id, jid, unread_count, last_message_at)
+		VALUES ($1, $2, CASE WHEN $3 THEN 0 ELSE 1 END, $4)
+		ON CONFLICT (user_id, jid) DO UPDATE SET
+			unread_count=CASE WHEN $3 THEN 0 ELSE chats.unread_count+1 END,
+			last_message_at=GREATEST(chats.last_message_at, EXCLUDED.last_message_at),
+			updated_at=NOW()`,
+		userID, info.Chat.ToNonAD().String(), info.IsFromMe, info.Timestamp)
+	return err
+}
+
+func setChatUnreadCount(db *sqlx.DB, userID int, chat types.JID, count int) error {
+	_, err := db.Exec(`INSERT INTO chats (user_id, jid, unread_count) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, jid) DO UPDATE SET unread_count=EXCLUDED.unread_count, updated_at=NOW()`,
+		userID, chat.ToNonAD().String(), count)
+	return err
+}
+
+func setChatArchived(db *sqlx.DB, userID int, chat types.JID, archived bool) error {
+	_, err := db.Exec(`INSERT INTO chats (user_id, jid, archived) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, jid) DO UPDATE SET archived=EXCLUDED.archived, updated_at=NOW()`,
+		userID, chat.ToNonAD().String(), archived)
+	return err
+}
+
+func setChatPinned(db *sqlx.DB, userID int, chat types.JID, pinned bool) error {
+	_, err := db.Exec(`INSERT INTO chats (user_id, jid, pinned) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, jid) DO UPDATE SET pinned=EXCLUDED.pinned, updated_at=NOW()`,
+		userID, chat.ToNonAD().String(), pinned)
+	return err
+}
+
+// Mutes or unmutes a chat, a nil until means muted forever
+func setChatMuted(db *sqlx.DB, userID int, chat types.JID, muted bool, until *time.Time) error {
+	var mutedUntil sql.NullTime
+	if muted && until != nil {
+		mutedUntil = sql.NullTime{Time: *until, Valid: true}
+	}
+	_, err := db.Exec(`INSERT INTO chats (user_id, jid, muted, muted_until) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, jid) DO UPDATE SET muted=EXCLUDED.muted, muted_until=EXCLUDED.muted_until, updated_at=NOW()`,
+		userID, chat.ToNonAD().String(), muted, mutedUntil)
+	return err
+}
+
+func setChatName(db *sqlx.DB, userID int, chat types.JID, name string) error {
+	_, err := db.Exec(`INSERT INTO chats (user_id, jid, name) VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, jid) DO UPDATE SET name=EXCLUDED.name, updated_at=NOW()`,
+		userID, chat.ToNonAD().String(), name)
+	return err
+}
+
+// Lists the chats of a user with their last stored message, pinned chats first
+// and then by last activity
+func listChats(db *sqlx.DB, userID int, archived *bool, limit int, offset int) ([]storedChat, int, error) {
+	where := "c.user_id=$1"
+	args := []interface{}{userID}
+	if archived != nil {
+		args = append(args, *archived)
+		where += " AND c.archived=$" + strconv.Itoa(len(args))
+	}
+
+	var total int
+	err := db.Get(&total, "SELECT COUNT(*) FROM chats c WHERE "+where, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, limit, offset)
+	chats := []storedChat{}
+	err = db.Select(&chats, `SELECT c.jid, c.name, c.unread_count, c.last_message_at, c.archived, c.pinned,
+			c.muted AND (c.muted_until IS NULL OR c.muted_until > NOW()) AS muted, c.muted_until,
+			m.message_id AS last_id, m.sender_jid AS last_sender, m.from_me AS last_from_me, m.type AS last_type,
+			m.text AS last_text, m.timestamp AS last_timestamp, m.deleted AS last_deleted
+		FROM chats c
+		LEFT JOIN LATERAL (
+			SELECT message_id, sender_jid, from_me, type, text, timestamp, deleted FROM messages
+			WHERE user_id=c.user_id AND chat_jid=c.jid ORDER BY timestamp DESC, id DESC LIMIT 1
+		) m ON TRUE
+		WHERE `+where+`
+		ORDER BY c.pinned DESC, c.last_message_at DESC NULLS LAST, c.id DESC
+		LIMIT $`+strconv.Itoa(len(args)-1)+` OFFSET $`+strconv.Itoa(len(args)), args...)
+	return chats, total, err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/proto/waCompanionReg"
+	"go.mau.fi/whatsmeow/store"
+	"google.golang.org/protobuf/proto"
+)
+
+// The device identity is what the phone shows for the session in its
+// "Linked devices" list. It is sent when the device is paired, so changing it
+// only affects the next pairing of the user.
+
+const (
+	defaultDeviceName     = "Mac OS 10"
+	defaultDevicePlatform = "UNKNOWN"
+	defaultDeviceBrowser  = "Chrome"
+)
+
+// Browsers accepted for pairing by phone number
+var pairClientTypes = map[string]whatsmeow.PairClientType{
+	"Chrome":   whatsmeow.PairClientChrome,
+	"Edge":     whatsmeow.PairClientEdge,
+	"Firefox":  whatsmeow.PairClientFirefox,
+	"IE":       whatsmeow.PairClientIE,
+	"Opera":    whatsmeow.PairClientOpera,
+	"Safari":   whatsmeow.PairClientSafari,
+	"Electron": whatsmeow.PairClientElectron,
+	"UWP":      whatsmeow.PairClientUWP,
+	"Other":    whatsmeow.PairClientOtherWebClient,
+}
+
+type deviceIdentity struct {
+	Name     string `json:"name" db:"device_name"`
+	Platform string `json:"platform" db:"device_platform"`
+	Browser  string `json:"browser" db:"device_browser"`
+}
+
+// Fills the empty fields with the defaults and checks the platform and browser
+func (d *deviceIdentity) normalize() error {
+	d.Name = strings.TrimSpace(d.Name)
+	if d.Name == "" {
+		d.Name = defaultDeviceName
+	}
+	if len(d.Name) > 64 {
+		return errors.New("Device name is too long, max 64 characters")
+	}
+	d.Platform = strings.ToUpper(strings.TrimSpace(d.Platform))
+	if d.Platform == "" {
+		d.Platform = defaultDevicePlatform
+	}
+	if _, ok := waCompanionReg.DeviceProps_PlatformType_value[d.Platform]; !ok {
+		return errors.New(fmt.Sprintf("Invalid device platform %s", d.Platform))
+	}
+	d.Browser = strings.TrimSpace(d.Browser)
+	if d.Browser == "" {
+		d.Browser = defaultDeviceBrowser
+	}
+	for name := range pairClientTypes {
+		if strings.EqualFold(name, d.Browser) {
+			d.Browser = name
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("Invalid device browser %s", d.Browser))
+}
+
+// The device properties sent on registration, based on the whatsmeow defaults
+func (d deviceIdentity) deviceProps() *waProto.DeviceProps {
+	props := proto.Clone(store.DeviceProps).(*waProto.DeviceProps)
+	props.Os = proto.String(d.Name)
+	props.PlatformType = waProto.DeviceProps_PlatformType(waCompanionReg.DeviceProps_PlatformType_value[d.Platform]).Enum()
+	return props
+}
+
+// The client type and display name used to pair by phone number, the display
+// name must be formatted as "Browser (OS)"
+func (d deviceIdentity) pairClient() (whatsmeow.PairClientType, string) {
+	return pairClientTypes[d.Browser], fmt.Sprintf("%s (%s)", d.Browser, d.Name)
+}
+
+// Builds the client payload of a whatsmeow client with the device identity of
+// its user instead of the package global store.DeviceProps, so sessions
+// starting at the same time do not overwrite each other's identity
+func clientPayloadFunc(client *whatsmeow.Client, d deviceIdentity) func() *waProto.ClientPayload {
+	return func() *waProto.ClientPayload {
+		payload := client.Store.GetClientPayload()
+		if payload.DevicePairingData != nil {
+			deviceProps, err := proto.Marshal(d.deviceProps())
+			if err == nil {
+				payload.DevicePairingData.DeviceProps = deviceProps
+			}
+		}
+		return payload
+	}
+}
+
+func getUserDevice(db *sqlx.DB, userID int) (deviceIdentity, error) {
+	var d deviceIdentity
+	err := db.Get(&d, "SELECT device_name, device_platform, device_browser FROM users WHERE id=$1", userID)
+	if err != nil {
+		return d, err
+	}
+	// Rows written before the columns existed or edited by hand
+	if d.normalize() != nil {
+		d = deviceIdentity{}
+		d.normalize()
+	}
+	return d, nil
+}
+
+// Removes the whatsmeow device of a session from the store
+func deleteStoredDevice(textjid string) error {
+	if textjid == "" {
+		return nil
+	}
+	jid, ok := parseJID(textjid)
+	if !ok {
+		return fmt.Errorf("invalid jid %s", textjid)
+	}
+	device, err := container.GetDevice(jid)
+	if err != nil || device == nil {
+		return err
+	}
+	return device.Delete()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDeviceIdentityNormalize(t *testing.T) {
+	tests := []struct {
+		name    string
+		device  deviceIdentity
+		want    deviceIdentity
+		wantErr bool
+	}{
+		{"defaults", deviceIdentity{}, deviceIdentity{defaultDeviceName, defaultDevicePlatform, defaultDeviceBrowser}, false},
+		{"blank fields", deviceIdentity{"  ", " ", " "}, deviceIdentity{defaultDeviceName, defaultDevicePlatform, defaultDeviceBrowser}, false},
+		{"trimmed name", deviceIdentity{Name: " Support desk "}, deviceIdentity{"Support desk", defaultDevicePlatform, defaultDeviceBrowser}, false},
+		{"lowercase platform", deviceIdentity{Platform: "firefox"}, deviceIdentity{defaultDeviceName, "FIREFOX", defaultDeviceBrowser}, false},
+		{"browser case", deviceIdentity{Browser: "safari"}, deviceIdentity{defaultDeviceName, defaultDevicePlatform, "Safari"}, false},
+		{"invalid platform", deviceIdentity{Platform: "amiga"}, deviceIdentity{}, true},
+		{"invalid browser", deviceIdentity{Browser: "Netscape"}, deviceIdentity{}, true},
+		{"name too long", deviceIdentity{Name: strings.Repeat("a", 65)}, deviceIdentity{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := tt.device
+			err := d.normalize()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalize() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && d != tt.want {
+				t.Errorf("normalize() = %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// The event hub fans out session events to streaming consumers (SSE, websocket).
+// Each user keeps a bounded ring buffer of recent events so a client that
+// reconnects with the last event id it saw can resume without gaps. The buffer
+// is dropped once the session stopped here and its last subscriber left.
+
+const (
+	eventHubBufferSize     = 256
+	eventHubSubscriberSize = 64
+)
+
+type hubEvent struct {
+	Id   uint64
+	Type string
+	Data []byte
+}
+
+type userEventStream struct {
+	nextID      uint64
+	buffer      []hubEvent
+	start       int
+	subscribers map[chan hubEvent]struct{}
+	// The session stopped on this replica, no more events will be published
+	stopped bool
+}
+
+type eventHub struct {
+	mu    sync.Mutex
+	users map[int]*userEventStream
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{users: make(map[int]*userEventStream)}
+}
+
+func (h *eventHub) stream(userID int) *userEventStream {
+	stream, ok := h.users[userID]
+	if !ok {
+		// Ids start from the current time so they keep growing across restarts
+		// and a stale Last-Event-ID from a previous process is never ahead of us
+		stream = &userEventStream{
+			nextID:      uint64(time.Now().UnixMilli()) * 1000,
+			subscribers: make(map[chan hubEvent]struct{}),
+		}
+		h.users[userID] = stream
+	}
+	return stream
+}
+
+// Publish stores the event in the user ring buffer and sends it to every subscriber.
+// Subscribers that are too slow to keep up are dropped, they can resume from the buffer.
+func (h *eventHub) Publish(userID int, eventType string, data []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream := h.stream(userID)
+	stream.stopped = false
+	stream.nextID++
+	evt := hubEvent{Id: stream.nextID, Type: eventType, Data: data}
+	if len(stream.buffer) < eventHubBufferSize {
+		stream.buffer = append(stream.buffer, evt)
+	} else {
+		stream.buffer[stream.start] = evt
+		stream.start = (stream.start + 1) % eventHubBufferSize
+	}
+
+	for ch := range stream.subscribers {
+		select {
+		case ch <- evt:
+		default:
+			log.Warn().Int("userid", userID).Msg("Dropping slow event stream subscriber")
+			delete(stream.subscribers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns the buffered events newer than lastID and a channel with the
+// following ones. The channel is closed when the subscriber is dropped or cancelled.
+func (h *eventHub) Subscribe(userID int, lastID uint64) ([]hubEvent, <-chan hubEvent, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stream := h.stream(userID)
+	backlog := []hubEvent{}
+	if lastID > 0 {
+		for i := 0; i < len(stream.buffer); i++ {
+			evt := stream.buffer[(stream.start+i)%len(stream.buffer)]
+			if evt.Id > lastID {
+				backlog = append(backlog, evt)
+			}
+		}
+	}
+
+	ch := make(chan hubEvent, eventHubSubscriberSize)
+	stream.subscribers[ch] = struct{}{}
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := stream.subscribers[ch]; ok {
+			delete(stream.subscribers, ch)
+			close(ch)
+		}
+		h.prune(userID, stream)
+	}
+	return backlog, ch, cancel
+}
+
+// Forget drops the buffer of a user whose session stopped or who was deleted.
+// Subscribers still connected keep it until they leave.
+func (h *eventHub) Forget(userID int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if stream, ok := h.users[userID]; ok {
+		stream.stopped = true
+		h.prune(userID, stream)
+	}
+}
+
+// Drops a stream with no subscribers left once there is nothing to resume
+// from it. Must be called with h.mu held.
+func (h *eventHub) prune(userID int, stream *userEventStream) {
+	if len(stream.subscribers) > 0 || (!stream.stopped && len(stream.buffer) > 0) {
+		return
+	}
+	if h.users[userID] == stream {
+		delete(h.users, userID)
+	}
+}
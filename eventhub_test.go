@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestEventHubBacklog(t *testing.T) {
+	tests := []struct {
+		name      string
+		published int
+		resume    int // index of the last event the client saw
+		want      int // events replayed
+		wantFirst int // index of the first replayed event
+	}{
+		{"nothing missed", 10, 9, 0, 0},
+		{"some missed", 10, 6, 3, 7},
+		{"buffer full", eventHubBufferSize, 0, eventHubBufferSize - 1, 1},
+		{"buffer wrapped", eventHubBufferSize + 10, 20, eventHubBufferSize - 11, 21},
+		{"resume point overwritten", eventHubBufferSize + 10, 3, eventHubBufferSize, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newEventHub()
+			_, live, cancel := h.Subscribe(1, 0)
+			var ids []uint64
+			for i := 0; i < tt.published; i++ {
+				h.Publish(1, "Message", []byte(strconv.Itoa(i)))
+				ids = append(ids, (<-live).Id)
+			}
+			cancel()
+
+			backlog, _, cancel := h.Subscribe(1, ids[tt.resume])
+			defer cancel()
+			if len(backlog) != tt.want {
+				t.Fatalf("replayed %d events, want %d", len(backlog), tt.want)
+			}
+			for i, evt := range backlog {
+				if evt.Id != ids[tt.wantFirst+i] {
+					t.Fatalf("event %d has id %d, want %d", i, evt.Id, ids[tt.wantFirst+i])
+				}
+				if string(evt.Data) != strconv.Itoa(tt.wantFirst+i) {
+					t.Fatalf("event %d has data %s, want %d", i, evt.Data, tt.wantFirst+i)
+				}
+			}
+		})
+	}
+}
+
+func TestEventHubNoBacklogWithoutLastID(t *testing.T) {
+	h := newEventHub()
+	h.Publish(1, "Message", []byte("0"))
+	backlog, _, cancel := h.Subscribe(1, 0)
+	defer cancel()
+	if len(backlog) != 0 {
+		t.Fatalf("replayed %d events without a last event id", len(backlog))
+	}
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	h := newEventHub()
+	_, live, cancel := h.Subscribe(1, 0)
+	defer cancel()
+	for i := 0; i <= eventHubSubscriberSize; i++ {
+		h.Publish(1, "Message", nil)
+	}
+	received := 0
+	for range live {
+		received++
+	}
+	if received != eventHubSubscriberSize {
+		t.Fatalf("received %d events before being dropped, want %d", received, eventHubSubscriberSize)
+	}
+}
+
+func TestEventHubUsersAreSeparate(t *testing.T) {
+	h := newEventHub()
+	_, other, cancel := h.Subscribe(2, 0)
+	defer cancel()
+	h.Publish(1, "Message", nil)
+	select {
+	case evt := <-other:
+		t.Fatalf("user 2 received event %d of user 1", evt.Id)
+	default:
+	}
+}
+
+func TestEventHubForget(t *testing.T) {
+	buffered := func(h *eventHub, userID int) bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		_, ok := h.users[userID]
+		return ok
+	}
+
+	h := newEventHub()
+	h.Publish(1, "Message", nil)
+	h.Forget(1)
+	if buffered(h, 1) {
+		t.Error("buffer kept after the session stopped")
+	}
+
+	// A subscriber still connected keeps the buffer until it leaves
+	_, _, cancel := h.Subscribe(2, 0)
+	h.Publish(2, "Message", nil)
+	h.Forget(2)
+	if !buffered(h, 2) {
+		t.Fatal("buffer dropped while subscribed")
+	}
+	cancel()
+	if buffered(h, 2) {
+		t.Error("buffer kept after the last subscriber left")
+	}
+
+	// The session started again before the subscriber left
+	_, _, cancel = h.Subscribe(3, 0)
+	h.Forget(3)
+	h.Publish(3, "Message", nil)
+	cancel()
+	if !buffered(h, 3) {
+		t.Error("buffer of a running session dropped")
+	}
+
+	// Nothing to resume from a user without events
+	_, _, cancel = h.Subscribe(4, 0)
+	cancel()
+	if buffered(h, 4) {
+		t.Error("empty buffer kept after the last subscriber left")
+	}
+}
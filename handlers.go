@@ -18,7 +18,6 @@ import (
 
 	"github.com/gorilla/mux"
 	"github.com/nfnt/resize"
-	"github.com/patrickmn/go-cache"
 	"github.com/vincent-petithory/dataurl"
 	"go.mau.fi/whatsmeow"
 	waProto "go.mau.fi/whatsmeow/binary/proto"
@@ -34,7 +33,7 @@ func (v Values) Get(key string) string {
 	return v.m[key]
 }
 
-var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
+var messageTypes = []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "Connection", "AccountStatus", "All"}
 
 // Connects to Whatsapp Servers
 func (s *server) Connect() http.HandlerFunc {
@@ -49,7 +48,6 @@ func (s *server) Connect() http.HandlerFunc {
 		webhook := r.Context().Value("userinfo").(Values).Get("Webhook")
 		jid := r.Context().Value("userinfo").(Values).Get("Jid")
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 		eventstring := ""
 
@@ -62,7 +60,7 @@ func (s *server) Connect() http.HandlerFunc {
 			return
 		}
 
-		if clientPointer[userid] != nil {
+		if sessions.Running(userid) {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Connected"))
 			return
 		} else {
@@ -89,19 +87,25 @@ func (s *server) Connect() http.HandlerFunc {
 				log.Warn().Msg("Could not set events in users table")
 			}
 			log.Info().Str("events", eventstring).Msg("Setting subscribed events")
-			v := updateUserInfo(r.Context().Value("userinfo"), "Events", eventstring)
-			userinfocache.Set(token, v, cache.NoExpiration)
+			invalidateUserInfo(s.db, userid)
 
 			log.Info().Str("jid", jid).Msg("Attempt to connect")
-			killchannel[userid] = make(chan bool)
-			go s.startClient(userid, jid, token, subscribedEvents)
+			started, err := s.startSession(userid, jid, subscribedEvents, nil)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if !started {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Connected"))
+				return
+			}
 
 			if t.Immediate == false {
 				log.Warn().Msg("Waiting 10 seconds")
 				time.Sleep(10000 * time.Millisecond)
 
-				if clientPointer[userid] != nil {
-					if !clientPointer[userid].IsConnected() {
+				if client := sessions.Get(userid); client != nil {
+					if !client.IsConnected() {
 						s.Respond(w, r, http.StatusInternalServerError, errors.New("Failed to Connect"))
 						return
 					}
@@ -130,23 +134,22 @@ func (s *server) Disconnect() http.HandlerFunc {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		jid := r.Context().Value("userinfo").(Values).Get("Jid")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
-		if clientPointer[userid].IsConnected() == true {
-			if clientPointer[userid].IsLoggedIn() == true {
+		if client.IsConnected() == true {
+			if client.IsLoggedIn() == true {
 				log.Info().Str("jid", jid).Msg("Disconnection successfull")
-				killchannel[userid] <- true
+				sessions.Stop(userid)
 				_, err := s.db.Exec("UPDATE users SET events=$1 WHERE id=$2", "", userid)
 				if err != nil {
 					log.Warn().Str("userid", txtid).Msg("Could not set events in users table")
 				}
-				v := updateUserInfo(r.Context().Value("userinfo"), "Events", "")
-				userinfocache.Set(token, v, cache.NoExpiration)
+				invalidateUserInfo(s.db, userid)
 
 				response := map[string]interface{}{"Details": "Disconnected"}
 				responseJson, err := json.Marshal(response)
@@ -175,16 +178,19 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		webhook := ""
 		events := ""
+		hasSecret := false
+		includeToken := false
+		format := ""
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 
-		rows, err := s.db.Query("SELECT webhook,events FROM users WHERE id=$1 LIMIT 1", txtid)
+		rows, err := s.db.Query("SELECT webhook,events,webhook_secret<>'',webhook_include_token,webhook_format FROM users WHERE id=$1 LIMIT 1", txtid)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %v", err)))
 			return
 		}
 		defer rows.Close()
 		for rows.Next() {
-			err = rows.Scan(&webhook, &events)
+			err = rows.Scan(&webhook, &events, &hasSecret, &includeToken, &format)
 			if err != nil {
 				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook: %s", fmt.Sprintf("%s", err))))
 				return
@@ -198,7 +204,7 @@ func (s *server) GetWebhook() http.HandlerFunc {
 
 		eventarray := strings.Split(events, ",")
 
-		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray}
+		response := map[string]interface{}{"webhook": webhook, "subscribe": eventarray, "hasSecret": hasSecret, "includeToken": includeToken, "format": format}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -213,7 +219,6 @@ func (s *server) GetWebhook() http.HandlerFunc {
 func (s *server) DeleteWebhook() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
 		// Update the database to remove the webhook and clear events
@@ -223,10 +228,8 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 			return
 		}
 
-		// Update the user info cache
-		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", "")
-		v = updateUserInfo(v, "Events", "")
-		userinfocache.Set(token, v, cache.NoExpiration)
+		// Every replica reloads the user info, including the one running the session
+		invalidateUserInfo(s.db, userid)
 
 		response := map[string]interface{}{"Details": "Webhook and events deleted successfully"}
 		responseJson, err := json.Marshal(response)
@@ -241,13 +244,16 @@ func (s *server) DeleteWebhook() http.HandlerFunc {
 // UpdateWebhook updates the webhook URL and events for a user
 func (s *server) UpdateWebhook() http.HandlerFunc {
 	type updateWebhookStruct struct {
-		WebhookURL string   `json:"webhook"`
-		Events     []string `json:"events"`
-		Active     bool     `json:"active"`
+		WebhookURL     string   `json:"webhook"`
+		Events         []string `json:"events"`
+		Active         bool     `json:"active"`
+		Secret         *string  `json:"secret"`
+		GenerateSecret bool     `json:"generateSecret"`
+		IncludeToken   *bool    `json:"includeToken"`
+		Format         *string  `json:"format"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
 		decoder := json.NewDecoder(r.Body)
@@ -258,6 +264,11 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			return
 		}
 
+		if t.Format != nil && !Find(webhookFormats, *t.Format) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid format, use one of: "+strings.Join(webhookFormats, ", ")))
+			return
+		}
+
 		webhook := t.WebhookURL
 		events := strings.Join(t.Events, ",")
 		if !t.Active {
@@ -265,17 +276,25 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 			events = ""
 		}
 
-		_, err = s.db.Exec("UPDATE users SET webhook=?, events=? WHERE id=?", webhook, events, userid)
+		_, err = s.db.Exec("UPDATE users SET webhook=$1, events=$2 WHERE id=$3", webhook, events, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update webhook: %v", err)))
+			return
+		}
+
+		secret, err := s.setWebhookOptions(userid, t.Secret, t.GenerateSecret, t.IncludeToken, t.Format)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update webhook: %v", err)))
 			return
 		}
 
-		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
-		v = updateUserInfo(v, "Events", events)
-		userinfocache.Set(token, v, cache.NoExpiration)
+		// Every replica reloads the user info, including the one running the session
+		invalidateUserInfo(s.db, userid)
 
 		response := map[string]interface{}{"webhook": webhook, "events": t.Events, "active": t.Active}
+		if secret != "" {
+			response["secret"] = secret
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -288,12 +307,15 @@ func (s *server) UpdateWebhook() http.HandlerFunc {
 // SetWebhook sets the webhook URL and events for a user
 func (s *server) SetWebhook() http.HandlerFunc {
 	type webhookStruct struct {
-		WebhookURL string   `json:"webhook"`
-		Events     []string `json:"events"`
+		WebhookURL     string   `json:"webhook"`
+		Events         []string `json:"events"`
+		Secret         *string  `json:"secret"`
+		GenerateSecret bool     `json:"generateSecret"`
+		IncludeToken   *bool    `json:"includeToken"`
+		Format         *string  `json:"format"`
 	}
 	return func(w http.ResponseWriter, r *http.Request) {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		token := r.Context().Value("userinfo").(Values).Get("Token")
 		userid, _ := strconv.Atoi(txtid)
 
 		decoder := json.NewDecoder(r.Body)
@@ -304,6 +326,11 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			return
 		}
 
+		if t.Format != nil && !Find(webhookFormats, *t.Format) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid format, use one of: "+strings.Join(webhookFormats, ", ")))
+			return
+		}
+
 		webhook := t.WebhookURL
 		events := strings.Join(t.Events, ",")
 
@@ -313,1016 +340,934 @@ func (s *server) SetWebhook() http.HandlerFunc {
 			return
 		}
 
-		v := updateUserInfo(r.Context().Value("userinfo"), "Webhook", webhook)
-		v = updateUserInfo(v, "Events", events)
-		userinfocache.Set(token, v, cache.NoExpiration)
-
-		response := map[string]interface{}{"webhook": webhook, "events": t.Events}
-		responseJson, err := json.Marshal(response)
+		secret, err := s.setWebhookOptions(userid, t.Secret, t.GenerateSecret, t.IncludeToken, t.Format)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set webhook: %v", err)))
+			return
 		}
-	}
-}
-
-// Gets QR code encoded in Base64
-func (s *server) GetQR() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-		code := ""
+		// Every replica reloads the user info, including the one running the session
+		invalidateUserInfo(s.db, userid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		} else {
-			if clientPointer[userid].IsConnected() == false {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
-				return
-			}
-			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=$1 LIMIT 1", userid)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			defer rows.Close()
-			for rows.Next() {
-				err = rows.Scan(&code)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, err)
-					return
-				}
-			}
-			err = rows.Err()
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, err)
-				return
-			}
-			if clientPointer[userid].IsLoggedIn() == true {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
-				return
-			}
+		response := map[string]interface{}{"webhook": webhook, "events": t.Events}
+		if secret != "" {
+			response["secret"] = secret
 		}
-
-		log.Info().Str("userid", txtid).Str("qrcode", code).Msg("Get QR successful")
-		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Logs out device from Whatsapp (requires to scan QR next time)
-func (s *server) Logout() http.HandlerFunc {
+// Lists the webhook endpoints of the user
+func (s *server) ListWebhookEndpoints() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		jid := r.Context().Value("userinfo").(Values).Get("Jid")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		endpoints, err := getWebhookEndpoints(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook endpoints: %v", err)))
 			return
-		} else {
-			if clientPointer[userid].IsLoggedIn() == true && clientPointer[userid].IsConnected() == true {
-				err := clientPointer[userid].Logout()
-				if err != nil {
-					log.Error().Str("jid", jid).Msg("Could not perform logout")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
-					return
-				} else {
-					log.Info().Str("jid", jid).Msg("Logged out")
-					killchannel[userid] <- true
-				}
-			} else {
-				if clientPointer[userid].IsConnected() == true {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not logged in"))
-					return
-				} else {
-					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
-					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
-					return
-				}
-			}
 		}
 
-		response := map[string]interface{}{"Details": "Logged out"}
+		list := []map[string]interface{}{}
+		for _, endpoint := range endpoints {
+			list = append(list, endpoint.toMap())
+		}
+
+		response := map[string]interface{}{"endpoints": list}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Pair by Phone. Retrieves the code to pair by phone number instead of QR
-func (s *server) PairPhone() http.HandlerFunc {
-
-	type pairStruct struct {
-		Phone string
+// Adds a webhook endpoint with its own event subscriptions and format
+func (s *server) AddWebhookEndpoint() http.HandlerFunc {
+	type endpointStruct struct {
+		Url     string   `json:"url"`
+		Events  []string `json:"events"`
+		Enabled *bool    `json:"enabled"`
+		Format  string   `json:"format"`
 	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t pairStruct
+		var t endpointStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		if t.Url == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing url in Payload"))
 			return
 		}
+		if t.Format == "" {
+			t.Format = webhookFormatForm
+		}
+		if !Find(webhookFormats, t.Format) {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid format, use one of: "+strings.Join(webhookFormats, ", ")))
+			return
+		}
+		events, err := validateWebhookEvents(t.Events)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+		enabled := true
+		if t.Enabled != nil {
+			enabled = *t.Enabled
+		}
 
-		isLoggedIn := clientPointer[userid].IsLoggedIn()
-		if isLoggedIn {
-			log.Error().Msg(fmt.Sprintf("%s", "Already paired"))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Already paired"))
+		var id int
+		err = s.db.QueryRowx("INSERT INTO webhooks (user_id, url, events, enabled, format) VALUES ($1, $2, $3, $4, $5) RETURNING id",
+			userid, t.Url, events, enabled, t.Format).Scan(&id)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not add webhook endpoint: %v", err)))
 			return
 		}
 
-		linkingCode, err := clientPointer[userid].PairPhone(t.Phone, true, whatsmeow.PairClientChrome, "Chrome (Linux)")
+		endpoint, err := getWebhookEndpoint(s.db, userid, strconv.Itoa(id))
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook endpoint: %v", err)))
 			return
 		}
 
-		response := map[string]interface{}{"LinkingCode": linkingCode}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(endpoint.toMap())
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Gets Connected and LoggedIn Status
-func (s *server) GetStatus() http.HandlerFunc {
-
+// Gets a webhook endpoint
+func (s *server) GetWebhookEndpoint() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		endpoint, err := getWebhookEndpoint(s.db, userid, mux.Vars(r)["id"])
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook endpoint: %v", err)))
+			}
 			return
 		}
 
-		isConnected := clientPointer[userid].IsConnected()
-		isLoggedIn := clientPointer[userid].IsLoggedIn()
-
-		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(endpoint.toMap())
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends a document/attachment message
-func (s *server) SendDocument() http.HandlerFunc {
-
-	type documentStruct struct {
-		Caption     string
-		Phone       string
-		Document    string
-		FileName    string
-		Id          string
-		ContextInfo waProto.ContextInfo
+// Updates a webhook endpoint, only the fields present in the payload are changed
+func (s *server) UpdateWebhookEndpoint() http.HandlerFunc {
+	type endpointStruct struct {
+		Url     *string   `json:"url"`
+		Events  *[]string `json:"events"`
+		Enabled *bool     `json:"enabled"`
+		Format  *string   `json:"format"`
 	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		endpoint, err := getWebhookEndpoint(s.db, userid, mux.Vars(r)["id"])
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook endpoint: %v", err)))
+			}
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t documentStruct
-		err := decoder.Decode(&t)
+		var t endpointStruct
+		err = decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		if t.Url != nil {
+			if *t.Url == "" {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Missing url in Payload"))
+				return
+			}
+			endpoint.Url = *t.Url
 		}
-
-		if t.Document == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
-			return
+		if t.Events != nil {
+			events, err := validateWebhookEvents(*t.Events)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			endpoint.Events = events
+		}
+		if t.Enabled != nil {
+			endpoint.Enabled = *t.Enabled
+		}
+		if t.Format != nil {
+			if !Find(webhookFormats, *t.Format) {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid format, use one of: "+strings.Join(webhookFormats, ", ")))
+				return
+			}
+			endpoint.Format = *t.Format
 		}
 
-		if t.FileName == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
+		tx, err := s.db.Beginx()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update webhook endpoint: %v", err)))
 			return
 		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		defer tx.Rollback()
+		err = tx.QueryRowx("UPDATE webhooks SET url=$1, events=$2, enabled=$3, format=$4, updated_at=NOW() WHERE id=$5 AND user_id=$6 RETURNING updated_at",
+			endpoint.Url, endpoint.Events, endpoint.Enabled, endpoint.Format, endpoint.Id, userid).Scan(&endpoint.UpdatedAt)
+		if err == nil && !endpoint.Enabled {
+			err = failEndpointEntries(tx, endpoint.Id, "webhook endpoint disabled")
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update webhook endpoint: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		responseJson, err := json.Marshal(endpoint.toMap())
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
+// Deletes a webhook endpoint
+func (s *server) DeleteWebhookEndpoint() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		if t.Document[0:29] == "data:application/octet-stream" {
-			dataURL, err := dataurl.DecodeString(t.Document)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaDocument)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Document data should start with \"data:application/octet-stream;base64,\""))
+		tx, err := s.db.Beginx()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete webhook endpoint: %v", err)))
 			return
 		}
-
-		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
-			URL:           proto.String(uploaded.URL),
-			FileName:      &t.FileName,
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			Caption:       proto.String(t.Caption),
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
+		defer tx.Rollback()
+		var webhookID int
+		err = tx.Get(&webhookID, "DELETE FROM webhooks WHERE id=$1 AND user_id=$2 RETURNING id", mux.Vars(r)["id"], userid)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Webhook endpoint not found"))
+			return
 		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		if err == nil {
+			err = failEndpointEntries(tx, webhookID, "webhook endpoint deleted")
+		}
+		if err == nil {
+			err = tx.Commit()
 		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete webhook endpoint: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Webhook endpoint deleted successfully"}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends an audio message
-func (s *server) SendAudio() http.HandlerFunc {
-
-	type audioStruct struct {
-		Phone       string
-		Audio       string
-		Caption     string
-		Id          string
-		ContextInfo waProto.ContextInfo
+// Lists webhook delivery attempts, newest first. Supports filtering by webhook, event type,
+// message id, status (success or failed) and time range, paginated with the before cursor
+func (s *server) ListWebhookDeliveries() http.HandlerFunc {
+	type deliveryStruct struct {
+		Id           int64     `db:"id" json:"id"`
+		OutboxId     int64     `db:"outbox_id" json:"outboxId"`
+		WebhookId    int       `db:"webhook_id" json:"webhookId"`
+		Url          string    `db:"url" json:"url"`
+		EventType    string    `db:"event_type" json:"eventType"`
+		MessageId    string    `db:"message_id" json:"messageId"`
+		Attempt      int       `db:"attempt" json:"attempt"`
+		StatusCode   int       `db:"status_code" json:"statusCode"`
+		LatencyMs    int       `db:"latency_ms" json:"latencyMs"`
+		ResponseBody string    `db:"response_body" json:"responseBody"`
+		Error        string    `db:"error" json:"error"`
+		CreatedAt    time.Time `db:"created_at" json:"createdAt"`
 	}
-
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
+		query := r.URL.Query()
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
+		conditions := []string{"user_id=$1"}
+		args := []interface{}{userid}
+		addCondition := func(condition string, value interface{}) {
+			args = append(args, value)
+			conditions = append(conditions, fmt.Sprintf(condition, len(args)))
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t audioStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
+		if v := query.Get("webhook_id"); v != "" {
+			webhookID, err := strconv.Atoi(v)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid webhook_id"))
+				return
+			}
+			addCondition("webhook_id=$%d", webhookID)
 		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		if v := query.Get("event_type"); v != "" {
+			addCondition("event_type=$%d", v)
 		}
-
-		if t.Audio == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
-			return
+		if v := query.Get("message_id"); v != "" {
+			addCondition("message_ids @> ARRAY[$%d::text]", v)
 		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+		switch query.Get("status") {
+		case "":
+		case "success":
+			conditions = append(conditions, "status_code BETWEEN 200 AND 299")
+		case "failed":
+			conditions = append(conditions, "(status_code NOT BETWEEN 200 AND 299)")
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid status, use success or failed"))
 			return
 		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Audio[0:14] == "data:audio/ogg" {
-			dataURL, err := dataurl.DecodeString(t.Audio)
+		for _, param := range []string{"since", "until"} {
+			v := query.Get(param)
+			if v == "" {
+				continue
+			}
+			ts, err := strconv.ParseInt(v, 10, 64)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid "+param+", expected unix timestamp"))
 				return
+			}
+			if param == "since" {
+				addCondition("created_at>=to_timestamp($%d)", ts)
 			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaAudio)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
+				addCondition("created_at<to_timestamp($%d)", ts)
 			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Audio data should start with \"data:audio/ogg;base64,\""))
-			return
 		}
-
-		ptt := true
-		mime := "audio/ogg; codecs=opus"
-
-		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
-			URL:        proto.String(uploaded.URL),
-			DirectPath: proto.String(uploaded.DirectPath),
-			MediaKey:   uploaded.MediaKey,
-			//Mimetype:      proto.String(http.DetectContentType(filedata)),
-			Mimetype:      &mime,
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			PTT:           &ptt,
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		if v := query.Get("before"); v != "" {
+			before, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid before"))
+				return
 			}
+			addCondition("id<$%d", before)
 		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+		limit := 50
+		if v := query.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit, must be between 1 and 500"))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+			limit = l
 		}
+		args = append(args, limit)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		deliveries := []deliveryStruct{}
+		err := s.db.Select(&deliveries, fmt.Sprintf(`SELECT id, outbox_id, webhook_id, url, event_type, message_id, attempt, status_code, latency_ms, response_body, error, created_at
+			FROM webhook_deliveries WHERE %s ORDER BY id DESC LIMIT $%d`, strings.Join(conditions, " AND "), len(args)), args...)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get webhook deliveries: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"deliveries": deliveries}
+		if len(deliveries) == limit {
+			response["nextBefore"] = deliveries[len(deliveries)-1].Id
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends an Image message
-func (s *server) SendImage() http.HandlerFunc {
-
-	type imageStruct struct {
-		Phone       string
-		Image       string
-		Caption     string
-		Id          string
-		ContextInfo waProto.ContextInfo
-	}
-
+// Sends the payload of a logged delivery again as a new outbox entry
+func (s *server) ReplayWebhookDelivery() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		var outboxID int64
+		err := s.db.Get(&outboxID, "SELECT outbox_id FROM webhook_deliveries WHERE id=$1 AND user_id=$2", mux.Vars(r)["id"], userid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Delivery not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get delivery: %v", err)))
+			}
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
-		err := decoder.Decode(&t)
+		newID, err := webhookQueue.Requeue(userid, outboxID)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Delivery payload no longer available"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not replay delivery: %v", err)))
+			}
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
+		log.Info().Str("userid", txtid).Int64("outboxid", newID).Msg("Webhook delivery replayed")
+		response := map[string]interface{}{"Details": "Delivery queued", "outboxId": newID}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		if t.Image == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
-			return
+// Updates the webhook signing secret, token opt-in and body format when present in the request.
+// Returns the new secret so it can be shown to the user once.
+func (s *server) setWebhookOptions(userid int, secret *string, generate bool, includeToken *bool, format *string) (string, error) {
+	newSecret := ""
+	if generate {
+		generated, err := generateWebhookSecret()
+		if err != nil {
+			return "", err
 		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		newSecret = generated
+		secret = &newSecret
+	} else if secret != nil {
+		newSecret = *secret
+	}
+	if secret != nil {
+		_, err := s.db.Exec("UPDATE users SET webhook_secret=$1 WHERE id=$2", *secret, userid)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+			return "", err
 		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+	}
+	if includeToken != nil {
+		_, err := s.db.Exec("UPDATE users SET webhook_include_token=$1 WHERE id=$2", *includeToken, userid)
+		if err != nil {
+			return "", err
+		}
+	}
+	if format != nil {
+		_, err := s.db.Exec("UPDATE users SET webhook_format=$1 WHERE id=$2", *format, userid)
+		if err != nil {
+			return "", err
 		}
+	}
+	return newSecret, nil
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-		var thumbnailBytes []byte
+// Streams the session events as Server-Sent Events. Clients can resume by sending
+// the Last-Event-ID header (or lastEventId query parameter) of the last event received.
+func (s *server) StreamEvents() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		if t.Image[0:10] == "data:image" {
-			dataURL, err := dataurl.DecodeString(t.Image)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Streaming not supported"))
+			return
+		}
 
-			// decode jpeg into image.Image
-			reader := bytes.NewReader(filedata)
-			img, _, err := image.Decode(reader)
+		lastEventID := r.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = r.URL.Query().Get("lastEventId")
+		}
+		var lastID uint64
+		if lastEventID != "" {
+			var err error
+			lastID, err = strconv.ParseUint(lastEventID, 10, 64)
 			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not decode image for thumbnail preparation: %v", err)))
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Last-Event-ID"))
 				return
 			}
+		}
 
-			// resize to width 72 using Lanczos resampling and preserve aspect ratio
-			m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
+		// The stream outlives the server write timeout
+		err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		if err != nil {
+			log.Warn().Err(err).Msg("Could not disable write deadline for event stream")
+		}
 
-			tmpFile, err := os.CreateTemp("", "resized-*.jpg")
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create temp file for thumbnail: %v", err)))
-				return
-			}
-			defer tmpFile.Close()
+		backlog, events, cancel := eventStreams.Subscribe(userid, lastID)
+		defer cancel()
 
-			// write new image to file
-			if err := jpeg.Encode(tmpFile, m, nil); err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to encode jpeg: %v", err)))
-				return
-			}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+		flusher.Flush()
 
-			thumbnailBytes, err = os.ReadFile(tmpFile.Name())
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to read %s: %v", tmpFile.Name(), err)))
-				return
-			}
+		log.Info().Str("userid", txtid).Uint64("lastEventId", lastID).Int("backlog", len(backlog)).Msg("Event stream opened")
 
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/png;base64,\""))
-			return
+		for _, evt := range backlog {
+			writeServerSentEvent(w, evt)
 		}
+		flusher.Flush()
 
-		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
-			Caption:       proto.String(t.Caption),
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: thumbnailBytes,
-		}}
-
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		keepalive := time.NewTicker(25 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				log.Info().Str("userid", txtid).Msg("Event stream closed")
+				return
+			case evt, ok := <-events:
+				if !ok {
+					log.Warn().Str("userid", txtid).Msg("Event stream subscriber dropped")
+					return
+				}
+				writeServerSentEvent(w, evt)
+				flusher.Flush()
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
 			}
 		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, evt hubEvent) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", evt.Id, evt.Type, evt.Data)
+}
+
+type proxyStruct struct {
+	ProxyURL string `json:"proxyUrl"`
+	Webhooks bool   `json:"webhooks"`
+}
+
+// Stores the proxy of a user and applies it to the running session
+func (s *server) setProxy(userid int, t proxyStruct) (bool, error) {
+	result, err := s.db.Exec("UPDATE users SET proxy_url=$1, proxy_webhooks=$2 WHERE id=$3", t.ProxyURL, t.Webhooks, userid)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+	if sessions.Running(userid) {
+		err = applyProxy(sessions.Get(userid), sessions.GetHTTP(userid), t.ProxyURL, t.Webhooks)
+		if err != nil {
+			return true, err
 		}
+	}
+	return true, nil
+}
+
+// Gets the proxy of the session
+func (s *server) GetProxy() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		proxyURL, webhooks, err := getUserProxy(s.db, userid)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get proxy: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"proxyUrl": redactProxyURL(proxyURL), "webhooks": webhooks}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends Sticker message
-func (s *server) SendSticker() http.HandlerFunc {
-
-	type stickerStruct struct {
-		Phone        string
-		Sticker      string
-		Id           string
-		PngThumbnail []byte
-		ContextInfo  waProto.ContextInfo
-	}
-
+// Sets the proxy of the session, an empty proxyUrl removes it. The websocket
+// uses the new proxy from the next connection on
+func (s *server) SetProxy() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t stickerStruct
+		var t proxyStruct
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
-
-		if t.Sticker == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker in Payload"))
+		err = validateProxyURL(t.ProxyURL)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		_, err = s.setProxy(userid, t)
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set proxy: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		response := map[string]interface{}{"proxyUrl": redactProxyURL(t.ProxyURL), "webhooks": t.Webhooks}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Sticker[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Sticker)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaImage)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
-		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
-			return
-		}
+// Stores the device identity of a user, it is used from the next pairing on
+func (s *server) setDevice(userid int, d deviceIdentity) (bool, error) {
+	result, err := s.db.Exec("UPDATE users SET device_name=$1, device_platform=$2, device_browser=$3 WHERE id=$4", d.Name, d.Platform, d.Browser, userid)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+	return true, nil
+}
 
-		msg := &waProto.Message{StickerMessage: &waProto.StickerMessage{
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			PngThumbnail:  t.PngThumbnail,
-		}}
+// Gets the device identity shown in the phone's linked devices list
+func (s *server) GetDevice() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		device, err := getUserDevice(s.db, userid)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get device identity: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(device)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends Video message
-func (s *server) SendVideo() http.HandlerFunc {
-
-	type imageStruct struct {
-		Phone         string
-		Video         string
-		Caption       string
-		Id            string
-		JPEGThumbnail []byte
-		ContextInfo   waProto.ContextInfo
-	}
-
+// Sets the device identity shown in the phone's linked devices list. Empty
+// fields are set to their defaults, a paired session keeps the identity it was
+// paired with until it logs out and pairs again
+func (s *server) SetDevice() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t imageStruct
+		var t deviceIdentity
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Video == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		err = t.normalize()
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
 			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
+		_, err = s.setDevice(userid, t)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set device identity: %v", err)))
+			return
 		}
 
-		var uploaded whatsmeow.UploadResponse
-		var filedata []byte
-
-		if t.Video[0:4] == "data" {
-			dataURL, err := dataurl.DecodeString(t.Video)
-			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
-				return
-			} else {
-				filedata = dataURL.Data
-				uploaded, err = clientPointer[userid].Upload(context.Background(), filedata, whatsmeow.MediaVideo)
-				if err != nil {
-					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
-					return
-				}
-			}
+		responseJson, err := json.Marshal(t)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
-			return
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
-			Caption:       proto.String(t.Caption),
-			URL:           proto.String(uploaded.URL),
-			DirectPath:    proto.String(uploaded.DirectPath),
-			MediaKey:      uploaded.MediaKey,
-			Mimetype:      proto.String(http.DetectContentType(filedata)),
-			FileEncSHA256: uploaded.FileEncSHA256,
-			FileSHA256:    uploaded.FileSHA256,
-			FileLength:    proto.Uint64(uint64(len(filedata))),
-			JPEGThumbnail: t.JPEGThumbnail,
-		}}
+// Lists the API keys of the user, without the keys themselves
+func (s *server) ListKeys() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		keys, err := listAPIKeys(s.db, userid)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not list keys: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		responseJson, err := json.Marshal(keys)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends Contact
-func (s *server) SendContact() http.HandlerFunc {
-
-	type contactStruct struct {
-		Phone       string
-		Id          string
-		Name        string
-		Vcard       string
-		ContextInfo waProto.ContextInfo
-	}
-
+// Creates an API key limited to some scopes, the key is only returned here
+func (s *server) AddKey() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t contactStruct
+		var t apiKeyRequest
 		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
-		if t.Vcard == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
+		err = t.validate()
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		token, key, err := createAPIKey(s.db, userid, t.Label, t.Scopes, t.expiresAt())
 		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create key: %v", err)))
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		response := map[string]interface{}{"key": token, "details": key}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		msg := &waProto.Message{ContactMessage: &waProto.ContactMessage{
-			DisplayName: &t.Name,
-			Vcard:       &t.Vcard,
-		}}
+// Revokes an API key of the user on every replica
+func (s *server) DeleteKey() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
-			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		keyid, _ := strconv.Atoi(mux.Vars(r)["id"])
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		found, err := deleteAPIKey(s.db, userid, keyid)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete key: %v", err)))
+			return
+		}
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Key not found"))
 			return
 		}
+		invalidateUserInfo(s.db, userid)
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Key deleted"}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// Sends location
-func (s *server) SendLocation() http.HandlerFunc {
-
-	type locationStruct struct {
-		Phone       string
-		Id          string
-		Name        string
-		Latitude    float64
-		Longitude   float64
-		ContextInfo waProto.ContextInfo
-	}
-
+// Streams the pairing of the session as Server-Sent Events: every new QR code,
+// the pairing success and the QR timeout. The stream ends after success or timeout.
+func (s *server) StreamQR() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Streaming not supported"))
+			return
+		}
+		if !sessions.Running(userid) {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
-		decoder := json.NewDecoder(r.Body)
-		var t locationStruct
-		err := decoder.Decode(&t)
+		err := http.NewResponseController(w).SetWriteDeadline(time.Time{})
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
+			log.Warn().Err(err).Msg("Could not disable write deadline for QR stream")
 		}
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+
+		// Subscribe before reading the current code so no rotation is missed
+		_, events, cancel := qrStreams.Subscribe(userid, 0)
+		defer cancel()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+
+		if client := sessions.Get(userid); client != nil && client.IsLoggedIn() {
+			data, _ := json.Marshal(map[string]interface{}{"jid": client.Store.ID.String()})
+			writeServerSentEvent(w, hubEvent{Type: "success", Data: data})
+			flusher.Flush()
 			return
 		}
-		if t.Latitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
-			return
+		code := ""
+		err = s.db.Get(&code, "SELECT qrcode FROM users WHERE id=$1", userid)
+		if err != nil {
+			log.Warn().Err(err).Str("userid", txtid).Msg("Could not get current QR code")
 		}
-		if t.Longitude == 0 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
-			return
+		if code != "" {
+			data, _ := json.Marshal(map[string]interface{}{"code": code})
+			writeServerSentEvent(w, hubEvent{Type: "code", Data: data})
 		}
+		flusher.Flush()
 
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
+		log.Info().Str("userid", txtid).Msg("QR stream opened")
+		keepalive := time.NewTicker(25 * time.Second)
+		defer keepalive.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				log.Info().Str("userid", txtid).Msg("QR stream closed")
+				return
+			case evt, ok := <-events:
+				if !ok {
+					return
+				}
+				writeServerSentEvent(w, evt)
+				flusher.Flush()
+				if evt.Type == "success" || evt.Type == "timeout" {
+					return
+				}
+			case <-keepalive.C:
+				fmt.Fprint(w, ": keepalive\n\n")
+				flusher.Flush()
+			}
 		}
+	}
+}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
+// Gets QR code encoded in Base64
+func (s *server) GetQR() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		msg := &waProto.Message{LocationMessage: &waProto.LocationMessage{
-			DegreesLatitude:  &t.Latitude,
-			DegreesLongitude: &t.Longitude,
-			Name:             &t.Name,
-		}}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		code := ""
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		} else {
+			if client.IsConnected() == false {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Not connected"))
+				return
 			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			rows, err := s.db.Query("SELECT qrcode AS code FROM users WHERE id=$1 LIMIT 1", userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			defer rows.Close()
+			for rows.Next() {
+				err = rows.Scan(&code)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, err)
+					return
+				}
+			}
+			err = rows.Err()
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, err)
+				return
+			}
+			if client.IsLoggedIn() == true {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Already Loggedin"))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		log.Info().Str("userid", txtid).Str("qrcode", code).Msg("Get QR successful")
+		response := map[string]interface{}{"QRCode": fmt.Sprintf("%s", code)}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Logs out device from Whatsapp (requires to scan QR next time)
+func (s *server) Logout() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		jid := r.Context().Value("userinfo").(Values).Get("Jid")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
+		} else {
+			if client.IsLoggedIn() == true && client.IsConnected() == true {
+				err := client.Logout()
+				if err != nil {
+					log.Error().Str("jid", jid).Msg("Could not perform logout")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not perform logout"))
+					return
+				} else {
+					log.Info().Str("jid", jid).Msg("Logged out")
+					sessions.Stop(userid)
+				}
+			} else {
+				if client.IsConnected() == true {
+					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not logged in")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not logged in"))
+					return
+				} else {
+					log.Warn().Str("jid", jid).Msg("Ignoring logout as it was not connected")
+					s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not disconnect as it was not connected"))
+					return
+				}
+			}
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		response := map[string]interface{}{"Details": "Logged out"}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1333,19 +1278,11 @@ func (s *server) SendLocation() http.HandlerFunc {
 	}
 }
 
-// Sends Buttons (not implemented, does not work)
-
-func (s *server) SendButtons() http.HandlerFunc {
+// Pair by Phone. Retrieves the code to pair by phone number instead of QR
+func (s *server) PairPhone() http.HandlerFunc {
 
-	type buttonStruct struct {
-		ButtonId   string
-		ButtonText string
-	}
-	type textStruct struct {
-		Phone   string
-		Title   string
-		Buttons []buttonStruct
-		Id      string
+	type pairStruct struct {
+		Phone string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1353,16 +1290,14 @@ func (s *server) SendButtons() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t pairStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
@@ -1374,61 +1309,57 @@ func (s *server) SendButtons() http.HandlerFunc {
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
+		isLoggedIn := client.IsLoggedIn()
+		if isLoggedIn {
+			log.Error().Msg(fmt.Sprintf("%s", "Already paired"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Already paired"))
 			return
 		}
 
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
-			return
-		}
-		if len(t.Buttons) > 3 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+		device, err := getUserDevice(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get device identity: %v", err)))
 			return
 		}
+		clientType, displayName := device.pairClient()
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		linkingCode, err := client.PairPhone(t.Phone, true, clientType, displayName)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		response := map[string]interface{}{"LinkingCode": linkingCode}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		var buttons []*waProto.ButtonsMessage_Button
+// Gets Connected and LoggedIn Status
+func (s *server) GetStatus() http.HandlerFunc {
 
-		for _, item := range t.Buttons {
-			buttons = append(buttons, &waProto.ButtonsMessage_Button{
-				ButtonID:       proto.String(item.ButtonId),
-				ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
-				Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
-				NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
-			})
-		}
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		msg2 := &waProto.ButtonsMessage{
-			ContentText: proto.String(t.Title),
-			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
-			Buttons:     buttons,
-		}
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
-			Message: &waProto.Message{
-				ButtonsMessage: msg2,
-			},
-		}}, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		isConnected := client.IsConnected()
+		isLoggedIn := client.IsLoggedIn()
+		state, since := sessions.State(userid)
+
+		response := map[string]interface{}{"Connected": isConnected, "LoggedIn": isLoggedIn, "State": state, "StateSince": since}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
@@ -1439,82 +1370,180 @@ func (s *server) SendButtons() http.HandlerFunc {
 	}
 }
 
-// SendList
-// https://github.com/tulir/whatsmeow/issues/305
-func (s *server) SendList() http.HandlerFunc {
-
-	type rowsStruct struct {
-		RowId       string
-		Title       string
-		Description string
-	}
-
-	type sectionsStruct struct {
-		Title string
-		Rows  []rowsStruct
-	}
+// Sends a document/attachment message
+func (s *server) SendDocument() http.HandlerFunc {
 
-	type listStruct struct {
+	type documentStruct struct {
+		Caption     string
 		Phone       string
-		Title       string
-		Description string
-		ButtonText  string
-		FooterText  string
-		Sections    []sectionsStruct
+		Document    string
+		FileName    string
 		Id          string
+		ContextInfo waProto.ContextInfo
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t listStruct
+		var t documentStruct
 		err := decoder.Decode(&t)
-		marshal, _ := json.Marshal(t)
-		fmt.Println(string(marshal))
 		if err != nil {
-			fmt.Println(err)
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
 		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
 
-		if t.Title == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+		if t.Document == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Document in Payload"))
 			return
 		}
 
-		if t.Description == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
+		if t.FileName == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing FileName in Payload"))
 			return
 		}
 
-		if t.ButtonText == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
-			return
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
 		}
 
-		if len(t.Sections) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if t.Document[0:29] == "data:application/octet-stream" {
+			dataURL, err := dataurl.DecodeString(t.Document)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaDocument)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					return
+				}
+			}
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Document data should start with \"data:application/octet-stream;base64,\""))
 			return
 		}
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+
+		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			URL:           proto.String(uploaded.URL),
+			FileName:      &t.FileName,
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			Caption:       proto.String(t.Caption),
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends an audio message
+func (s *server) SendAudio() http.HandlerFunc {
+
+	type audioStruct struct {
+		Phone       string
+		Audio       string
+		Caption     string
+		Id          string
+		ContextInfo waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t audioStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Audio == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Audio in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
@@ -1524,51 +1553,65 @@ func (s *server) SendList() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		var sections []*waProto.ListMessage_Section
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
 
-		for _, item := range t.Sections {
-			var rows []*waProto.ListMessage_Row
-			id := 1
-			for _, row := range item.Rows {
-				var idtext string
-				if row.RowId == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = row.RowId
+		if t.Audio[0:14] == "data:audio/ogg" {
+			dataURL, err := dataurl.DecodeString(t.Audio)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaAudio)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					return
 				}
-				rows = append(rows, &waProto.ListMessage_Row{
-					RowID:       proto.String(idtext),
-					Title:       proto.String(row.Title),
-					Description: proto.String(row.Description),
-				})
 			}
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Audio data should start with \"data:audio/ogg;base64,\""))
+			return
+		}
 
-			sections = append(sections, &waProto.ListMessage_Section{
-				Title: proto.String(item.Title),
-				Rows:  rows,
-			})
+		ptt := true
+		mime := "audio/ogg; codecs=opus"
+
+		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			URL:        proto.String(uploaded.URL),
+			DirectPath: proto.String(uploaded.DirectPath),
+			MediaKey:   uploaded.MediaKey,
+			//Mimetype:      proto.String(http.DetectContentType(filedata)),
+			Mimetype:      &mime,
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			PTT:           &ptt,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
 		}
-		msg1 := &waProto.ListMessage{
-			Title:       proto.String(t.Title),
-			Description: proto.String(t.Description),
-			ButtonText:  proto.String(t.ButtonText),
-			ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
-			Sections:    sections,
-			FooterText:  proto.String(t.FooterText),
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, &waProto.Message{
-			ViewOnceMessage: &waProto.FutureProofMessage{
-				Message: &waProto.Message{
-					ListMessage: msg1,
-				},
-			}}, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
@@ -1580,109 +1623,1850 @@ func (s *server) SendList() http.HandlerFunc {
 	}
 }
 
-// Sends a regular text message
-func (s *server) SendMessage() http.HandlerFunc {
+// Sends an Image message
+func (s *server) SendImage() http.HandlerFunc {
 
-	type textStruct struct {
+	type imageStruct struct {
 		Phone       string
-		Body        string
+		Image       string
+		Caption     string
 		Id          string
 		ContextInfo waProto.ContextInfo
 	}
 
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t imageStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Image == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+		var thumbnailBytes []byte
+
+		if t.Image[0:10] == "data:image" {
+			dataURL, err := dataurl.DecodeString(t.Image)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaImage)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					return
+				}
+			}
+
+			// decode jpeg into image.Image
+			reader := bytes.NewReader(filedata)
+			img, _, err := image.Decode(reader)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not decode image for thumbnail preparation: %v", err)))
+				return
+			}
+
+			// resize to width 72 using Lanczos resampling and preserve aspect ratio
+			m := resize.Thumbnail(72, 72, img, resize.Lanczos3)
+
+			tmpFile, err := os.CreateTemp("", "resized-*.jpg")
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create temp file for thumbnail: %v", err)))
+				return
+			}
+			defer tmpFile.Close()
+
+			// write new image to file
+			if err := jpeg.Encode(tmpFile, m, nil); err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to encode jpeg: %v", err)))
+				return
+			}
+
+			thumbnailBytes, err = os.ReadFile(tmpFile.Name())
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to read %s: %v", tmpFile.Name(), err)))
+				return
+			}
+
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/png;base64,\""))
+			return
+		}
+
+		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			Caption:       proto.String(t.Caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			JPEGThumbnail: thumbnailBytes,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Sticker message
+func (s *server) SendSticker() http.HandlerFunc {
+
+	type stickerStruct struct {
+		Phone        string
+		Sticker      string
+		Id           string
+		PngThumbnail []byte
+		ContextInfo  waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t stickerStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Sticker == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Sticker in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if t.Sticker[0:4] == "data" {
+			dataURL, err := dataurl.DecodeString(t.Sticker)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaImage)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					return
+				}
+			}
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
+			return
+		}
+
+		msg := &waProto.Message{StickerMessage: &waProto.StickerMessage{
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			PngThumbnail:  t.PngThumbnail,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Video message
+func (s *server) SendVideo() http.HandlerFunc {
+
+	type imageStruct struct {
+		Phone         string
+		Video         string
+		Caption       string
+		Id            string
+		JPEGThumbnail []byte
+		ContextInfo   waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t imageStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Video == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Video in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var uploaded whatsmeow.UploadResponse
+		var filedata []byte
+
+		if t.Video[0:4] == "data" {
+			dataURL, err := dataurl.DecodeString(t.Video)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			} else {
+				filedata = dataURL.Data
+				uploaded, err = client.Upload(context.Background(), filedata, whatsmeow.MediaVideo)
+				if err != nil {
+					s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to upload file: %v", err)))
+					return
+				}
+			}
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Data should start with \"data:mime/type;base64,\""))
+			return
+		}
+
+		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			Caption:       proto.String(t.Caption),
+			URL:           proto.String(uploaded.URL),
+			DirectPath:    proto.String(uploaded.DirectPath),
+			MediaKey:      uploaded.MediaKey,
+			Mimetype:      proto.String(http.DetectContentType(filedata)),
+			FileEncSHA256: uploaded.FileEncSHA256,
+			FileSHA256:    uploaded.FileSHA256,
+			FileLength:    proto.Uint64(uint64(len(filedata))),
+			JPEGThumbnail: t.JPEGThumbnail,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Contact
+func (s *server) SendContact() http.HandlerFunc {
+
+	type contactStruct struct {
+		Phone       string
+		Id          string
+		Name        string
+		Vcard       string
+		ContextInfo waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t contactStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+			return
+		}
+		if t.Vcard == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Vcard in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		msg := &waProto.Message{ContactMessage: &waProto.ContactMessage{
+			DisplayName: &t.Name,
+			Vcard:       &t.Vcard,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends location
+func (s *server) SendLocation() http.HandlerFunc {
+
+	type locationStruct struct {
+		Phone       string
+		Id          string
+		Name        string
+		Latitude    float64
+		Longitude   float64
+		ContextInfo waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t locationStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		if t.Latitude == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Latitude in Payload"))
+			return
+		}
+		if t.Longitude == 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Longitude in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		msg := &waProto.Message{LocationMessage: &waProto.LocationMessage{
+			DegreesLatitude:  &t.Latitude,
+			DegreesLongitude: &t.Longitude,
+			Name:             &t.Name,
+		}}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends Buttons (not implemented, does not work)
+
+func (s *server) SendButtons() http.HandlerFunc {
+
+	type buttonStruct struct {
+		ButtonId   string
+		ButtonText string
+	}
+	type textStruct struct {
+		Phone   string
+		Title   string
+		Buttons []buttonStruct
+		Id      string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Title == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Title in Payload"))
+			return
+		}
+
+		if len(t.Buttons) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Buttons in Payload"))
+			return
+		}
+		if len(t.Buttons) > 3 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("buttons cant more than 3"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var buttons []*waProto.ButtonsMessage_Button
+
+		for _, item := range t.Buttons {
+			buttons = append(buttons, &waProto.ButtonsMessage_Button{
+				ButtonID:       proto.String(item.ButtonId),
+				ButtonText:     &waProto.ButtonsMessage_Button_ButtonText{DisplayText: proto.String(item.ButtonText)},
+				Type:           waProto.ButtonsMessage_Button_RESPONSE.Enum(),
+				NativeFlowInfo: &waProto.ButtonsMessage_Button_NativeFlowInfo{},
+			})
+		}
+
+		msg2 := &waProto.ButtonsMessage{
+			ContentText: proto.String(t.Title),
+			HeaderType:  waProto.ButtonsMessage_EMPTY.Enum(),
+			Buttons:     buttons,
+		}
+
+		msg := &waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+			Message: &waProto.Message{
+				ButtonsMessage: msg2,
+			},
+		}}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// SendList
+// https://github.com/tulir/whatsmeow/issues/305
+func (s *server) SendList() http.HandlerFunc {
+
+	type rowsStruct struct {
+		RowId       string
+		Title       string
+		Description string
+	}
+
+	type sectionsStruct struct {
+		Title string
+		Rows  []rowsStruct
+	}
+
+	type listStruct struct {
+		Phone       string
+		Title       string
+		Description string
+		ButtonText  string
+		FooterText  string
+		Sections    []sectionsStruct
+		Id          string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("no session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t listStruct
+		err := decoder.Decode(&t)
+		marshal, _ := json.Marshal(t)
+		fmt.Println(string(marshal))
+		if err != nil {
+			fmt.Println(err)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Phone in Payload"))
+			return
+		}
+
+		if t.Title == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Title in Payload"))
+			return
+		}
+
+		if t.Description == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Description in Payload"))
+			return
+		}
+
+		if t.ButtonText == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing ButtonText in Payload"))
+			return
+		}
+
+		if len(t.Sections) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("missing Sections in Payload"))
+			return
+		}
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var sections []*waProto.ListMessage_Section
+
+		for _, item := range t.Sections {
+			var rows []*waProto.ListMessage_Row
+			id := 1
+			for _, row := range item.Rows {
+				var idtext string
+				if row.RowId == "" {
+					idtext = strconv.Itoa(id)
+				} else {
+					idtext = row.RowId
+				}
+				rows = append(rows, &waProto.ListMessage_Row{
+					RowID:       proto.String(idtext),
+					Title:       proto.String(row.Title),
+					Description: proto.String(row.Description),
+				})
+			}
+
+			sections = append(sections, &waProto.ListMessage_Section{
+				Title: proto.String(item.Title),
+				Rows:  rows,
+			})
+		}
+		msg1 := &waProto.ListMessage{
+			Title:       proto.String(t.Title),
+			Description: proto.String(t.Description),
+			ButtonText:  proto.String(t.ButtonText),
+			ListType:    waProto.ListMessage_SINGLE_SELECT.Enum(),
+			Sections:    sections,
+			FooterText:  proto.String(t.FooterText),
+		}
+
+		msg := &waProto.Message{
+			ViewOnceMessage: &waProto.FutureProofMessage{
+				Message: &waProto.Message{
+					ListMessage: msg1,
+				},
+			}}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Sends a regular text message
+func (s *server) SendMessage() http.HandlerFunc {
+
+	type textStruct struct {
+		Phone       string
+		Body        string
+		Id          string
+		ContextInfo waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t textStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		//	msg := &waProto.Message{Conversation: &t.Body}
+
+		msg := &waProto.Message{
+			ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text: &t.Body,
+			},
+		}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Sends a edit text message
+func (s *server) SendEditMessage() http.HandlerFunc {
+
+	type editStruct struct {
+		Phone       string
+		Body        string
+		Id          string
+		ContextInfo waProto.ContextInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t editStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+			return
+		}
+
+		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
+		if err != nil {
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, err)
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		} else {
+			msgid = t.Id
+		}
+
+		msg := &waProto.Message{
+			ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text: &t.Body,
+			},
+		}
+
+		if t.ContextInfo.StanzaID != nil {
+			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
+				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
+				Participant:   proto.String(*t.ContextInfo.Participant),
+				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
+			}
+		}
+		if t.ContextInfo.MentionedJID != nil {
+			if msg.ExtendedTextMessage.ContextInfo == nil {
+				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+			}
+			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
+		}
+
+		editMsg := client.BuildEdit(recipient, msgid, msg)
+		resp, err = client.SendMessage(context.Background(), recipient, editMsg)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending edit message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, resp.ID, resp.Timestamp, editMsg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message edit sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Sends a delete message
+func (s *server) SendDeleteMessage() http.HandlerFunc {
+
+	type deleteStruct struct {
+		Chat  string
+		Phone string
+		Id    string
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+
+		decoder := json.NewDecoder(r.Body)
+		var t deleteStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Chat == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Chat in Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		chat, ok := parseJID(t.Chat)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Chat"))
+			return
+		}
+
+		phone, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+			return
+		} else {
+			msgid = t.Id
+		}
+
+		revokeMsg := client.BuildRevoke(chat, phone, msgid)
+		resp, err = client.SendMessage(context.Background(), chat, revokeMsg)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending delete message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, chat, resp.ID, resp.Timestamp, revokeMsg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message delete sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+/*
+// Sends a Template message
+func (s *server) SendTemplate() http.HandlerFunc {
+
+	type buttonStruct struct {
+		DisplayText string
+		Id          string
+		Url         string
+		PhoneNumber string
+		Type        string
+	}
+
+	type templateStruct struct {
+		Phone   string
+		Content string
+		Footer  string
+		Id      string
+		Buttons []buttonStruct
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		msgid := ""
+		var resp whatsmeow.SendResponse
+//var ts time.Time
+
+		decoder := json.NewDecoder(r.Body)
+		var t templateStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if t.Phone == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if t.Content == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+			return
+		}
+
+		if t.Footer == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+			return
+		}
+
+		if len(t.Buttons) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
+			return
+		}
+
+		recipient, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		if t.Id == "" {
+			msgid = whatsmeow.GenerateMessageID()
+		} else {
+			msgid = t.Id
+		}
+
+		var buttons []*waProto.HydratedTemplateButton
+
+		id := 1
+		for _, item := range t.Buttons {
+			switch item.Type {
+			case "quickreply":
+				var idtext string
+				text := item.DisplayText
+				if item.Id == "" {
+					idtext = strconv.Itoa(id)
+				} else {
+					idtext = item.Id
+				}
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
+						QuickReplyButton: &waProto.HydratedQuickReplyButton{
+							DisplayText: &text,
+							Id:          proto.String(idtext),
+						},
+					},
+				})
+			case "url":
+				text := item.DisplayText
+				url := item.Url
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_UrlButton{
+						UrlButton: &waProto.HydratedURLButton{
+							DisplayText: &text,
+							Url:         &url,
+						},
+					},
+				})
+			case "call":
+				text := item.DisplayText
+				phonenumber := item.PhoneNumber
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_CallButton{
+						CallButton: &waProto.HydratedCallButton{
+							DisplayText: &text,
+							PhoneNumber: &phonenumber,
+						},
+					},
+				})
+			default:
+				text := item.DisplayText
+				buttons = append(buttons, &waProto.HydratedTemplateButton{
+					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
+						QuickReplyButton: &waProto.HydratedQuickReplyButton{
+							DisplayText: &text,
+							Id:          proto.String(string(id)),
+						},
+					},
+				})
+			}
+			id++
+		}
+
+		msg := &waProto.Message{TemplateMessage: &waProto.TemplateMessage{
+			HydratedTemplate: &waProto.HydratedFourRowTemplate{
+				HydratedContentText: proto.String(t.Content),
+				HydratedFooterText:  proto.String(t.Footer),
+				HydratedButtons:     buttons,
+				TemplateId:          proto.String("1"),
+			},
+		},
+		}
+
+		resp, err = client.SendMessage(context.Background(),recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			return
+		}
+
+		s.saveSentMessage(userid, recipient, msgid, resp.Timestamp, msg)
+
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
+		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+*/
+// checks if users/phones are on Whatsapp
+func (s *server) CheckUser() http.HandlerFunc {
+
+	type checkUserStruct struct {
+		Phone []string
+	}
+
+	type User struct {
+		Query        string
+		IsInWhatsapp bool
+		JID          string
+		VerifiedName string
+	}
+
+	type UserCollection struct {
+		Users []User
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t checkUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		resp, err := client.IsOnWhatsApp(t.Phone)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			return
+		}
+
+		uc := new(UserCollection)
+		for _, item := range resp {
+			if item.VerifiedName != nil {
+				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: item.VerifiedName.Details.GetVerifiedName()}
+				uc.Users = append(uc.Users, msg)
+			} else {
+				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: ""}
+				uc.Users = append(uc.Users, msg)
+			}
+		}
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets user information
+func (s *server) GetUser() http.HandlerFunc {
+
+	type checkUserStruct struct {
+		Phone []string
+	}
+
+	type UserCollection struct {
+		Users map[types.JID]types.UserInfo
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t checkUserStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		var jids []types.JID
+		for _, arg := range t.Phone {
+			jid, err := types.ParseJID(arg)
+			if err != nil {
+				return
+			}
+			jids = append(jids, jid)
+		}
+		resp, err := client.GetUserInfo(jids)
+
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get user info: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+		uc := new(UserCollection)
+		uc.Users = make(map[types.JID]types.UserInfo)
+
+		for jid, info := range resp {
+			uc.Users[jid] = info
+		}
+
+		responseJson, err := json.Marshal(uc)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets avatar info for user
+func (s *server) GetAvatar() http.HandlerFunc {
+
+	type getAvatarStruct struct {
+		Phone   string
+		Preview bool
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t getAvatarStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		jid, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		var pic *types.ProfilePictureInfo
+
+		existingID := ""
+		pic, err = client.GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
+			Preview:    t.Preview,
+			ExistingID: existingID,
+		})
+		if err != nil {
+			msg := fmt.Sprintf("Failed to get avatar: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+			return
+		}
+
+		if pic == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No avatar found"))
+			return
+		}
+
+		log.Info().Str("id", pic.ID).Str("url", pic.URL).Msg("Got avatar")
+
+		responseJson, err := json.Marshal(pic)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Gets all contacts
+func (s *server) GetContacts() http.HandlerFunc {
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		result := map[types.JID]types.ContactInfo{}
+		result, err := client.Store.Contacts.GetAllContacts()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+			return
+		}
+
+		responseJson, err := json.Marshal(result)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+
+		return
+	}
+}
+
+// Sets Chat Presence (typing/paused/recording audio)
+func (s *server) ChatPresence() http.HandlerFunc {
+
+	type chatPresenceStruct struct {
+		Phone string
+		State string
+		Media types.ChatPresenceMedia
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t chatPresenceStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+
+		if len(t.State) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing State in Payload"))
+			return
+		}
+
+		jid, ok := parseJID(t.Phone)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			return
+		}
+
+		err = client.SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure sending chat presence to Whatsapp servers"))
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Chat presence set successfuly"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Image and returns base64 representation
+func (s *server) DownloadImage() http.HandlerFunc {
+
+	type downloadImageStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var imgdata []byte
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadImageStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		img := msg.GetImageMessage()
+
+		if img != nil {
+			imgdata, err = client.Download(img)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
+				msg := fmt.Sprintf("Failed to download image %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			mimetype = img.GetMimetype()
+		}
+
+		dataURL := dataurl.New(imgdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Document and returns base64 representation
+func (s *server) DownloadDocument() http.HandlerFunc {
+
+	type downloadDocumentStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		mimetype := ""
+		var docdata []byte
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
+		}
+
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
+
+		decoder := json.NewDecoder(r.Body)
+		var t downloadDocumentStruct
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
+
+		doc := msg.GetDocumentMessage()
+
+		if doc != nil {
+			docdata, err = client.Download(doc)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
+				msg := fmt.Sprintf("Failed to download document %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
+			}
+			mimetype = doc.GetMimetype()
+		}
+
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
+		return
+	}
+}
+
+// Downloads Video and returns base64 representation
+func (s *server) DownloadVideo() http.HandlerFunc {
+
+	type downloadVideoStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
+	}
+
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		mimetype := ""
+		var docdata []byte
+
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
-		err := decoder.Decode(&t)
+		var t downloadVideoStruct
+		err = decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
-			return
-		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
-		}
-
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
-		} else {
-			msgid = t.Id
-		}
-
-		//	msg := &waProto.Message{Conversation: &t.Body}
+		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
 
-		msg := &waProto.Message{
-			ExtendedTextMessage: &waProto.ExtendedTextMessage{
-				Text: &t.Body,
-			},
-		}
+		doc := msg.GetVideoMessage()
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+		if doc != nil {
+			docdata, err = client.Download(doc)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
+				msg := fmt.Sprintf("Failed to download video %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
-			return
+			mimetype = doc.GetMimetype()
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
 		return
 	}
 }
 
-// Sends a edit text message
-func (s *server) SendEditMessage() http.HandlerFunc {
+// Downloads Audio and returns base64 representation
+func (s *server) DownloadAudio() http.HandlerFunc {
 
-	type editStruct struct {
-		Phone       string
-		Body        string
-		Id          string
-		ContextInfo waProto.ContextInfo
+	type downloadAudioStruct struct {
+		Url           string
+		DirectPath    string
+		MediaKey      []byte
+		Mimetype      string
+		FileEncSHA256 []byte
+		FileSHA256    []byte
+		FileLength    uint64
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1690,91 +3474,75 @@ func (s *server) SendEditMessage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		mimetype := ""
+		var docdata []byte
+
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
+		// check/creates user directory for files
+		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
+		_, err := os.Stat(userDirectory)
+		if os.IsNotExist(err) {
+			errDir := os.MkdirAll(userDirectory, 0751)
+			if errDir != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+				return
+			}
+		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t editStruct
-		err := decoder.Decode(&t)
+		var t downloadAudioStruct
+		err = decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
-			return
-		}
-
-		recipient, err := validateMessageFields(t.Phone, t.ContextInfo.StanzaID, t.ContextInfo.Participant)
-		if err != nil {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, err)
-			return
-		}
-
-		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
-			return
-		} else {
-			msgid = t.Id
-		}
+		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
+			URL:           proto.String(t.Url),
+			DirectPath:    proto.String(t.DirectPath),
+			MediaKey:      t.MediaKey,
+			Mimetype:      proto.String(t.Mimetype),
+			FileEncSHA256: t.FileEncSHA256,
+			FileSHA256:    t.FileSHA256,
+			FileLength:    &t.FileLength,
+		}}
 
-		msg := &waProto.Message{
-			ExtendedTextMessage: &waProto.ExtendedTextMessage{
-				Text: &t.Body,
-			},
-		}
+		doc := msg.GetAudioMessage()
 
-		if t.ContextInfo.StanzaID != nil {
-			msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{
-				StanzaID:      proto.String(*t.ContextInfo.StanzaID),
-				Participant:   proto.String(*t.ContextInfo.Participant),
-				QuotedMessage: &waProto.Message{Conversation: proto.String("")},
-			}
-		}
-		if t.ContextInfo.MentionedJID != nil {
-			if msg.ExtendedTextMessage.ContextInfo == nil {
-				msg.ExtendedTextMessage.ContextInfo = &waProto.ContextInfo{}
+		if doc != nil {
+			docdata, err = client.Download(doc)
+			if err != nil {
+				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
+				msg := fmt.Sprintf("Failed to download audio %v", err)
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
+				return
 			}
-			msg.ExtendedTextMessage.ContextInfo.MentionedJID = t.ContextInfo.MentionedJID
-		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, clientPointer[userid].BuildEdit(recipient, msgid, msg))
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending edit message: %v", err)))
-			return
+			mimetype = doc.GetMimetype()
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message edit sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		dataURL := dataurl.New(docdata, mimetype)
+		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
 		return
 	}
 }
 
-// Sends a delete message
-func (s *server) SendDeleteMessage() http.HandlerFunc {
+// React
+func (s *server) React() http.HandlerFunc {
 
-	type deleteStruct struct {
-		Chat  string
+	type textStruct struct {
 		Phone string
+		Body  string
 		Id    string
 	}
 
@@ -1783,7 +3551,8 @@ func (s *server) SendDeleteMessage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
@@ -1792,32 +3561,27 @@ func (s *server) SendDeleteMessage() http.HandlerFunc {
 		var resp whatsmeow.SendResponse
 
 		decoder := json.NewDecoder(r.Body)
-		var t deleteStruct
+		var t textStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Chat == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Chat in Payload"))
-			return
-		}
-
 		if t.Phone == "" {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
 			return
 		}
 
-		chat, ok := parseJID(t.Chat)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Chat"))
+		if t.Body == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
 			return
 		}
 
-		phone, ok := parseJID(t.Phone)
+		recipient, ok := parseJID(t.Phone)
 		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+			log.Error().Msg(fmt.Sprintf("%s", err))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
 			return
 		}
 
@@ -1828,43 +3592,55 @@ func (s *server) SendDeleteMessage() http.HandlerFunc {
 			msgid = t.Id
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(), chat, clientPointer[userid].BuildRevoke(chat, phone, msgid))
+		fromMe := false
+		if strings.HasPrefix(msgid, "me:") {
+			fromMe = true
+			msgid = msgid[len("me:"):]
+		}
+		reaction := t.Body
+		if reaction == "remove" {
+			reaction = ""
+		}
+
+		msg := &waProto.Message{
+			ReactionMessage: &waProto.ReactionMessage{
+				Key: &waProto.MessageKey{
+					RemoteJID: proto.String(recipient.String()),
+					FromMe:    proto.Bool(fromMe),
+					ID:        proto.String(msgid),
+				},
+				Text:              proto.String(reaction),
+				GroupingKey:       proto.String(reaction),
+				SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
+			},
+		}
+
+		resp, err = client.SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending delete message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message delete sent")
+		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp.Unix())).Str("id", msgid).Msg("Message sent")
 		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
-		}
-
-		return
-	}
-}
-
-/*
-// Sends a Template message
-func (s *server) SendTemplate() http.HandlerFunc {
-
-	type buttonStruct struct {
-		DisplayText string
-		Id          string
-		Url         string
-		PhoneNumber string
-		Type        string
+		}
+
+		return
 	}
+}
 
-	type templateStruct struct {
-		Phone   string
-		Content string
-		Footer  string
-		Id      string
-		Buttons []buttonStruct
+// Mark messages as read
+func (s *server) MarkRead() http.HandlerFunc {
+
+	type markReadStruct struct {
+		Id     []string
+		Chat   types.JID
+		Sender types.JID
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -1872,156 +3648,100 @@ func (s *server) SendTemplate() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-//var ts time.Time
-
 		decoder := json.NewDecoder(r.Body)
-		var t templateStruct
+		var t markReadStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		if t.Content == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Content in Payload"))
+		if t.Chat.String() == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Chat in Payload"))
 			return
 		}
 
-		if t.Footer == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Footer in Payload"))
+		if len(t.Id) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
 			return
 		}
 
-		if len(t.Buttons) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Buttons in Payload"))
+		err = client.MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure marking messages as read"))
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
-			return
+		err = setChatUnreadCount(s.db, userid, t.Chat, 0)
+		if err != nil {
+			log.Error().Err(err).Str("chat", t.Chat.String()).Msg("Could not update chat unread count")
 		}
 
-		if t.Id == "" {
-			msgid = whatsmeow.GenerateMessageID()
+		response := map[string]interface{}{"Details": "Message(s) marked as read"}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
-			msgid = t.Id
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+		return
+	}
+}
 
-		var buttons []*waProto.HydratedTemplateButton
+// List groups
+func (s *server) ListGroups() http.HandlerFunc {
 
-		id := 1
-		for _, item := range t.Buttons {
-			switch item.Type {
-			case "quickreply":
-				var idtext string
-				text := item.DisplayText
-				if item.Id == "" {
-					idtext = strconv.Itoa(id)
-				} else {
-					idtext = item.Id
-				}
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(idtext),
-						},
-					},
-				})
-			case "url":
-				text := item.DisplayText
-				url := item.Url
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_UrlButton{
-						UrlButton: &waProto.HydratedURLButton{
-							DisplayText: &text,
-							Url:         &url,
-						},
-					},
-				})
-			case "call":
-				text := item.DisplayText
-				phonenumber := item.PhoneNumber
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_CallButton{
-						CallButton: &waProto.HydratedCallButton{
-							DisplayText: &text,
-							PhoneNumber: &phonenumber,
-						},
-					},
-				})
-			default:
-				text := item.DisplayText
-				buttons = append(buttons, &waProto.HydratedTemplateButton{
-					HydratedButton: &waProto.HydratedTemplateButton_QuickReplyButton{
-						QuickReplyButton: &waProto.HydratedQuickReplyButton{
-							DisplayText: &text,
-							Id:          proto.String(string(id)),
-						},
-					},
-				})
-			}
-			id++
-		}
+	type GroupCollection struct {
+		Groups []types.GroupInfo
+	}
 
-		msg := &waProto.Message{TemplateMessage: &waProto.TemplateMessage{
-			HydratedTemplate: &waProto.HydratedFourRowTemplate{
-				HydratedContentText: proto.String(t.Content),
-				HydratedFooterText:  proto.String(t.Footer),
-				HydratedButtons:     buttons,
-				TemplateId:          proto.String("1"),
-			},
-		},
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+
+		client := sessions.Get(userid)
+		if client == nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+			return
 		}
 
-		resp, err = clientPointer[userid].SendMessage(context.Background(),recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
+		resp, err := client.GetJoinedGroups()
+
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			msg := fmt.Sprintf("Failed to get group list: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
-		responseJson, err := json.Marshal(response)
+		gc := new(GroupCollection)
+		for _, info := range resp {
+			gc.Groups = append(gc.Groups, *info)
+		}
+
+		responseJson, err := json.Marshal(gc)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
-*/
-// checks if users/phones are on Whatsapp
-func (s *server) CheckUser() http.HandlerFunc {
-
-	type checkUserStruct struct {
-		Phone []string
-	}
 
-	type User struct {
-		Query        string
-		IsInWhatsapp bool
-		JID          string
-		VerifiedName string
-	}
+// Get group info
+func (s *server) GetGroupInfo() http.HandlerFunc {
 
-	type UserCollection struct {
-		Users []User
+	type getGroupInfoStruct struct {
+		GroupJID string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2029,59 +3749,52 @@ func (s *server) CheckUser() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t checkUserStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+		// Get GroupJID from query parameter
+		groupJID := r.URL.Query().Get("groupJID")
+		if groupJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		group, ok := parseJID(groupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
 			return
 		}
 
-		resp, err := clientPointer[userid].IsOnWhatsApp(t.Phone)
+		resp, err := client.GetGroupInfo(group)
+
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Failed to check if users are on WhatsApp: %s", err)))
+			msg := fmt.Sprintf("Failed to get group info: %v", err)
+			log.Error().Msg(msg)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		uc := new(UserCollection)
-		for _, item := range resp {
-			if item.VerifiedName != nil {
-				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: item.VerifiedName.Details.GetVerifiedName()}
-				uc.Users = append(uc.Users, msg)
-			} else {
-				var msg = User{Query: item.Query, IsInWhatsapp: item.IsIn, JID: fmt.Sprintf("%s", item.JID), VerifiedName: ""}
-				uc.Users = append(uc.Users, msg)
-			}
-		}
-		responseJson, err := json.Marshal(uc)
+		responseJson, err := json.Marshal(resp)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Gets user information
-func (s *server) GetUser() http.HandlerFunc {
-
-	type checkUserStruct struct {
-		Phone []string
-	}
+// Get group invite link
+func (s *server) GetGroupInviteLink() http.HandlerFunc {
 
-	type UserCollection struct {
-		Users map[types.JID]types.UserInfo
+	type getGroupInfoStruct struct {
+		GroupJID string
+		Reset    bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2089,64 +3802,64 @@ func (s *server) GetUser() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t checkUserStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		// Get GroupJID from query parameter
+		groupJID := r.URL.Query().Get("groupJID")
+		if groupJID == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
 			return
 		}
 
-		var jids []types.JID
-		for _, arg := range t.Phone {
-			jid, err := types.ParseJID(arg)
+		// Get reset parameter
+		resetParam := r.URL.Query().Get("reset")
+		reset := false
+		if resetParam != "" {
+			var err error
+			reset, err = strconv.ParseBool(resetParam)
 			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid reset parameter, must be true or false"))
 				return
 			}
-			jids = append(jids, jid)
 		}
-		resp, err := clientPointer[userid].GetUserInfo(jids)
 
-		if err != nil {
-			msg := fmt.Sprintf("Failed to get user info: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+		group, ok := parseJID(groupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
 			return
 		}
 
-		uc := new(UserCollection)
-		uc.Users = make(map[types.JID]types.UserInfo)
+		resp, err := client.GetGroupInviteLink(group, reset)
 
-		for jid, info := range resp {
-			uc.Users[jid] = info
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite link")
+			msg := fmt.Sprintf("Failed to get group invite link: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
 		}
 
-		responseJson, err := json.Marshal(uc)
+		response := map[string]interface{}{"InviteLink": resp}
+		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Gets avatar info for user
-func (s *server) GetAvatar() http.HandlerFunc {
+// Get group invite info
+func (s *server) GetGroupInviteInfo() http.HandlerFunc {
 
-	type getAvatarStruct struct {
-		Phone   string
-		Preview bool
+	type getGroupInviteInfoStruct struct {
+		Code string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2154,82 +3867,111 @@ func (s *server) GetAvatar() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t getAvatarStruct
+		var t getGroupInviteInfoStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		if t.Code == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Code in Payload"))
 			return
 		}
 
-		var pic *types.ProfilePictureInfo
+		groupInfo, err := client.GetGroupInfoFromLink(t.Code)
 
-		existingID := ""
-		pic, err = clientPointer[userid].GetProfilePictureInfo(jid, &whatsmeow.GetProfilePictureParams{
-			Preview:    t.Preview,
-			ExistingID: existingID,
-		})
 		if err != nil {
-			msg := fmt.Sprintf("Failed to get avatar: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-			return
-		}
-
-		if pic == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No avatar found"))
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite info")
+			msg := fmt.Sprintf("Failed to get group invite info: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		log.Info().Str("id", pic.ID).Str("url", pic.URL).Msg("Got avatar")
+		responseJson, err := json.Marshal(groupInfo)
 
-		responseJson, err := json.Marshal(pic)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Gets all contacts
-func (s *server) GetContacts() http.HandlerFunc {
+// Set group photo
+func (s *server) SetGroupPhoto() http.HandlerFunc {
+
+	type setGroupPhotoStruct struct {
+		GroupJID string
+		Image    string
+	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		result := map[types.JID]types.ContactInfo{}
-		result, err := clientPointer[userid].Store.Contacts.GetAllContacts()
+		decoder := json.NewDecoder(r.Body)
+		var t setGroupPhotoStruct
+		err := decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		responseJson, err := json.Marshal(result)
+		group, ok := parseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if t.Image == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+			return
+		}
+
+		var filedata []byte
+
+		if t.Image[0:13] == "data:image/jp" {
+			dataURL, err := dataurl.DecodeString(t.Image)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				return
+			} else {
+				filedata = dataURL.Data
+			}
+		} else {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/jpeg;base64,\""))
+			return
+		}
+
+		picture_id, err := client.SetGroupPhoto(group, filedata)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group photo")
+			msg := fmt.Sprintf("Failed to set group photo: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
+		}
+
+		response := map[string]interface{}{"Details": "Group Photo set successfully", "PictureID": picture_id}
+		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
@@ -2240,13 +3982,12 @@ func (s *server) GetContacts() http.HandlerFunc {
 	}
 }
 
-// Sets Chat Presence (typing/paused/recording audio)
-func (s *server) ChatPresence() http.HandlerFunc {
+// Set group name
+func (s *server) SetGroupName() http.HandlerFunc {
 
-	type chatPresenceStruct struct {
-		Phone string
-		State string
-		Media types.ChatPresenceMedia
+	type setGroupNameStruct struct {
+		GroupJID string
+		Name     string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2254,63 +3995,59 @@ func (s *server) ChatPresence() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t chatPresenceStruct
+		var t setGroupNameStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		group, ok := parseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
 			return
 		}
 
-		if len(t.State) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing State in Payload"))
+		if t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
 			return
 		}
 
-		jid, ok := parseJID(t.Phone)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
-			return
-		}
+		err = client.SetGroupName(group, t.Name)
 
-		err = clientPointer[userid].SendChatPresence(jid, types.ChatPresence(t.State), types.ChatPresenceMedia(t.Media))
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure sending chat presence to Whatsapp servers"))
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
+			msg := fmt.Sprintf("Failed to set group name: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Chat presence set successfuly"}
+		response := map[string]interface{}{"Details": "Group Name set successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Image and returns base64 representation
-func (s *server) DownloadImage() http.HandlerFunc {
+// Set group topic (description)
+func (s *server) SetGroupTopic() http.HandlerFunc {
 
-	type downloadImageStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type setGroupTopicStruct struct {
+		GroupJID string
+		Topic    string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2318,79 +4055,61 @@ func (s *server) DownloadImage() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var imgdata []byte
-
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t downloadImageStruct
-		err = decoder.Decode(&t)
+		var t setGroupTopicStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{ImageMessage: &waProto.ImageMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		group, ok := parseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
 
-		img := msg.GetImageMessage()
+		if t.Topic == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Topic in Payload"))
+			return
+		}
 
-		if img != nil {
-			imgdata, err = clientPointer[userid].Download(img)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download image")
-				msg := fmt.Sprintf("Failed to download image %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = img.GetMimetype()
+		err = client.SetGroupTopic(group, "", "", t.Topic)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group topic")
+			msg := fmt.Sprintf("Failed to set group topic: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
 		}
 
-		dataURL := dataurl.New(imgdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Details": "Group Topic set successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Document and returns base64 representation
-func (s *server) DownloadDocument() http.HandlerFunc {
+// add, remove, promote and demote members group
+func (s *server) UpdateGroupParticipants() http.HandlerFunc {
 
-	type downloadDocumentStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type updateGroupParticipantsStruct struct {
+		GroupJID string
+		Phone    []string
+		// Action string // add, remove, promote, demote
+		Action string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2398,79 +4117,90 @@ func (s *server) DownloadDocument() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
+		decoder := json.NewDecoder(r.Body)
+		var t updateGroupParticipantsStruct
+		err := decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			return
+		}
+
+		group, ok := parseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
+
+		if len(t.Phone) < 1 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+			return
+		}
+		// parse phone numbers
+		phoneParsed := make([]types.JID, len(t.Phone))
+		for i, phone := range t.Phone {
+			phoneParsed[i], ok = parseJID(phone)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
 				return
 			}
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t downloadDocumentStruct
-		err = decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+		if t.Action == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Action in Payload"))
+			return
+		}
+
+		// parse action
+
+		var action whatsmeow.ParticipantChange
+		switch t.Action {
+		case "add":
+			action = "add"
+		case "remove":
+			action = "remove"
+		case "promote":
+			action = "promote"
+		case "demote":
+			action = "demote"
+		default:
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Action in Payload"))
 			return
 		}
 
-		msg := &waProto.Message{DocumentMessage: &waProto.DocumentMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
-
-		doc := msg.GetDocumentMessage()
+		_, err = client.UpdateGroupParticipants(group, phoneParsed, action)
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download document")
-				msg := fmt.Sprintf("Failed to download document %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = doc.GetMimetype()
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to change participant group")
+			msg := fmt.Sprintf("Failed to change participant group: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Details": "Group Participants updated successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Video and returns base64 representation
-func (s *server) DownloadVideo() http.HandlerFunc {
+// SetGroupAnnounce post
+func (s *server) SetGroupAnnounce() http.HandlerFunc {
 
-	type downloadVideoStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type setGroupAnnounceStruct struct {
+		GroupJID string
+		Announce bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2478,79 +4208,53 @@ func (s *server) DownloadVideo() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t downloadVideoStruct
-		err = decoder.Decode(&t)
+		var t setGroupAnnounceStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{VideoMessage: &waProto.VideoMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		group, ok := parseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			return
+		}
 
-		doc := msg.GetVideoMessage()
+		err = client.SetGroupAnnounce(group, t.Announce)
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download video")
-				msg := fmt.Sprintf("Failed to download video %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = doc.GetMimetype()
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group announce")
+			msg := fmt.Sprintf("Failed to set group announce: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Details": "Group Announce set successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// Downloads Audio and returns base64 representation
-func (s *server) DownloadAudio() http.HandlerFunc {
+// Join group invite link
+func (s *server) GroupJoin() http.HandlerFunc {
 
-	type downloadAudioStruct struct {
-		Url           string
-		DirectPath    string
-		MediaKey      []byte
-		Mimetype      string
-		FileEncSHA256 []byte
-		FileSHA256    []byte
-		FileLength    uint64
+	type joinGroupStruct struct {
+		Code string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2558,75 +4262,52 @@ func (s *server) DownloadAudio() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		mimetype := ""
-		var docdata []byte
-
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(s.exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create user directory (%s)", userDirectory)))
-				return
-			}
-		}
-
 		decoder := json.NewDecoder(r.Body)
-		var t downloadAudioStruct
-		err = decoder.Decode(&t)
+		var t joinGroupStruct
+		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		msg := &waProto.Message{AudioMessage: &waProto.AudioMessage{
-			URL:           proto.String(t.Url),
-			DirectPath:    proto.String(t.DirectPath),
-			MediaKey:      t.MediaKey,
-			Mimetype:      proto.String(t.Mimetype),
-			FileEncSHA256: t.FileEncSHA256,
-			FileSHA256:    t.FileSHA256,
-			FileLength:    &t.FileLength,
-		}}
+		if t.Code == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Code in Payload"))
+			return
+		}
 
-		doc := msg.GetAudioMessage()
+		_, err = client.JoinGroupWithLink(t.Code)
 
-		if doc != nil {
-			docdata, err = clientPointer[userid].Download(doc)
-			if err != nil {
-				log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to download audio")
-				msg := fmt.Sprintf("Failed to download audio %v", err)
-				s.Respond(w, r, http.StatusInternalServerError, errors.New(msg))
-				return
-			}
-			mimetype = doc.GetMimetype()
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to join group")
+			msg := fmt.Sprintf("Failed to join group: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
+			return
 		}
 
-		dataURL := dataurl.New(docdata, mimetype)
-		response := map[string]interface{}{"Mimetype": mimetype, "Data": dataURL.String()}
+		response := map[string]interface{}{"Details": "Group joined successfully"}
 		responseJson, err := json.Marshal(response)
+
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+
 		return
 	}
 }
 
-// React
-func (s *server) React() http.HandlerFunc {
+// SetGroupAnnounce post
+func (s *server) GroupLeave() http.HandlerFunc {
 
-	type textStruct struct {
-		Phone string
-		Body  string
-		Id    string
+	type groupLeaveStruct struct {
+		GroupJID string
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -2634,966 +4315,1264 @@ func (s *server) React() http.HandlerFunc {
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
+		client := sessions.Get(userid)
+		if client == nil {
 			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
 			return
 		}
 
-		msgid := ""
-		var resp whatsmeow.SendResponse
-
 		decoder := json.NewDecoder(r.Body)
-		var t textStruct
+		var t groupLeaveStruct
 		err := decoder.Decode(&t)
 		if err != nil {
 			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
 			return
 		}
 
-		if t.Phone == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
+		group, ok := parseJID(t.GroupJID)
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
 			return
 		}
 
-		if t.Body == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Body in Payload"))
+		err = client.LeaveGroup(group)
+
+		if err != nil {
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to leave group")
+			msg := fmt.Sprintf("Failed to leave group: %v", err)
+			s.Respond(w, r, http.StatusInternalServerError, msg)
 			return
 		}
 
-		recipient, ok := parseJID(t.Phone)
-		if !ok {
-			log.Error().Msg(fmt.Sprintf("%s", err))
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
-			return
+		response := map[string]interface{}{"Details": "Group left successfully"}
+		responseJson, err := json.Marshal(response)
+
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
 
-		if t.Id == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+		return
+	}
+}
+
+// Lists the stored messages of a conversation, newest first. Use the returned
+// nextCursor as the before parameter to get older messages
+func (s *server) GetMessages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+
+		txtid := r.Context().Value("userinfo").(Values).Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		query := r.URL.Query()
+
+		if query.Get("chat") == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing chat in query"))
+			return
+		}
+		chat, ok := parseJID(query.Get("chat"))
+		if !ok {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse chat"))
 			return
-		} else {
-			msgid = t.Id
 		}
 
-		fromMe := false
-		if strings.HasPrefix(msgid, "me:") {
-			fromMe = true
-			msgid = msgid[len("me:"):]
+		limit := 50
+		if v := query.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > 200 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit, must be between 1 and 200"))
+				return
+			}
+			limit = l
 		}
-		reaction := t.Body
-		if reaction == "remove" {
-			reaction = ""
+		withRaw := query.Get("raw") == "true"
+
+		columns := "id, message_id, chat_jid, sender_jid, from_me, timestamp, type, text, media_type, media_file_name, media_size, media_path, quoted_id, edited_at, deleted"
+		if withRaw {
+			columns += ", raw"
 		}
 
-		msg := &waProto.Message{
-			ReactionMessage: &waProto.ReactionMessage{
-				Key: &waProto.MessageKey{
-					RemoteJID: proto.String(recipient.String()),
-					FromMe:    proto.Bool(fromMe),
-					ID:        proto.String(msgid),
-				},
-				Text:              proto.String(reaction),
-				GroupingKey:       proto.String(reaction),
-				SenderTimestampMS: proto.Int64(time.Now().UnixMilli()),
-			},
+		messages := []storedMessage{}
+		var err error
+		if before := query.Get("before"); before != "" {
+			ts, id, cerr := parseMessageCursor(before)
+			if cerr != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid before cursor"))
+				return
+			}
+			err = s.db.Select(&messages, "SELECT "+columns+" FROM messages WHERE user_id=$1 AND chat_jid=$2 AND (timestamp, id) < ($3, $4) ORDER BY timestamp DESC, id DESC LIMIT $5",
+				userid, chat.ToNonAD().String(), ts, id, limit)
+		} else {
+			err = s.db.Select(&messages, "SELECT "+columns+" FROM messages WHERE user_id=$1 AND chat_jid=$2 ORDER BY timestamp DESC, id DESC LIMIT $3",
+				userid, chat.ToNonAD().String(), limit)
 		}
-
-		resp, err = clientPointer[userid].SendMessage(context.Background(), recipient, msg, whatsmeow.SendRequestExtra{ID: msgid})
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Error sending message: %v", err)))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get messages: %v", err)))
 			return
 		}
 
-		log.Info().Str("timestamp", fmt.Sprintf("%d", resp.Timestamp)).Str("id", msgid).Msg("Message sent")
-		response := map[string]interface{}{"Details": "Sent", "Timestamp": resp.Timestamp, "Id": msgid}
+		list := []map[string]interface{}{}
+		for _, m := range messages {
+			item := map[string]interface{}{
+				"id":        m.MessageId,
+				"chat":      m.ChatJid,
+				"sender":    m.SenderJid,
+				"fromMe":    m.FromMe,
+				"timestamp": m.Timestamp,
+				"type":      m.Type,
+				"text":      m.Text,
+				"deleted":   m.Deleted,
+			}
+			if m.MediaType != "" {
+				item["media"] = map[string]interface{}{
+					"mimeType": m.MediaType,
+					"fileName": m.MediaFileName,
+					"size":     m.MediaSize,
+					"path":     m.MediaPath,
+				}
+			}
+			if m.QuotedId != "" {
+				item["quotedId"] = m.QuotedId
+			}
+			if m.EditedAt.Valid {
+				item["editedAt"] = m.EditedAt.Time
+			}
+			if withRaw {
+				item["raw"] = m.Raw
+			}
+			list = append(list, item)
+		}
+
+		response := map[string]interface{}{"messages": list}
+		if len(messages) == limit {
+			response["nextCursor"] = messageCursor(messages[len(messages)-1])
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Mark messages as read
-func (s *server) MarkRead() http.HandlerFunc {
-
-	type markReadStruct struct {
-		Id     []string
-		Chat   types.JID
-		Sender types.JID
-	}
-
+// Lists the chats of the user, pinned chats first and then by last activity.
+// Use offset and limit to paginate, archived=true|false filters archived chats
+func (s *server) ListChats() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		query := r.URL.Query()
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
+		limit := 50
+		if v := query.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > 200 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit, must be between 1 and 200"))
+				return
+			}
+			limit = l
 		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t markReadStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
+		offset := 0
+		if v := query.Get("offset"); v != "" {
+			o, err := strconv.Atoi(v)
+			if err != nil || o < 0 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid offset"))
+				return
+			}
+			offset = o
 		}
-
-		if t.Chat.String() == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Chat in Payload"))
-			return
+		var archived *bool
+		if v := query.Get("archived"); v != "" {
+			a, err := strconv.ParseBool(v)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid archived, must be true or false"))
+				return
+			}
+			archived = &a
 		}
 
-		if len(t.Id) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Id in Payload"))
+		chats, total, err := listChats(s.db, userid, archived, limit, offset)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not list chats: %v", err)))
 			return
 		}
 
-		err = clientPointer[userid].MarkRead(t.Id, time.Now(), t.Chat, t.Sender)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Failure marking messages as read"))
-			return
+		list := []map[string]interface{}{}
+		for _, c := range chats {
+			jid, _ := types.ParseJID(c.Jid)
+			name := c.Name
+			if client := sessions.Get(userid); name == "" && client != nil && jid.Server == types.DefaultUserServer {
+				contact, err := client.Store.Contacts.GetContact(jid)
+				if err == nil && contact.Found {
+					name = contact.FullName
+					if name == "" {
+						name = contact.PushName
+					}
+					if name == "" {
+						name = contact.BusinessName
+					}
+				}
+			}
+			item := map[string]interface{}{
+				"jid":         c.Jid,
+				"name":        name,
+				"isGroup":     jid.Server == types.GroupServer,
+				"unreadCount": c.UnreadCount,
+				"archived":    c.Archived,
+				"pinned":      c.Pinned,
+				"muted":       c.Muted,
+			}
+			if c.LastMessageAt.Valid {
+				item["lastActivity"] = c.LastMessageAt.Time
+			}
+			if c.Muted && c.MutedUntil.Valid {
+				item["mutedUntil"] = c.MutedUntil.Time
+			}
+			if c.LastId.Valid {
+				item["lastMessage"] = map[string]interface{}{
+					"id":        c.LastId.String,
+					"sender":    c.LastSender.String,
+					"fromMe":    c.LastFromMe.Bool,
+					"type":      c.LastType.String,
+					"text":      c.LastText.String,
+					"timestamp": c.LastTimestamp.Time,
+					"deleted":   c.LastDeleted.Bool,
+				}
+			}
+			list = append(list, item)
 		}
 
-		response := map[string]interface{}{"Details": "Message(s) marked as read"}
+		response := map[string]interface{}{"chats": list, "total": total}
+		if offset+len(chats) < total {
+			response["nextOffset"] = offset + len(chats)
+		}
 		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-		return
 	}
 }
 
-// List groups
-func (s *server) ListGroups() http.HandlerFunc {
-
-	type GroupCollection struct {
-		Groups []types.GroupInfo
-	}
-
+// Gets the delivery status of a message with the timeline of receipts of every
+// recipient. For group messages readBy/deliveredTo/playedBy list the participants
+func (s *server) GetMessageStatus() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
+		msgid := mux.Vars(r)["id"]
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
+		chat := ""
+		if v := r.URL.Query().Get("chat"); v != "" {
+			jid, ok := parseJID(v)
+			if !ok {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse chat"))
+				return
+			}
+			chat = jid.ToNonAD().String()
 		}
 
-		resp, err := clientPointer[userid].GetJoinedGroups()
-
+		receipts, err := getMessageReceipts(s.db, userid, msgid, chat)
 		if err != nil {
-			msg := fmt.Sprintf("Failed to get group list: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get message status: %v", err)))
 			return
 		}
+		if len(receipts) == 0 {
+			var count int
+			query := "SELECT COUNT(*) FROM messages WHERE user_id=$1 AND message_id=$2"
+			args := []interface{}{userid, msgid}
+			if chat != "" {
+				query += " AND chat_jid=$3"
+				args = append(args, chat)
+			}
+			err = s.db.Get(&count, query, args...)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get message status: %v", err)))
+				return
+			}
+			if count == 0 {
+				s.Respond(w, r, http.StatusNotFound, errors.New("Message not found"))
+				return
+			}
+		}
 
-		gc := new(GroupCollection)
-		for _, info := range resp {
-			gc.Groups = append(gc.Groups, *info)
+		status := ""
+		var sentAt *time.Time
+		timeline := []map[string]interface{}{}
+		recipients := map[string]map[string]interface{}{}
+		order := []string{}
+		byStatus := map[string][]string{
+			receiptStatusDelivered: {},
+			receiptStatusRead:      {},
+			receiptStatusPlayed:    {},
+		}
+		for _, rc := range receipts {
+			if chat == "" {
+				chat = rc.ChatJid
+			}
+			if receiptStatusRank[rc.Status] > receiptStatusRank[status] {
+				status = rc.Status
+			}
+			timeline = append(timeline, map[string]interface{}{
+				"recipient": rc.RecipientJid,
+				"status":    rc.Status,
+				"timestamp": rc.Timestamp,
+			})
+			if rc.Status == receiptStatusSent {
+				ts := rc.Timestamp
+				sentAt = &ts
+				continue
+			}
+			recipient, ok := recipients[rc.RecipientJid]
+			if !ok {
+				recipient = map[string]interface{}{"jid": rc.RecipientJid, "status": rc.Status}
+				recipients[rc.RecipientJid] = recipient
+				order = append(order, rc.RecipientJid)
+			}
+			if receiptStatusRank[rc.Status] > receiptStatusRank[recipient["status"].(string)] {
+				recipient["status"] = rc.Status
+			}
+			recipient[rc.Status+"At"] = rc.Timestamp
+			byStatus[rc.Status] = append(byStatus[rc.Status], rc.RecipientJid)
 		}
 
-		responseJson, err := json.Marshal(gc)
+		recipientList := []map[string]interface{}{}
+		for _, jid := range order {
+			recipientList = append(recipientList, recipients[jid])
+		}
+		response := map[string]interface{}{
+			"id":          msgid,
+			"chat":        chat,
+			"status":      status,
+			"recipients":  recipientList,
+			"deliveredTo": byStatus[receiptStatusDelivered],
+			"readBy":      byStatus[receiptStatusRead],
+			"playedBy":    byStatus[receiptStatusPlayed],
+			"timeline":    timeline,
+		}
+		if sentAt != nil {
+			response["sentAt"] = *sentAt
+		}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Get group info
-func (s *server) GetGroupInfo() http.HandlerFunc {
-
-	type getGroupInfoStruct struct {
-		GroupJID string
-	}
-
+// Gets the progress of the history sync sent by the phone after pairing
+func (s *server) GetHistorySyncStatus() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		txtid := r.Context().Value("userinfo").(Values).Get("Id")
 		userid, _ := strconv.Atoi(txtid)
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		status, found, err := getHistorySyncStatus(s.db, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get history sync status: %v", err)))
 			return
 		}
 
-		// Get GroupJID from query parameter
-		groupJID := r.URL.Query().Get("groupJID")
-		if groupJID == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
-			return
+		response := map[string]interface{}{
+			"started":       found,
+			"complete":      status.Complete,
+			"progress":      status.Progress,
+			"chunks":        status.Chunks,
+			"conversations": status.Conversations,
+			"messages":      status.Messages,
+		}
+		if found {
+			response["lastSyncType"] = status.LastSyncType
+			response["startedAt"] = status.StartedAt
+			response["updatedAt"] = status.UpdatedAt
+			if status.CompletedAt.Valid {
+				response["completedAt"] = status.CompletedAt.Time
+			}
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		group, ok := parseJID(groupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+// Rota de Healthcheck
+func (s *server) GetHealth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Verificar a conexão com o banco de dados
+		if err := s.db.Ping(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Database connection error"))
 			return
 		}
-
-		resp, err := clientPointer[userid].GetGroupInfo(group)
-
-		if err != nil {
-			msg := fmt.Sprintf("Failed to get group info: %v", err)
-			log.Error().Msg(msg)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+		if draining.Load() {
+			s.Respond(w, r, http.StatusServiceUnavailable, errors.New("Server is shutting down"))
 			return
 		}
 
-		responseJson, err := json.Marshal(resp)
-
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+		// Retornar status 200 OK se tudo estiver bem
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		response := map[string]interface{}{
+			"status":    "ok",
+			"timestamp": time.Now().Unix(),
 		}
-
-		return
+		json.NewEncoder(w).Encode(response)
 	}
 }
 
-// Get group invite link
-func (s *server) GetGroupInviteLink() http.HandlerFunc {
+// A user as shown by the admin API
+type adminUser struct {
+	Id          int          `db:"id"`
+	Name        string       `db:"name"`
+	TokenPrefix string       `db:"token_prefix"`
+	Webhook     string       `db:"webhook"`
+	Jid         string       `db:"jid"`
+	Qrcode      string       `db:"qrcode"`
+	Connected   sql.NullBool `db:"connected"`
+	Expiration  int          `db:"expiration"`
+	Events      string       `db:"events"`
+	ProxyURL    string       `db:"proxy_url"`
+	Status      string       `db:"status"`
+}
 
-	type getGroupInfoStruct struct {
-		GroupJID string
-		Reset    bool
+const adminUserQuery = `SELECT id, name, webhook, jid, qrcode, connected, COALESCE(expiration,0) AS expiration, events, proxy_url, status,
+	COALESCE((SELECT prefix FROM user_tokens t WHERE t.user_id=users.id AND t.scopes IS NULL ORDER BY t.created_at DESC LIMIT 1),'') AS token_prefix
+	FROM users`
+
+func (user adminUser) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":          user.Id,
+		"name":        user.Name,
+		"tokenPrefix": user.TokenPrefix,
+		"webhook":     user.Webhook,
+		"jid":         user.Jid,
+		"qrcode":      user.Qrcode,
+		"connected":   user.Connected.Bool,
+		"expiration":  user.Expiration,
+		"events":      user.Events,
+		"proxyUrl":    redactProxyURL(user.ProxyURL),
+		"status":      accountStatus(user.Status, int64(user.Expiration), time.Now()),
 	}
+}
 
+// Admin List users
+func (s *server) ListUsers() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		// Get GroupJID from query parameter
-		groupJID := r.URL.Query().Get("groupJID")
-		if groupJID == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing groupJID parameter"))
+		// Query the database to get the list of users
+		rows, err := s.db.Queryx(adminUserQuery + " ORDER BY id")
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
-
-		// Get reset parameter
-		resetParam := r.URL.Query().Get("reset")
-		reset := false
-		if resetParam != "" {
-			var err error
-			reset, err = strconv.ParseBool(resetParam)
+		defer rows.Close()
+		// Create a slice to store the user data
+		users := []map[string]interface{}{}
+		// Iterate over the rows and populate the user data
+		for rows.Next() {
+			var user adminUser
+			err := rows.StructScan(&user)
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid reset parameter, must be true or false"))
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 				return
 			}
+			users = append(users, user.toMap())
 		}
-
-		group, ok := parseJID(groupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		// Check for any error that occurred during iteration
+		if err := rows.Err(); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		// Set the response content type to JSON
+		w.Header().Set("Content-Type", "application/json")
+		// Encode the user data as JSON and write the response
+		err = json.NewEncoder(w).Encode(users)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encoding JSON"))
 			return
 		}
+	}
+}
 
-		resp, err := clientPointer[userid].GetGroupInviteLink(group, reset)
+// Admin Show user, with the state of its session
+func (s *server) ShowUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite link")
-			msg := fmt.Sprintf("Failed to get group invite link: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
-		response := map[string]interface{}{"InviteLink": resp}
-		responseJson, err := json.Marshal(response)
+		var user adminUser
+		err = s.db.Get(&user, adminUserQuery+" WHERE id=$1", userid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get user: %v", err)))
+			}
+			return
+		}
 
+		response := user.toMap()
+		session := map[string]interface{}{"replica": nil}
+		if sessions.Running(userid) {
+			state, since := sessions.State(userid)
+			session["replica"] = leases.replicaID
+			session["state"] = state
+			session["stateSince"] = since
+		} else if owner, found, err := leases.Owner(userid); err == nil && found {
+			session["replica"] = owner.Owner
+		}
+		response["session"] = session
+
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Get group invite info
-func (s *server) GetGroupInviteInfo() http.HandlerFunc {
+// Admin Update user, only the fields present in the request are changed. A new
+// expiration makes an expired account active again when it is in the future.
+func (s *server) UpdateUser() http.HandlerFunc {
 
-	type getGroupInviteInfoStruct struct {
-		Code string
+	type updateUserStruct struct {
+		Name       *string `json:"name"`
+		Webhook    *string `json:"webhook"`
+		Events     *string `json:"events"`
+		Expiration *int64  `json:"expiration"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t getGroupInviteInfoStruct
-		err := decoder.Decode(&t)
+		var t updateUserStruct
+		err = decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
+		}
+		if t.Name != nil && *t.Name == "" {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Name can not be empty"))
+			return
+		}
+		if t.Events != nil {
+			events, err := normalizeEvents(*t.Events)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, err)
+				return
+			}
+			t.Events = &events
+		}
+		if t.Expiration != nil && *t.Expiration < 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Expiration can not be negative"))
 			return
 		}
 
-		if t.Code == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Code in Payload"))
+		var user adminUser
+		err = s.db.Get(&user, adminUserQuery+" WHERE id=$1", userid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get user: %v", err)))
+			}
 			return
 		}
-
-		groupInfo, err := clientPointer[userid].GetGroupInfoFromLink(t.Code)
-
+		if t.Name != nil {
+			user.Name = *t.Name
+		}
+		if t.Webhook != nil {
+			user.Webhook = *t.Webhook
+		}
+		if t.Events != nil {
+			user.Events = *t.Events
+		}
+		reactivated := false
+		if t.Expiration != nil && int64(user.Expiration) != *t.Expiration {
+			user.Expiration = int(*t.Expiration)
+			// The watcher expires the account again if the new expiration is past
+			if user.Status == accountExpired {
+				user.Status = accountActive
+				reactivated = accountStatus(accountActive, *t.Expiration, time.Now()) == accountActive
+			}
+			_, err = s.db.Exec("UPDATE users SET expiration=$1, status=$2, expiry_warned_at=NULL WHERE id=$3", user.Expiration, user.Status, userid)
+			if err != nil {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update user: %v", err)))
+				return
+			}
+		}
+		_, err = s.db.Exec("UPDATE users SET name=$1, webhook=$2, events=$3 WHERE id=$4", user.Name, user.Webhook, user.Events, userid)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to get group invite info")
-			msg := fmt.Sprintf("Failed to get group invite info: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not update user: %v", err)))
 			return
 		}
+		invalidateUserInfo(s.db, userid)
+		if reactivated {
+			sendAccountEvent(s.db, userid, map[string]interface{}{"status": accountActive, "expiration": user.Expiration})
+		}
 
-		responseJson, err := json.Marshal(groupInfo)
-
+		responseJson, err := json.Marshal(user.toMap())
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Set group photo
-func (s *server) SetGroupPhoto() http.HandlerFunc {
-
-	type setGroupPhotoStruct struct {
-		GroupJID string
-		Image    string
+// Checks a comma separated list of events a user subscribes to. An empty
+// list means no filter, like connecting without events, and becomes All.
+func normalizeEvents(events string) (string, error) {
+	if strings.TrimSpace(events) == "" {
+		return "All", nil
 	}
-
-	return func(w http.ResponseWriter, r *http.Request) {
-
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
+	var list []string
+	for _, event := range strings.Split(events, ",") {
+		event = strings.TrimSpace(event)
+		if !Find(messageTypes, event) {
+			return "", errors.New("Invalid event: " + event)
 		}
+		list = append(list, event)
+	}
+	return strings.Join(list, ","), nil
+}
 
-		decoder := json.NewDecoder(r.Body)
-		var t setGroupPhotoStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
+func (s *server) AddUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
-			return
+		// Parse the request body
+		var user struct {
+			Name       string `json:"name"`
+			Token      string `json:"token"`
+			Webhook    string `json:"webhook"`
+			Expiration int    `json:"expiration"`
+			Events     string `json:"events"`
 		}
-
-		if t.Image == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Image in Payload"))
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Incomplete data in Payload. Required name, webhook, expiration, events"))
 			return
 		}
 
-		var filedata []byte
-
-		if t.Image[0:13] == "data:image/jp" {
-			dataURL, err := dataurl.DecodeString(t.Image)
+		// A token is generated unless one is given, it is only returned here
+		var err error
+		if user.Token == "" {
+			user.Token, err = generateToken()
 			if err != nil {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode base64 encoded data from payload"))
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Could not generate token"))
 				return
-			} else {
-				filedata = dataURL.Data
 			}
 		} else {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Image data should start with \"data:image/jpeg;base64,\""))
-			return
+			// Check if a user with the same token already exists
+			_, err = resolveToken(s.db, user.Token)
+			if err == nil {
+				s.Respond(w, r, http.StatusConflict, errors.New("User with the same token already exists"))
+				return
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+				return
+			}
 		}
 
-		picture_id, err := clientPointer[userid].SetGroupPhoto(group, filedata)
-
+		// Validate the events input
+		user.Events, err = normalizeEvents(user.Events)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group photo")
-			msg := fmt.Sprintf("Failed to set group photo: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Group Photo set successfully", "PictureID": picture_id}
-		responseJson, err := json.Marshal(response)
-
+		// Insert the user and the hash of its token into the database
+		tx, err := s.db.Beginx()
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, err)
-		} else {
-			s.Respond(w, r, http.StatusOK, string(responseJson))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		defer tx.Rollback()
+		var id int
+		err = tx.QueryRowx(
+			"INSERT INTO users (name, webhook, expiration, events, jid, qrcode) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			user.Name, user.Webhook, user.Expiration, user.Events, "", "",
+		).Scan(&id)
+		if err == nil {
+			_, err = insertToken(tx, id, user.Token, nil)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
+			return
 		}
 
-		return
+		// Return the inserted user ID and its token, which can not be retrieved later
+		response := map[string]interface{}{
+			"id":          id,
+			"token":       user.Token,
+			"tokenPrefix": tokenPrefix(user.Token),
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encoding JSON"))
+			return
+		}
 	}
 }
 
-// Set group name
-func (s *server) SetGroupName() http.HandlerFunc {
-
-	type setGroupNameStruct struct {
-		GroupJID string
-		Name     string
-	}
-
+// Deletes a user, stopping its session and removing its device from the store
+func (s *server) DeleteUser() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
+		// Get the user ID from the request URL
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
+			return
+		}
 
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		var jid string
+		err = s.db.Get(&jid, "SELECT jid FROM users WHERE id=$1", userid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			}
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t setGroupNameStruct
-		err := decoder.Decode(&t)
+		// The request is forwarded to the replica running the session, which
+		// logs it out first so the linked device is removed from the phone
+		if client := sessions.Get(userid); client != nil && client.IsLoggedIn() {
+			if err := client.Logout(); err != nil {
+				log.Warn().Err(err).Str("userid", strconv.Itoa(userid)).Msg("Could not log out deleted user")
+			}
+		}
+		sessions.Stop(userid)
+		startup.forget(userid)
+		eventStreams.Forget(userid)
+
+		// Delete the user from the database, its session lease goes with it
+		result, err := s.db.Exec("DELETE FROM users WHERE id=$1", userid)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
 			return
 		}
 
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		// Check if the user was deleted
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem checking rows affected"))
+			return
+		}
+		if rowsAffected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
+		// Its tokens stop working on every replica right away
+		invalidateUserInfo(s.db, userid)
+		if err := deleteStoredDevice(jid); err != nil {
+			log.Error().Err(err).Str("userid", strconv.Itoa(userid)).Str("jid", jid).Msg("Could not delete device of deleted user")
+		}
 
-		if t.Name == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Name in Payload"))
+		// Return a success response
+		response := map[string]interface{}{"Details": "User deleted successfully"}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encoding JSON"))
 			return
 		}
+	}
+}
 
-		err = clientPointer[userid].SetGroupName(group, t.Name)
+// Suspends a user: its token stops working and its session is disconnected
+func (s *server) SuspendUser() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
 
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group name")
-			msg := fmt.Sprintf("Failed to set group name: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Group Name set successfully"}
-		responseJson, err := json.Marshal(response)
+		result, err := s.db.Exec("UPDATE users SET status=$1 WHERE id=$2", accountSuspended, userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not suspend user: %v", err)))
+			return
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil || rowsAffected == 0 {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		}
+		invalidateUserInfo(s.db, userid)
+		// A session running on another replica is stopped by its account watcher
+		sessions.Stop(userid)
+		sendAccountEvent(s.db, userid, map[string]interface{}{"status": accountSuspended})
 
+		response := map[string]interface{}{"id": userid, "status": accountSuspended}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Set group topic (description)
-func (s *server) SetGroupTopic() http.HandlerFunc {
+// Reactivates a suspended or expired user, optionally with a new expiration.
+// The session is not reconnected, the user connects it again.
+func (s *server) ReactivateUser() http.HandlerFunc {
 
-	type setGroupTopicStruct struct {
-		GroupJID string
-		Topic    string
+	type reactivateStruct struct {
+		Expiration *int64 `json:"expiration"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
-		decoder := json.NewDecoder(r.Body)
-		var t setGroupTopicStruct
-		err := decoder.Decode(&t)
-		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
+		var t reactivateStruct
+		if r.ContentLength != 0 {
+			err = json.NewDecoder(r.Body).Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+				return
+			}
 		}
 
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		var expiration int64
+		err = s.db.Get(&expiration, "SELECT COALESCE(expiration,0) FROM users WHERE id=$1", userid)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			} else {
+				s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get user: %v", err)))
+			}
 			return
 		}
-
-		if t.Topic == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Topic in Payload"))
+		if t.Expiration != nil {
+			expiration = *t.Expiration
+		}
+		if accountStatus(accountActive, expiration, time.Now()) != accountActive {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Expiration is in the past, pass a new expiration"))
 			return
 		}
 
-		err = clientPointer[userid].SetGroupTopic(group, "", "", t.Topic)
-
+		_, err = s.db.Exec("UPDATE users SET status=$1, expiration=$2, expiry_warned_at=NULL WHERE id=$3", accountActive, expiration, userid)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group topic")
-			msg := fmt.Sprintf("Failed to set group topic: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not reactivate user: %v", err)))
 			return
 		}
+		invalidateUserInfo(s.db, userid)
+		sendAccountEvent(s.db, userid, map[string]interface{}{"status": accountActive, "expiration": expiration})
 
-		response := map[string]interface{}{"Details": "Group Topic set successfully"}
+		response := map[string]interface{}{"id": userid, "status": accountActive, "expiration": expiration}
 		responseJson, err := json.Marshal(response)
-
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// add, remove, promote and demote members group
-func (s *server) UpdateGroupParticipants() http.HandlerFunc {
+// Gives a user a new token, returned only once. The previous tokens keep
+// working for the optional grace period in seconds, and are revoked right
+// away without it.
+func (s *server) RotateUserToken() http.HandlerFunc {
 
-	type updateGroupParticipantsStruct struct {
-		GroupJID string
-		Phone    []string
-		// Action string // add, remove, promote, demote
-		Action string
+	type rotateStruct struct {
+		Grace int64 `json:"grace"`
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
-			return
-		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t updateGroupParticipantsStruct
-		err := decoder.Decode(&t)
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
-			return
-		}
-
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
-		if len(t.Phone) < 1 {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Phone in Payload"))
-			return
-		}
-		// parse phone numbers
-		phoneParsed := make([]types.JID, len(t.Phone))
-		for i, phone := range t.Phone {
-			phoneParsed[i], ok = parseJID(phone)
-			if !ok {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Phone"))
+		var t rotateStruct
+		if r.ContentLength != 0 {
+			err = json.NewDecoder(r.Body).Decode(&t)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 				return
 			}
 		}
-
-		if t.Action == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Action in Payload"))
+		if t.Grace < 0 {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Grace must not be negative"))
 			return
 		}
 
-		// parse action
-
-		var action whatsmeow.ParticipantChange
-		switch t.Action {
-		case "add":
-			action = "add"
-		case "remove":
-			action = "remove"
-		case "promote":
-			action = "promote"
-		case "demote":
-			action = "demote"
-		default:
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid Action in Payload"))
+		exists, err := s.userExists(userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get user: %v", err)))
+			return
+		}
+		if !exists {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
 
-		_, err = clientPointer[userid].UpdateGroupParticipants(group, phoneParsed, action)
-
+		token, previousExpireAt, err := rotateToken(s.db, userid, time.Duration(t.Grace)*time.Second)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to change participant group")
-			msg := fmt.Sprintf("Failed to change participant group: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not rotate token: %v", err)))
 			return
 		}
+		invalidateUserInfo(s.db, userid)
+		log.Info().Str("userid", strconv.Itoa(userid)).Int64("grace", t.Grace).Msg("Token rotated")
 
-		response := map[string]interface{}{"Details": "Group Participants updated successfully"}
+		response := map[string]interface{}{"id": userid, "token": token, "tokenPrefix": tokenPrefix(token), "previousTokensExpireAt": previousExpireAt}
 		responseJson, err := json.Marshal(response)
-
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// SetGroupAnnounce post
-func (s *server) SetGroupAnnounce() http.HandlerFunc {
-
-	type setGroupAnnounceStruct struct {
-		GroupJID string
-		Announce bool
-	}
-
+// Sets the proxy of a user
+func (s *server) SetUserProxy() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t setGroupAnnounceStruct
-		err := decoder.Decode(&t)
+		var t proxyStruct
+		err = decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
-
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		err = validateProxyURL(t.ProxyURL)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		err = clientPointer[userid].SetGroupAnnounce(group, t.Announce)
-
+		found, err := s.setProxy(userid, t)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to set group announce")
-			msg := fmt.Sprintf("Failed to set group announce: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set proxy: %v", err)))
+			return
+		}
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Group Announce set successfully"}
+		response := map[string]interface{}{"id": userid, "proxyUrl": redactProxyURL(t.ProxyURL), "webhooks": t.Webhooks}
 		responseJson, err := json.Marshal(response)
-
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Join group invite link
-func (s *server) GroupJoin() http.HandlerFunc {
-
-	type joinGroupStruct struct {
-		Code string
-	}
-
+// Sets the device identity of a user
+func (s *server) SetUserDevice() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
 		decoder := json.NewDecoder(r.Body)
-		var t joinGroupStruct
-		err := decoder.Decode(&t)
+		var t deviceIdentity
+		err = decoder.Decode(&t)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
 			return
 		}
-
-		if t.Code == "" {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Missing Code in Payload"))
+		err = t.normalize()
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
 
-		_, err = clientPointer[userid].JoinGroupWithLink(t.Code)
-
+		found, err := s.setDevice(userid, t)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to join group")
-			msg := fmt.Sprintf("Failed to join group: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not set device identity: %v", err)))
+			return
+		}
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Group joined successfully"}
+		response := map[string]interface{}{"id": userid, "name": t.Name, "platform": t.Platform, "browser": t.Browser}
 		responseJson, err := json.Marshal(response)
-
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// SetGroupAnnounce post
-func (s *server) GroupLeave() http.HandlerFunc {
-
-	type groupLeaveStruct struct {
-		GroupJID string
-	}
+func (s *server) userExists(userid int) (bool, error) {
+	var exists bool
+	err := s.db.Get(&exists, "SELECT EXISTS(SELECT 1 FROM users WHERE id=$1)", userid)
+	return exists, err
+}
 
+// Lists the API keys of a user, without the keys themselves
+func (s *server) ListUserKeys() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		txtid := r.Context().Value("userinfo").(Values).Get("Id")
-		userid, _ := strconv.Atoi(txtid)
-
-		if clientPointer[userid] == nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("No session"))
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
-
-		decoder := json.NewDecoder(r.Body)
-		var t groupLeaveStruct
-		err := decoder.Decode(&t)
+		exists, err := s.userExists(userid)
 		if err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode Payload"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get user: %v", err)))
 			return
 		}
-
-		group, ok := parseJID(t.GroupJID)
-		if !ok {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not parse Group JID"))
+		if !exists {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
 
-		err = clientPointer[userid].LeaveGroup(group)
-
+		keys, err := listAPIKeys(s.db, userid)
 		if err != nil {
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Failed to leave group")
-			msg := fmt.Sprintf("Failed to leave group: %v", err)
-			s.Respond(w, r, http.StatusInternalServerError, msg)
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not list keys: %v", err)))
 			return
 		}
 
-		response := map[string]interface{}{"Details": "Group left successfully"}
-		responseJson, err := json.Marshal(response)
-
+		responseJson, err := json.Marshal(keys)
 		if err != nil {
 			s.Respond(w, r, http.StatusInternalServerError, err)
 		} else {
 			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
-
-		return
 	}
 }
 
-// Rota de Healthcheck
-func (s *server) GetHealth() http.HandlerFunc {
+// Creates an API key limited to some scopes for a user, the key is only returned here
+func (s *server) AddUserKey() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Verificar a conexão com o banco de dados
-		if err := s.db.Ping(); err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Database connection error"))
+
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
 			return
 		}
 
-		// Retornar status 200 OK se tudo estiver bem
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		response := map[string]interface{}{
-			"status":    "ok",
-			"timestamp": time.Now().Unix(),
+		decoder := json.NewDecoder(r.Body)
+		var t apiKeyRequest
+		err = decoder.Decode(&t)
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Could not decode payload"))
+			return
 		}
-		json.NewEncoder(w).Encode(response)
-	}
-}
-
-// Admin List users
-func (s *server) ListUsers() http.HandlerFunc {
-	type usersStruct struct {
-		Id         int          `db:"id"`
-		Name       string       `db:"name"`
-		Token      string       `db:"token"`
-		Webhook    string       `db:"webhook"`
-		Jid        string       `db:"jid"`
-		Qrcode     string       `db:"qrcode"`
-		Connected  sql.NullBool `db:"connected"`
-		Expiration int          `db:"expiration"`
-		Events     string       `db:"events"`
-	}
-	return func(w http.ResponseWriter, r *http.Request) {
-		// Query the database to get the list of users
-		rows, err := s.db.Queryx("SELECT id, name, token, webhook, jid, qrcode, connected, expiration, events FROM users")
+		err = t.validate()
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			s.Respond(w, r, http.StatusBadRequest, err)
 			return
 		}
-		defer rows.Close()
-		// Create a slice to store the user data
-		users := []map[string]interface{}{}
-		// Iterate over the rows and populate the user data
-		for rows.Next() {
-			var user usersStruct
-			err := rows.StructScan(&user)
-			if err != nil {
-				s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-				return
-			}
-			userMap := map[string]interface{}{
-				"id":         user.Id,
-				"name":       user.Name,
-				"token":      user.Token,
-				"webhook":    user.Webhook,
-				"jid":        user.Jid,
-				"qrcode":     user.Qrcode,
-				"connected":  user.Connected.Bool,
-				"expiration": user.Expiration,
-				"events":     user.Events,
-			}
-			users = append(users, userMap)
+
+		exists, err := s.userExists(userid)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get user: %v", err)))
+			return
 		}
-		// Check for any error that occurred during iteration
-		if err := rows.Err(); err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+		if !exists {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
 			return
 		}
-		// Set the response content type to JSON
-		w.Header().Set("Content-Type", "application/json")
-		// Encode the user data as JSON and write the response
-		err = json.NewEncoder(w).Encode(users)
+
+		token, key, err := createAPIKey(s.db, userid, t.Label, t.Scopes, t.expiresAt())
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encoding JSON"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not create key: %v", err)))
 			return
 		}
+
+		response := map[string]interface{}{"id": userid, "key": token, "details": key}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
+		}
 	}
 }
 
-func (s *server) AddUser() http.HandlerFunc {
+// Revokes an API key of a user on every replica
+func (s *server) DeleteUserKey() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 
-		// Parse the request body
-		var user struct {
-			Name       string `json:"name"`
-			Token      string `json:"token"`
-			Webhook    string `json:"webhook"`
-			Expiration int    `json:"expiration"`
-			Events     string `json:"events"`
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
+			return
 		}
-		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-			s.Respond(w, r, http.StatusBadRequest, errors.New("Incomplete data in Payload. Required name, token, webhook, expiration, events"))
+		keyid, err := strconv.Atoi(mux.Vars(r)["keyid"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid key id"))
 			return
 		}
 
-		// Check if a user with the same token already exists
-		var count int
-		err := s.db.Get(&count, "SELECT COUNT(*) FROM users WHERE token = $1", user.Token)
+		found, err := deleteAPIKey(s.db, userid, keyid)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not delete key: %v", err)))
 			return
 		}
-		if count > 0 {
-			s.Respond(w, r, http.StatusConflict, errors.New("User with the same token already exists"))
+		if !found {
+			s.Respond(w, r, http.StatusNotFound, errors.New("Key not found"))
 			return
 		}
+		invalidateUserInfo(s.db, userid)
 
-		// Validate the events input
-		validEvents := []string{"Message", "ReadReceipt", "Presence", "HistorySync", "ChatPresence", "All"}
-		eventList := strings.Split(user.Events, ",")
-		for _, event := range eventList {
-			event = strings.TrimSpace(event)
-			if !Find(validEvents, event) {
-				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid event: "+event))
-				return
-			}
-		}
-
-		// Insert the user into the database
-		var id int
-		err = s.db.QueryRowx(
-			"INSERT INTO users (name, token, webhook, expiration, events, jid, qrcode) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
-			user.Name, user.Token, user.Webhook, user.Expiration, user.Events, "", "",
-		).Scan(&id)
+		response := map[string]interface{}{"id": userid, "Details": "Key deleted"}
+		responseJson, err := json.Marshal(response)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-			log.Error().Str("error", fmt.Sprintf("%v", err)).Msg("Admin DB Error")
-			return
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
+	}
+}
 
-		// Return the inserted user ID
-		response := map[string]interface{}{
-			"id": id,
+// Shows the sessions this replica restores on startup or takes over from
+// other replicas, with the ones still pending and the ones that failed
+func (s *server) GetStartup() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		entries := startup.List()
+		summary := map[string]int{startupPending: 0, startupConnecting: 0, startupRestored: 0, startupFailed: 0}
+		for _, entry := range entries {
+			summary[entry.Status]++
 		}
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encoding JSON"))
-			return
+
+		response := map[string]interface{}{"replica": leases.replicaID, "summary": summary, "sessions": entries}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
 	}
 }
 
-func (s *server) DeleteUser() http.HandlerFunc {
+// Lists the audit log, newest first, filtered by user, action, actor, token
+// and time, paginated with before
+func (s *server) GetAudit() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
 
-		// Get the user ID from the request URL
-		vars := mux.Vars(r)
-		userID := vars["id"]
+		conditions := []string{"TRUE"}
+		args := []interface{}{}
+		addCondition := func(condition string, value interface{}) {
+			args = append(args, value)
+			conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+		}
 
-		// Delete the user from the database
-		result, err := s.db.Exec("DELETE FROM users WHERE id=$1", userID)
-		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
-			return
+		for _, param := range []string{"user_id", "token_id"} {
+			v := query.Get(param)
+			if v == "" {
+				continue
+			}
+			id, err := strconv.Atoi(v)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid "+param))
+				return
+			}
+			addCondition(param+"=$%d", id)
+		}
+		if v := query.Get("action"); v != "" {
+			addCondition("action=$%d", v)
+		}
+		if v := query.Get("actor"); v != "" {
+			if v != auditActorAdmin && v != auditActorUser && v != auditActorWhatsapp {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid actor, use admin, user or whatsapp"))
+				return
+			}
+			addCondition("actor=$%d", v)
 		}
+		for _, param := range []string{"since", "until"} {
+			v := query.Get(param)
+			if v == "" {
+				continue
+			}
+			ts, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid "+param+", expected unix timestamp"))
+				return
+			}
+			if param == "since" {
+				addCondition("created_at>=to_timestamp($%d)", ts)
+			} else {
+				addCondition("created_at<to_timestamp($%d)", ts)
+			}
+		}
+		if v := query.Get("before"); v != "" {
+			before, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid before"))
+				return
+			}
+			addCondition("id<$%d", before)
+		}
+		limit := 50
+		if v := query.Get("limit"); v != "" {
+			l, err := strconv.Atoi(v)
+			if err != nil || l < 1 || l > 500 {
+				s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid limit, must be between 1 and 500"))
+				return
+			}
+			limit = l
+		}
+		args = append(args, limit)
 
-		// Check if the user was deleted
-		rowsAffected, err := result.RowsAffected()
+		entries := []auditEntry{}
+		err := s.db.Select(&entries, fmt.Sprintf(`SELECT id, created_at, action, actor, token_id, token_prefix, user_id, ip, request_id, method, path, status, request, diff
+			FROM audit_log WHERE %s ORDER BY id DESC LIMIT $%d`, strings.Join(conditions, " AND "), len(args)), args...)
 		if err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem checking rows affected"))
-			return
-		}
-		if rowsAffected == 0 {
-			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Could not get audit log: %v", err)))
 			return
 		}
 
-		// Return a success response
-		response := map[string]interface{}{"Details": "User deleted successfully"}
-		if err := json.NewEncoder(w).Encode(response); err != nil {
-			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem encoding JSON"))
-			return
+		response := map[string]interface{}{"entries": entries}
+		if len(entries) == limit {
+			response["nextBefore"] = entries[len(entries)-1].Id
+		}
+		responseJson, err := json.Marshal(response)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, err)
+		} else {
+			s.Respond(w, r, http.StatusOK, string(responseJson))
 		}
 	}
 }
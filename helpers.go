@@ -1,10 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Webhook body formats
+const (
+	webhookFormatForm          = "form"
+	webhookFormatJSON          = "json"
+	webhookFormatMultipartJSON = "multipart-json"
 )
 
+var webhookFormats = []string{webhookFormatForm, webhookFormatJSON, webhookFormatMultipartJSON}
+
 func Find(slice []string, val string) bool {
     for _, item := range slice {
         if item == val {
@@ -14,15 +38,20 @@ func Find(slice []string, val string) bool {
     return false
 }
 
-// Update entry in User map
+// Update entry in User map. The map is copied, the cached one may be read by
+// event handlers at the same time.
 func updateUserInfo(values interface{}, field string, value string) interface{} {
     log.Debug().Str("field",field).Str("value",value).Msg("User info updated")
-    values.(Values).m[field] = value
-    return values
+    m := make(map[string]string, len(values.(Values).m)+1)
+    for k, v := range values.(Values).m {
+        m[k] = v
+    }
+    m[field] = value
+    return Values{m}
 }
 
 // webhook for regular messages
-func callHook(myurl string, payload map[string]string, id int) {
+func callHook(client *resty.Client, myurl string, payload map[string]string, id int, secret string) (*resty.Response, error) {
     log.Info().Str("url",myurl).Msg("Sending POST to client "+strconv.Itoa(id))
 
     // Log the payload map
@@ -31,14 +60,28 @@ func callHook(myurl string, payload map[string]string, id int) {
         log.Debug().Str(key, value).Msg("")
     }
 
-    _, err := clientHttp[id].R().SetFormData(payload).Post(myurl)
+    // The body is encoded here instead of by resty so that the exact bytes can be signed
+    form := url.Values{}
+    for key, value := range payload {
+        form.Set(key, value)
+    }
+    body := []byte(form.Encode())
+
+    req := client.R().
+        SetHeader("Content-Type", "application/x-www-form-urlencoded").
+        SetBody(body)
+    signWebhookRequest(req, secret, body)
+
+    resp, err := req.Post(myurl)
     if err != nil {
-        log.Debug().Str("error",err.Error())
+        log.Debug().Str("error",err.Error()).Msg("Failed to send POST request")
+        return nil, err
     }
+    return resp, nil
 }
 
 // webhook for messages with file attachments
-func callHookFile(myurl string, payload map[string]string, id int, file string) error {
+func callHookFile(client *resty.Client, myurl string, payload map[string]string, id int, file string, secret string) (*resty.Response, error) {
     log.Info().Str("file", file).Str("url", myurl).Msg("Sending POST")
 
     // Criar um novo mapa para o payload final
@@ -52,16 +95,21 @@ func callHookFile(myurl string, payload map[string]string, id int, file string)
 
     log.Debug().Interface("finalPayload", finalPayload).Msg("Final payload to be sent")
 
-    resp, err := clientHttp[id].R().
-        SetFiles(map[string]string{
-            "file": file,
-        }).
-        SetFormData(finalPayload).
-        Post(myurl)
+    body, contentType, err := buildMultipartBody(finalPayload, file)
+    if err != nil {
+        log.Error().Err(err).Str("file", file).Msg("Failed to build multipart body")
+        return nil, fmt.Errorf("failed to build multipart body: %w", err)
+    }
+
+    req := client.R().
+        SetHeader("Content-Type", contentType).
+        SetBody(body)
+    signWebhookRequest(req, secret, body)
 
+    resp, err := req.Post(myurl)
     if err != nil {
         log.Error().Err(err).Str("url", myurl).Msg("Failed to send POST request")
-        return fmt.Errorf("failed to send POST request: %w", err)
+        return nil, fmt.Errorf("failed to send POST request: %w", err)
     }
 
     // Log do payload enviado
@@ -70,5 +118,178 @@ func callHookFile(myurl string, payload map[string]string, id int, file string)
     // Optionally, you can log the response status and body
     log.Info().Int("status", resp.StatusCode()).Str("body", string(resp.Body())).Msg("POST request completed")
 
-    return nil
-}
\ No newline at end of file
+    return resp, nil
+}
+
+// webhook posted as application/json, media is kept inline as base64
+func callHookJSON(client *resty.Client, myurl string, payload map[string]string, id int, secret string) (*resty.Response, error) {
+    log.Info().Str("url",myurl).Msg("Sending JSON POST to client "+strconv.Itoa(id))
+
+    body, err := webhookJSONBody(payload, false)
+    if err != nil {
+        return nil, fmt.Errorf("failed to build JSON body: %w", err)
+    }
+
+    req := client.R().
+        SetHeader("Content-Type", "application/json").
+        SetBody(body)
+    signWebhookRequest(req, secret, body)
+
+    resp, err := req.Post(myurl)
+    if err != nil {
+        log.Error().Err(err).Str("url", myurl).Msg("Failed to send POST request")
+        return nil, fmt.Errorf("failed to send POST request: %w", err)
+    }
+    log.Info().Int("status", resp.StatusCode()).Msg("POST request completed")
+    return resp, nil
+}
+
+// webhook posted as multipart/form-data with a JSON "payload" part and the media as a "file" part
+func callHookMultipartJSON(client *resty.Client, myurl string, payload map[string]string, id int, file string, secret string) (*resty.Response, error) {
+    log.Info().Str("file", file).Str("url",myurl).Msg("Sending multipart JSON POST to client "+strconv.Itoa(id))
+
+    jsonBody, err := webhookJSONBody(payload, file != "")
+    if err != nil {
+        return nil, fmt.Errorf("failed to build JSON body: %w", err)
+    }
+
+    var buf bytes.Buffer
+    writer := multipart.NewWriter(&buf)
+    header := make(textproto.MIMEHeader)
+    header.Set("Content-Disposition", `form-data; name="payload"`)
+    header.Set("Content-Type", "application/json")
+    part, err := writer.CreatePart(header)
+    if err != nil {
+        return nil, err
+    }
+    if _, err = part.Write(jsonBody); err != nil {
+        return nil, err
+    }
+    if file != "" {
+        if err = writeMultipartFile(writer, file); err != nil {
+            log.Error().Err(err).Str("file", file).Msg("Failed to build multipart body")
+            return nil, fmt.Errorf("failed to build multipart body: %w", err)
+        }
+    }
+    if err = writer.Close(); err != nil {
+        return nil, err
+    }
+    body := buf.Bytes()
+
+    req := client.R().
+        SetHeader("Content-Type", writer.FormDataContentType()).
+        SetBody(body)
+    signWebhookRequest(req, secret, body)
+
+    resp, err := req.Post(myurl)
+    if err != nil {
+        log.Error().Err(err).Str("url", myurl).Msg("Failed to send POST request")
+        return nil, fmt.Errorf("failed to send POST request: %w", err)
+    }
+    log.Info().Int("status", resp.StatusCode()).Msg("POST request completed")
+    return resp, nil
+}
+
+// Builds the JSON webhook body from the event in jsonData, adding the token prefix when present.
+// The inline base64 media is dropped when it is sent as a separate part.
+func webhookJSONBody(payload map[string]string, stripMedia bool) ([]byte, error) {
+    event := make(map[string]interface{})
+    if err := json.Unmarshal([]byte(payload["jsonData"]), &event); err != nil {
+        return nil, err
+    }
+    if prefix, ok := payload["tokenPrefix"]; ok {
+        event["tokenPrefix"] = prefix
+    }
+    if stripMedia {
+        delete(event, "base64")
+    }
+    return json.Marshal(event)
+}
+
+// Builds a multipart/form-data body with the payload fields and the file attached as "file"
+func buildMultipartBody(fields map[string]string, file string) ([]byte, string, error) {
+    var buf bytes.Buffer
+    writer := multipart.NewWriter(&buf)
+    for key, value := range fields {
+        if err := writer.WriteField(key, value); err != nil {
+            return nil, "", err
+        }
+    }
+    if err := writeMultipartFile(writer, file); err != nil {
+        return nil, "", err
+    }
+    if err := writer.Close(); err != nil {
+        return nil, "", err
+    }
+    return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+func writeMultipartFile(writer *multipart.Writer, file string) error {
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+    part, err := writer.CreateFormFile("file", filepath.Base(file))
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(part, f)
+    return err
+}
+
+// Adds the timestamp and HMAC-SHA256 signature headers when the user has a webhook secret.
+// The signature covers "<timestamp>.<body>" so receivers can reject replayed deliveries.
+func signWebhookRequest(req *resty.Request, secret string, body []byte) {
+    if secret == "" {
+        return
+    }
+    timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+    req.SetHeader("X-Wuzapi-Timestamp", timestamp)
+    req.SetHeader("X-Wuzapi-Signature", "sha256="+signWebhook(secret, timestamp, body))
+}
+
+func signWebhook(secret string, timestamp string, body []byte) string {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(timestamp))
+    mac.Write([]byte("."))
+    mac.Write(body)
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Generates a random webhook secret
+func generateWebhookSecret() (string, error) {
+    buf := make([]byte, 32)
+    if _, err := rand.Read(buf); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(buf), nil
+}
+
+// Sends a webhook using the body format configured for it
+func sendWebhook(client *resty.Client, format string, myurl string, payload map[string]string, id int, file string, secret string) (*resty.Response, error) {
+    switch format {
+    case webhookFormatJSON:
+        return callHookJSON(client, myurl, payload, id, secret)
+    case webhookFormatMultipartJSON:
+        return callHookMultipartJSON(client, myurl, payload, id, file, secret)
+    default:
+        if file == "" {
+            return callHook(client, myurl, payload, id, secret)
+        }
+        return callHookFile(client, myurl, payload, id, file, secret)
+    }
+}
+
+// Returns the http client of the user session. When the session is not
+// running (e.g. outbox entries left over from a restart, or replayed) it uses
+// the stored proxy settings of the user, so webhooks never skip its proxy.
+func webhookClient(id int, proxyURL string, webhooks bool) *resty.Client {
+    if client := sessions.GetHTTP(id); client != nil {
+        return client
+    }
+    if proxyURL == "" || !webhooks {
+        return defaultHttpClient
+    }
+    return proxyHttpClient(proxyURL)
+}
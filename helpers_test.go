@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		body      string
+		want      string
+	}{
+		{"json body", "whsec_test", "1700000000", `{"type":"Message"}`, "ee2d0fc2286094fac060851270109dfe7eccee5f39c7b503403a2a8e9567ba12"},
+		{"empty body", "whsec_test", "1700000000", "", "5967f3c560522fa40cf2876ebc3c3a08551dd6959aaade3b413460591895bdcc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhook(tt.secret, tt.timestamp, []byte(tt.body)); got != tt.want {
+				t.Errorf("signWebhook() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	body := []byte(`{"type":"Message"}`)
+	base := signWebhook("whsec_test", "1700000000", body)
+	if signWebhook("whsec_other", "1700000000", body) == base {
+		t.Error("signature does not depend on the secret")
+	}
+	if signWebhook("whsec_test", "1700000001", body) == base {
+		t.Error("signature does not depend on the timestamp")
+	}
+}
+
+func TestSignWebhookRequest(t *testing.T) {
+	body := []byte(`{"type":"Message"}`)
+
+	req := resty.New().R()
+	signWebhookRequest(req, "", body)
+	if req.Header.Get("X-Wuzapi-Signature") != "" || req.Header.Get("X-Wuzapi-Timestamp") != "" {
+		t.Error("request signed without a secret")
+	}
+
+	req = resty.New().R()
+	signWebhookRequest(req, "whsec_test", body)
+	timestamp := req.Header.Get("X-Wuzapi-Timestamp")
+	if timestamp == "" {
+		t.Fatal("missing timestamp header")
+	}
+	if got, want := req.Header.Get("X-Wuzapi-Signature"), "sha256="+signWebhook("whsec_test", timestamp, body); got != want {
+		t.Errorf("signature header = %s, want %s", got, want)
+	}
+}
+
+// The cached map is read by event handlers, updates must not write to it
+func TestUpdateUserInfoCopies(t *testing.T) {
+	cached := Values{map[string]string{"Id": "1", "Events": "All"}}
+	updated := updateUserInfo(cached, "Events", "Message").(Values)
+	if cached.Get("Events") != "All" {
+		t.Errorf("cached Events = %q, want it unchanged", cached.Get("Events"))
+	}
+	if updated.Get("Events") != "Message" || updated.Get("Id") != "1" {
+		t.Errorf("updated = %v, want Events changed and Id kept", updated.m)
+	}
+}
+
+func TestWebhookJSONBody(t *testing.T) {
+	event := `{"type":"Message","event":{"Info":{"ID":"3EB0"}},"base64":"aGVsbG8="}`
+	tests := []struct {
+		name       string
+		payload    map[string]string
+		stripMedia bool
+		want       map[string]interface{}
+	}{
+		{
+			"inline media",
+			map[string]string{"jsonData": event},
+			false,
+			map[string]interface{}{"type": "Message", "event": map[string]interface{}{"Info": map[string]interface{}{"ID": "3EB0"}}, "base64": "aGVsbG8="},
+		},
+		{
+			"media sent as a file part",
+			map[string]string{"jsonData": event},
+			true,
+			map[string]interface{}{"type": "Message", "event": map[string]interface{}{"Info": map[string]interface{}{"ID": "3EB0"}}},
+		},
+		{
+			"token prefix",
+			map[string]string{"jsonData": `{"type":"ReadReceipt"}`, "tokenPrefix": "wz_1a2b"},
+			true,
+			map[string]interface{}{"type": "ReadReceipt", "tokenPrefix": "wz_1a2b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := webhookJSONBody(tt.payload, tt.stripMedia)
+			if err != nil {
+				t.Fatalf("webhookJSONBody() error = %v", err)
+			}
+			var got map[string]interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("body is not JSON: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("webhookJSONBody() = %s, want %v", body, tt.want)
+			}
+		})
+	}
+
+	if _, err := webhookJSONBody(map[string]string{"jsonData": "{"}, false); err == nil {
+		t.Error("webhookJSONBody() accepted invalid jsonData")
+	}
+}
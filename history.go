@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+)
+
+// After pairing, the phone sends the chat history in several HistorySync blobs.
+// Their conversations and messages are imported into the chats and messages
+// tables, and the progress is tracked per user in history_sync_status.
+
+type historySyncStatus struct {
+	Chunks        int          `db:"chunks"`
+	Conversations int          `db:"conversations"`
+	Messages      int          `db:"messages"`
+	Progress      int          `db:"progress"`
+	LastSyncType  string       `db:"last_sync_type"`
+	Complete      bool         `db:"complete"`
+	StartedAt     time.Time    `db:"started_at"`
+	UpdatedAt     time.Time    `db:"updated_at"`
+	CompletedAt   sql.NullTime `db:"completed_at"`
+}
+
+func getHistorySyncStatus(db *sqlx.DB, userID int) (historySyncStatus, bool, error) {
+	var status historySyncStatus
+	err := db.Get(&status, "SELECT chunks, conversations, messages, progress, last_sync_type, complete, started_at, updated_at, completed_at FROM history_sync_status WHERE user_id=$1", userID)
+	if err == sql.ErrNoRows {
+		return status, false, nil
+	}
+	return status, err == nil, err
+}
+
+// Clears the sync progress of a user, called when a new device is paired
+func resetHistorySyncStatus(db *sqlx.DB, userID int) error {
+	_, err := db.Exec("DELETE FROM history_sync_status WHERE user_id=$1", userID)
+	return err
+}
+
+// Stores the conversations and messages of a history sync blob and updates the sync progress
+func importHistorySync(db *sqlx.DB, client *whatsmeow.Client, userID int, data *waProto.HistorySync) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	conversations := 0
+	messages := 0
+	for _, conv := range data.GetConversations() {
+		chatJID, err := types.ParseJID(conv.GetID())
+		if err != nil {
+			log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Str("chat", conv.GetID()).Msg("Skipping history conversation with invalid jid")
+			continue
+		}
+		chatJID = chatJID.ToNonAD()
+
+		var lastMessageAt, mutedUntil sql.NullTime
+		if ts := conv.GetConversationTimestamp(); ts > 0 {
+			lastMessageAt = sql.NullTime{Time: time.Unix(int64(ts), 0), Valid: true}
+		}
+		if ts := conv.GetMuteEndTime(); ts > 0 {
+			mutedUntil = sql.NullTime{Time: time.Unix(int64(ts), 0), Valid: true}
+		}
+		name := conv.GetName()
+		if name == "" {
+			name = conv.GetDisplayName()
+		}
+		_, err = tx.Exec(`INSERT INTO chats (user_id, jid, name, unread_count, last_message_at, archived, pinned, muted, muted_until)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			ON CONFLICT (user_id, jid) DO UPDATE SET
+				name=CASE WHEN EXCLUDED.name<>'' THEN EXCLUDED.name ELSE chats.name END,
+				unread_count=EXCLUDED.unread_count,
+				last_message_at=GREATEST(chats.last_message_at, EXCLUDED.last_message_at),
+				archived=EXCLUDED.archived, pinned=EXCLUDED.pinned, muted=EXCLUDED.muted, muted_until=EXCLUDED.muted_until, updated_at=NOW()`,
+			userID, chatJID.String(), name, conv.GetUnreadCount(), lastMessageAt, conv.GetArchived(), conv.GetPinned() > 0, mutedUntil.Valid, mutedUntil)
+		if err != nil {
+			return err
+		}
+		conversations++
+
+		for _, historyMsg := range conv.GetMessages() {
+			evt, err := client.ParseWebMessage(chatJID, historyMsg.GetMessage())
+			if err != nil {
+				log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Str("chat", chatJID.String()).Msg("Skipping history message that could not be parsed")
+				continue
+			}
+			if err := saveMessage(tx, userID, evt.Info, evt.Message, ""); err != nil {
+				return err
+			}
+			messages++
+		}
+	}
+
+	// The phone reports the progress of the initial transfer, it is done when it reaches 100
+	progress := int(data.GetProgress())
+	_, err = tx.Exec(`INSERT INTO history_sync_status (user_id, chunks, conversations, messages, progress, last_sync_type, complete, completed_at)
+		VALUES ($1, 1, $2, $3, $4, $5, $6, CASE WHEN $6 THEN NOW() END)
+		ON CONFLICT (user_id) DO UPDATE SET
+			chunks=history_sync_status.chunks+1,
+			conversations=history_sync_status.conversations+EXCLUDED.conversations,
+			messages=history_sync_status.messages+EXCLUDED.messages,
+			progress=GREATEST(history_sync_status.progress, EXCLUDED.progress),
+			last_sync_type=EXCLUDED.last_sync_type,
+			complete=history_sync_status.complete OR EXCLUDED.complete,
+			completed_at=COALESCE(history_sync_status.completed_at, EXCLUDED.completed_at),
+			updated_at=NOW()`,
+		userID, conversations, messages, progress, data.GetSyncType().String(), progress >= 100)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Info().Str("userid", strconv.Itoa(userID)).Str("type", data.GetSyncType().String()).Int("conversations", conversations).Int("messages", messages).Int("progress", progress).Msg("Imported history sync")
+	return nil
+}
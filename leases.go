@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog/hlog"
+)
+
+// Sessions are owned by one replica at a time through a lease in the
+// session_leases table. The owner renews its leases while it runs, when a
+// replica dies its leases expire and the other replicas take its sessions
+// over. API calls for a user reaching a replica that does not own its session
+// are forwarded to the owner.
+
+var errLeaseHeld = errors.New("Session is running on another replica")
+
+// Headers set on forwarded requests. They are signed with -clustersecret, a
+// request with a valid signature is always served locally, the headers of a
+// request without one are dropped.
+const (
+	forwardedHeader          = "X-Wuzapi-Forwarded-By"
+	forwardedAtHeader        = "X-Wuzapi-Forwarded-At"
+	forwardedSignatureHeader = "X-Wuzapi-Forwarded-Signature"
+	forwardedBodyHeader      = "X-Wuzapi-Forwarded-Body-Sha256"
+
+	// How old a signed forwarded request can be
+	forwardedMaxAge = 30 * time.Second
+)
+
+// Headers a replica vouches for when it forwards a request
+var forwardedSignedHeaders = []string{forwardedHeader, forwardedAtHeader, forwardedBodyHeader, requestIDHeader, clientIPHeader}
+
+type leaseManager struct {
+	db        *sqlx.DB
+	replicaID string
+	url       string
+	ttl       time.Duration
+
+	proxies sync.Map
+}
+
+type sessionLease struct {
+	Owner    string `db:"owner"`
+	OwnerUrl string `db:"owner_url"`
+}
+
+func newLeaseManager(db *sqlx.DB, replicaID string, replicaURL string, ttl time.Duration) *leaseManager {
+	return &leaseManager{db: db, replicaID: replicaID, url: replicaURL, ttl: ttl}
+}
+
+// Acquire takes the lease of the user's session for this replica. It succeeds
+// if the lease is free, expired or already held by this replica.
+func (m *leaseManager) Acquire(userID int) (bool, error) {
+	result, err := m.db.Exec(`INSERT INTO session_leases (user_id, owner, owner_url, acquired_at, expires_at)
+		VALUES ($1, $2, $3, NOW(), NOW() + $4 * INTERVAL '1 millisecond')
+		ON CONFLICT (user_id) DO UPDATE SET owner=EXCLUDED.owner, owner_url=EXCLUDED.owner_url,
+			acquired_at=CASE WHEN session_leases.owner=EXCLUDED.owner THEN session_leases.acquired_at ELSE NOW() END,
+			expires_at=EXCLUDED.expires_at
+		WHERE session_leases.owner=EXCLUDED.owner OR session_leases.expires_at<NOW()`,
+		userID, m.replicaID, m.url, m.ttl.Milliseconds())
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return rowsAffected == 1, nil
+}
+
+// Release gives up the lease of the user's session if this replica holds it
+func (m *leaseManager) Release(userID int) error {
+	_, err := m.db.Exec("DELETE FROM session_leases WHERE user_id=$1 AND owner=$2", userID, m.replicaID)
+	return err
+}
+
+// Owner returns the replica holding a live lease on the user's session
+func (m *leaseManager) Owner(userID int) (sessionLease, bool, error) {
+	var lease sessionLease
+	err := m.db.Get(&lease, "SELECT owner, owner_url FROM session_leases WHERE user_id=$1 AND expires_at>NOW()", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return lease, false, nil
+	}
+	if err != nil {
+		return lease, false, err
+	}
+	return lease, true, nil
+}
+
+// Owns reports whether this replica holds a live lease on the user's session
+func (m *leaseManager) Owns(userID int) (bool, error) {
+	lease, found, err := m.Owner(userID)
+	if err != nil {
+		return false, err
+	}
+	return found && lease.Owner == m.replicaID, nil
+}
+
+// Records that this replica is alive, the number of live replicas sets how
+// many sessions each of them takes
+func (m *leaseManager) heartbeat() error {
+	_, err := m.db.Exec(`INSERT INTO replicas (id, url, started_at, heartbeat_at) VALUES ($1, $2, NOW(), NOW())
+		ON CONFLICT (id) DO UPDATE SET url=EXCLUDED.url, heartbeat_at=NOW()`, m.replicaID, m.url)
+	return err
+}
+
+// Removes this replica from the live replicas so the others take its share
+// without waiting for its heartbeat to expire
+func (m *leaseManager) retire() error {
+	_, err := m.db.Exec("DELETE FROM replicas WHERE id=$1", m.replicaID)
+	return err
+}
+
+// Extends the leases held by this replica and returns the users they cover
+func (m *leaseManager) renew() (map[int]bool, error) {
+	var userIDs []int
+	err := m.db.Select(&userIDs, `UPDATE session_leases SET expires_at=NOW() + $1 * INTERVAL '1 millisecond'
+		WHERE owner=$2 RETURNING user_id`, m.ttl.Milliseconds(), m.replicaID)
+	if err != nil {
+		return nil, err
+	}
+	renewed := make(map[int]bool, len(userIDs))
+	for _, id := range userIDs {
+		renewed[id] = true
+	}
+	return renewed, nil
+}
+
+// The number of sessions each live replica should run
+func (m *leaseManager) fairShare() (int, error) {
+	var counts struct {
+		Replicas int `db:"replicas"`
+		Sessions int `db:"sessions"`
+	}
+	err := m.db.Get(&counts, `SELECT
+		(SELECT COUNT(*) FROM replicas WHERE heartbeat_at > NOW() - $1 * INTERVAL '1 millisecond') AS replicas,
+		(SELECT COUNT(*) FROM users WHERE connected=1) AS sessions`, m.ttl.Milliseconds())
+	if err != nil {
+		return 0, err
+	}
+	if counts.Replicas < 1 {
+		counts.Replicas = 1
+	}
+	return (counts.Sessions + counts.Replicas - 1) / counts.Replicas, nil
+}
+
+// Returns a reverse proxy to the replica at replicaURL
+func (m *leaseManager) proxy(replicaURL string) (*httputil.ReverseProxy, error) {
+	if p, ok := m.proxies.Load(replicaURL); ok {
+		return p.(*httputil.ReverseProxy), nil
+	}
+	target, err := url.Parse(replicaURL)
+	if err != nil {
+		return nil, err
+	}
+	p := httputil.NewSingleHostReverseProxy(target)
+	director := p.Director
+	p.Director = func(r *http.Request) {
+		director(r)
+		// The serving replica records the request under the same id
+		r.Header.Del(requestIDHeader)
+		if id, ok := hlog.IDFromRequest(r); ok {
+			r.Header.Set(requestIDHeader, id.String())
+		}
+		r.Header.Set(clientIPHeader, requestIP(r))
+		body, err := readBody(r)
+		if err != nil {
+			log.Error().Err(err).Str("replica", replicaURL).Msg("Could not read forwarded request body")
+		}
+		m.signForwarded(r.Header, r.Method, r.URL.RequestURI(), body)
+	}
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Error().Err(err).Str("replica", replicaURL).Msg("Could not forward request")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprint(w, `{"code":502,"error":"Could not reach the replica running the session","success":false}`)
+	}
+	actual, _ := m.proxies.LoadOrStore(replicaURL, p)
+	return actual.(*httputil.ReverseProxy), nil
+}
+
+// Marks a request forwarded by this replica, signing it with the cluster secret.
+// The signature covers the method, the path and query, the time and the body.
+func (m *leaseManager) signForwarded(header http.Header, method string, requestURI string, body []byte) {
+	header.Set(forwardedHeader, m.replicaID)
+	header.Set(forwardedAtHeader, strconv.FormatInt(time.Now().Unix(), 10))
+	header.Set(forwardedBodyHeader, bodySHA256(body))
+	header.Set(forwardedSignatureHeader, signForwarded(*clusterSecret, header, method, requestURI))
+}
+
+func signForwarded(secret string, header http.Header, method string, requestURI string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + requestURI))
+	for _, name := range forwardedSignedHeaders {
+		mac.Write([]byte("\n" + header.Get(name)))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Whether a request was forwarded by another replica, with a valid and
+// recent signature
+func verifyForwarded(r *http.Request) bool {
+	if *clusterSecret == "" || r.Header.Get(forwardedHeader) == "" {
+		return false
+	}
+	at, err := strconv.ParseInt(r.Header.Get(forwardedAtHeader), 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(at, 0)); age > forwardedMaxAge || age < -forwardedMaxAge {
+		return false
+	}
+	signature := signForwarded(*clusterSecret, r.Header, r.Method, r.URL.RequestURI())
+	if !hmac.Equal([]byte(signature), []byte(r.Header.Get(forwardedSignatureHeader))) {
+		return false
+	}
+	body, err := readBody(r)
+	return err == nil && hmac.Equal([]byte(bodySHA256(body)), []byte(r.Header.Get(forwardedBodyHeader)))
+}
+
+func bodySHA256(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// Reads the whole body of a request and puts it back for the next reader
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err
+}
+
+// Drops the forwarding headers of requests not signed by a replica, so only
+// other replicas can have a request served here without the lease check
+func (s *server) peerMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(forwardedHeader) != "" && !verifyForwarded(r) {
+			log.Warn().Str("replica", r.Header.Get(forwardedHeader)).Str("ip", r.RemoteAddr).Msg("Dropping unsigned forwarded request headers")
+			for _, name := range forwardedSignedHeaders {
+				r.Header.Del(name)
+			}
+			r.Header.Del(forwardedSignatureHeader)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Starts the session of the user on this replica once it holds its lease. It
+// returns false if the session is already running here. onExit, if set, is
+// called with the error of the session when it ends.
+func (s *server) startSession(userID int, jid string, subscriptions []string, onExit func(error)) (bool, error) {
+	if sessions.Running(userID) {
+		return false, nil
+	}
+	acquired, err := leases.Acquire(userID)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Could not acquire session lease: %v", err))
+	}
+	if !acquired {
+		return false, errLeaseHeld
+	}
+	started := sessions.Start(userID, func(ctx context.Context) {
+		var sessionErr error
+		defer func() {
+			if err := leases.Release(userID); err != nil {
+				log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not release session lease")
+			}
+			eventStreams.Forget(userID)
+			if onExit != nil {
+				onExit(sessionErr)
+			}
+		}()
+		// A failing session must not take the other sessions down with it
+		defer func() {
+			if p := recover(); p != nil {
+				log.Error().Str("userid", strconv.Itoa(userID)).Interface("panic", p).Msg("Session panicked")
+				sessionErr = fmt.Errorf("session panicked: %v", p)
+			}
+		}()
+		sessionErr = s.startClient(ctx, userID, jid, subscriptions)
+	})
+	return started, nil
+}
+
+// Takes this replica's share of the sessions that should be running and hands
+// one session off when it runs more than its share, so a replica joining the
+// cluster gets sessions over time
+func (s *server) claimSessions() {
+	err := leases.heartbeat()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not record replica heartbeat")
+		return
+	}
+	share, err := leases.fairShare()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not compute the session share")
+		return
+	}
+	running := sessions.List()
+	waiting := startup.Waiting()
+	if len(running) > share {
+		// Only connected sessions are resumed by the replica taking them
+		for i := len(running) - 1; i >= 0; i-- {
+			if state, _ := sessions.State(running[i]); state == sessionStateConnected {
+				log.Info().Str("userid", strconv.Itoa(running[i])).Int("running", len(running)).Int("share", share).Msg("Handing off session to rebalance replicas")
+				sessions.Handoff(running[i])
+				break
+			}
+		}
+		return
+	}
+	if len(running)+waiting < share {
+		s.connectUnowned(share - len(running) - waiting)
+	}
+}
+
+// Renews the leases of this replica and claims sessions until ctx is
+// cancelled. Sessions whose lease was lost, e.g. after losing the database
+// for longer than the lease, are handed off to the replica that took them.
+func (s *server) runLeases(ctx context.Context) {
+	ticker := time.NewTicker(leases.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// Sessions are listed first, their leases were acquired before they started
+		running := sessions.List()
+		renewed, err := leases.renew()
+		if err != nil {
+			log.Error().Err(err).Msg("Could not renew session leases")
+			continue
+		}
+		for _, userID := range running {
+			if !renewed[userID] {
+				log.Warn().Str("userid", strconv.Itoa(userID)).Msg("Lost session lease")
+				sessions.Handoff(userID)
+			}
+		}
+		s.claimSessions()
+	}
+}
+
+// Forwards requests of users whose session runs on another replica to it
+func (s *server) forwardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userinfo, ok := r.Context().Value("userinfo").(Values)
+		if !ok || r.Header.Get(forwardedHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userid, _ := strconv.Atoi(userinfo.Get("Id"))
+		owner, found := s.remoteOwner(userid)
+		if !found {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// Without a cluster secret the owner would not accept the request
+		if *clusterSecret == "" {
+			s.Respond(w, r, http.StatusConflict, errLeaseHeld)
+			return
+		}
+		p, err := leases.proxy(owner.OwnerUrl)
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New(fmt.Sprintf("Invalid replica URL: %v", err)))
+			return
+		}
+		p.ServeHTTP(w, r)
+	})
+}
+
+// Returns the lease of the user's session when another replica runs it
+func (s *server) remoteOwner(userID int) (sessionLease, bool) {
+	if sessions.Running(userID) {
+		return sessionLease{}, false
+	}
+	owner, found, err := leases.Owner(userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not get session lease")
+		return owner, false
+	}
+	if !found || owner.Owner == leases.replicaID {
+		return owner, false
+	}
+	return owner, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPeerMiddleware(t *testing.T) {
+	previous := *clusterSecret
+	defer func() { *clusterSecret = previous }()
+	peer := &leaseManager{replicaID: "replica-1"}
+	s := &server{}
+
+	tests := []struct {
+		name   string
+		secret string
+		sign   bool
+		want   string
+	}{
+		{"unsigned", "cluster-secret", false, ""},
+		{"signed", "cluster-secret", true, "replica-1"},
+		{"no cluster secret", "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*clusterSecret = tt.secret
+			r := httptest.NewRequest("POST", "/chat/send/text", nil)
+			r.Header.Set(forwardedHeader, "replica-1")
+			r.Header.Set(requestIDHeader, "chosen-id")
+			if tt.sign {
+				peer.signForwarded(r.Header, r.Method, r.URL.RequestURI(), nil)
+			}
+			var forwardedBy, requestID string
+			s.peerMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				forwardedBy = r.Header.Get(forwardedHeader)
+				requestID = r.Header.Get(requestIDHeader)
+			})).ServeHTTP(httptest.NewRecorder(), r)
+			if forwardedBy != tt.want {
+				t.Errorf("forwarded by %q, want %q", forwardedBy, tt.want)
+			}
+			if tt.want == "" && requestID != "" {
+				t.Errorf("kept request id %q of an unsigned request", requestID)
+			}
+		})
+	}
+}
+
+// A signature only holds for the request it was made for
+func TestVerifyForwarded(t *testing.T) {
+	previous := *clusterSecret
+	*clusterSecret = "cluster-secret"
+	defer func() { *clusterSecret = previous }()
+	peer := &leaseManager{replicaID: "replica-1"}
+	body := `{"Phone":"5491155554444","Body":"Hello"}`
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		body   string
+		want   bool
+	}{
+		{"same request", "POST", "/chat/send/text?debug=1", body, true},
+		{"other method", "PUT", "/chat/send/text?debug=1", body, false},
+		{"other path", "POST", "/chat/send/image?debug=1", body, false},
+		{"other query", "POST", "/chat/send/text?debug=2", body, false},
+		{"other body", "POST", "/chat/send/text?debug=1", strings.Replace(body, "Hello", "Bye", 1), false},
+		{"no body", "POST", "/chat/send/text?debug=1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signed := httptest.NewRequest("POST", "/chat/send/text?debug=1", nil)
+			peer.signForwarded(signed.Header, signed.Method, signed.URL.RequestURI(), []byte(body))
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header = signed.Header
+			if got := verifyForwarded(r); got != tt.want {
+				t.Errorf("verifyForwarded() = %v, want %v", got, tt.want)
+			}
+			if read, _ := io.ReadAll(r.Body); string(read) != tt.body {
+				t.Errorf("body after verifying = %q, want %q", read, tt.body)
+			}
+		})
+	}
+
+	// Signed again with an old timestamp
+	r := httptest.NewRequest("GET", "/ws?lastEventId=1", nil)
+	peer.signForwarded(r.Header, r.Method, r.URL.RequestURI(), nil)
+	if !verifyForwarded(r) {
+		t.Fatal("verifyForwarded() = false for a request without a body")
+	}
+	r.Header.Set(forwardedAtHeader, strconv.FormatInt(time.Now().Add(-forwardedMaxAge-time.Second).Unix(), 10))
+	r.Header.Set(forwardedSignatureHeader, signForwarded(*clusterSecret, r.Header, r.Method, r.URL.RequestURI()))
+	if verifyForwarded(r) {
+		t.Error("verifyForwarded() = true for a stale signature")
+	}
+}
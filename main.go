@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -32,25 +33,49 @@ type server struct {
 }
 
 var (
-	address     = flag.String("address", "0.0.0.0", "Bind IP Address")
-	port        = flag.String("port", "8080", "Listen Port")
-	waDebug     = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
-	logType     = flag.String("logtype", "console", "Type of log output (console or json)")
-	colorOutput = flag.Bool("color", false, "Enable colored output for console logs")
-	sslcert     = flag.String("sslcertificate", "", "SSL Certificate File")
-	sslprivkey  = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
-	adminToken  = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
-	container   *sqlstore.Container
-
-	killchannel   = make(map[int](chan bool))
+	address            = flag.String("address", "0.0.0.0", "Bind IP Address")
+	port               = flag.String("port", "8080", "Listen Port")
+	waDebug            = flag.String("wadebug", "", "Enable whatsmeow debug (INFO or DEBUG)")
+	logType            = flag.String("logtype", "console", "Type of log output (console or json)")
+	colorOutput        = flag.Bool("color", false, "Enable colored output for console logs")
+	sslcert            = flag.String("sslcertificate", "", "SSL Certificate File")
+	sslprivkey         = flag.String("sslprivatekey", "", "SSL Certificate Private Key File")
+	adminToken         = flag.String("admintoken", "", "Security Token to authorize admin actions (list/create/remove users)")
+	webhookWorkers     = flag.Int("webhookworkers", 4, "Number of concurrent webhook delivery workers")
+	webhookMaxAttempts = flag.Int("webhookmaxattempts", 10, "Maximum delivery attempts before a webhook is marked as failed")
+	webhookRetention   = flag.Duration("webhookretention", 7*24*time.Hour, "How long delivered and failed webhooks and delivery attempts are kept, 0 to keep them forever")
+	replicaID          = flag.String("replicaid", "", "Unique name of this replica (default hostname)")
+	replicaURL         = flag.String("replicaurl", "", "URL other replicas use to reach this one (default http://hostname:port)")
+	leaseTTL           = flag.Duration("leasettl", 30*time.Second, "How long a replica owns its sessions without renewing them")
+	startupWorkers     = flag.Int("startupconcurrency", 8, "Number of sessions restored at the same time on startup")
+	startupStagger     = flag.Duration("startupstagger", 500*time.Millisecond, "Delay between two session restores")
+	startupAttempts    = flag.Int("startupattempts", 5, "Attempts to restore a session before giving up")
+	wsOrigins          = flag.String("wsorigins", "", "Comma separated origins allowed to open websockets besides the server's own, * for any")
+	clusterSecret      = flag.String("clustersecret", "", "Secret shared by the replicas to sign the requests they forward to each other")
+	expiryWarning      = flag.Duration("expirywarning", 72*time.Hour, "How long before an account expires its users get an AccountStatus webhook")
+	shutdownTimeout    = flag.Duration("shutdowntimeout", 30*time.Second, "How long to wait for requests and sessions to finish on shutdown")
+	webhookDrainTime   = flag.Duration("webhookdraintimeout", 10*time.Second, "How long to keep delivering due webhooks on shutdown")
+	container          *sqlstore.Container
+	webhookQueue       *webhookOutbox
+	leases             *leaseManager
+	startup            *startupQueue
+
+	sessions      = NewSessionManager()
 	userinfocache = cache.New(5*time.Minute, 10*time.Minute)
+	tokencache    = cache.New(5*time.Minute, 10*time.Minute)
+	eventStreams  = newEventHub()
+	qrStreams     = newEventHub()
 	log           zerolog.Logger
 )
 
 func init() {
 	// Tente carregar o .env, mas não sobrescreva variáveis de ambiente existentes
 	_ = godotenv.Overload(".env")
+}
 
+// Lê as flags e completa as opções com o ambiente, chamada no início do main
+// para não interferir nas flags do go test
+func configure() {
 	flag.Parse()
 
 	if *logType == "json" {
@@ -65,6 +90,25 @@ func init() {
 			*adminToken = v
 		}
 	}
+
+	if *clusterSecret == "" {
+		if v := os.Getenv("WUZAPI_CLUSTER_SECRET"); v != "" {
+			*clusterSecret = v
+		}
+	}
+
+	// Identidade desta réplica para os leases de sessão
+	hostname, _ := os.Hostname()
+	if *replicaID == "" {
+		*replicaID = hostname
+	}
+	if *replicaURL == "" {
+		scheme := "http"
+		if *sslcert != "" {
+			scheme = "https"
+		}
+		*replicaURL = scheme + "://" + hostname + ":" + *port
+	}
 }
 
 
@@ -87,6 +131,8 @@ func runMigrations(db *sqlx.DB) {
 }
 
 func main() {
+	configure()
+
 	ex, err := os.Executable()
 	if err != nil {
 		panic(err)
@@ -132,6 +178,11 @@ func main() {
 		panic(err)
 	}
 
+	// Inicia a fila de entrega de webhooks
+	defaultHttpClient = newHttpClient()
+	webhookQueue = newWebhookOutbox(db, *replicaID, *webhookWorkers, *webhookMaxAttempts, *webhookRetention)
+	webhookQueue.Start()
+
 	s := &server{
 		router: mux.NewRouter(),
 		db:     db,
@@ -139,8 +190,19 @@ func main() {
 	}
 	s.routes()
 
+	// Reconecta a parte desta réplica das sessões e mantém os leases
+	leases = newLeaseManager(db, *replicaID, *replicaURL, *leaseTTL)
+	startup = newStartupQueue(*startupWorkers, *startupStagger, *startupAttempts)
+	leaseCtx, stopLeases := context.WithCancel(context.Background())
+	defer stopLeases()
+	s.runStartup(leaseCtx)
 	s.connectOnStartup()
+	go s.runLeases(leaseCtx)
+	go s.runAccountWatcher(leaseCtx, *expiryWarning)
+	go listenUserInfo(leaseCtx, dsn)
 
+	// Os streams de eventos terminam quando o servidor começa a parar
+	baseCtx, cancelBase := context.WithCancel(context.Background())
 	srv := &http.Server{
 		Addr:    *address + ":" + *port,
 		Handler: s.router,
@@ -148,7 +210,9 @@ func main() {
 		ReadTimeout:       60 * time.Second,
 		WriteTimeout:      120 * time.Second,
 		IdleTimeout:       180 * time.Second,
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
 	}
+	srv.RegisterOnShutdown(cancelBase)
 
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
@@ -169,14 +233,7 @@ func main() {
 	<-done
 	log.Info().Msg("Servidor parando")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer func() {
-		cancel()
-	}()
-
-	if err := srv.Shutdown(ctx); err != nil {
-		log.Error().Str("error", fmt.Sprintf("%+v", err)).Msg("Falha ao parar o servidor")
-		os.Exit(1)
-	}
+	// Para as requisições, as sessões e a fila de webhooks nesta ordem
+	s.shutdown(srv, stopLeases, *shutdownTimeout, *webhookDrainTime)
 	log.Info().Msg("Servidor saiu corretamente")
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"go.mau.fi/whatsmeow/types"
+	"google.golang.org/protobuf/proto"
+)
+
+// Messages received and sent by every session are stored in the messages
+// table so conversations can be queried later. Edits and revokes are applied
+// to the original message instead of being stored as separate rows.
+
+type storedMessage struct {
+	Id            int64        `db:"id"`
+	MessageId     string       `db:"message_id"`
+	ChatJid       string       `db:"chat_jid"`
+	SenderJid     string       `db:"sender_jid"`
+	FromMe        bool         `db:"from_me"`
+	Timestamp     time.Time    `db:"timestamp"`
+	Type          string       `db:"type"`
+	Text          string       `db:"text"`
+	MediaType     string       `db:"media_type"`
+	MediaFileName string       `db:"media_file_name"`
+	MediaSize     int64        `db:"media_size"`
+	MediaPath     string       `db:"media_path"`
+	QuotedId      string       `db:"quoted_id"`
+	EditedAt      sql.NullTime `db:"edited_at"`
+	Deleted       bool         `db:"deleted"`
+	Raw           []byte       `db:"raw"`
+}
+
+// Summary of the content of a message used to fill the messages table
+type messageContent struct {
+	Type          string
+	Text          string
+	MediaType     string
+	MediaFileName string
+	MediaSize     int64
+	QuotedId      string
+}
+
+func describeMessage(msg *waProto.Message) messageContent {
+	var content messageContent
+	var ctx *waProto.ContextInfo
+	switch {
+	case msg.GetConversation() != "":
+		content.Type = "text"
+		content.Text = msg.GetConversation()
+	case msg.GetExtendedTextMessage() != nil:
+		content.Type = "text"
+		content.Text = msg.GetExtendedTextMessage().GetText()
+		ctx = msg.GetExtendedTextMessage().GetContextInfo()
+	case msg.GetImageMessage() != nil:
+		m := msg.GetImageMessage()
+		content = messageContent{Type: "image", Text: m.GetCaption(), MediaType: m.GetMimetype(), MediaSize: int64(m.GetFileLength())}
+		ctx = m.GetContextInfo()
+	case msg.GetVideoMessage() != nil:
+		m := msg.GetVideoMessage()
+		content = messageContent{Type: "video", Text: m.GetCaption(), MediaType: m.GetMimetype(), MediaSize: int64(m.GetFileLength())}
+		ctx = m.GetContextInfo()
+	case msg.GetAudioMessage() != nil:
+		m := msg.GetAudioMessage()
+		content = messageContent{Type: "audio", MediaType: m.GetMimetype(), MediaSize: int64(m.GetFileLength())}
+		ctx = m.GetContextInfo()
+	case msg.GetDocumentMessage() != nil:
+		m := msg.GetDocumentMessage()
+		content = messageContent{Type: "document", Text: m.GetCaption(), MediaType: m.GetMimetype(), MediaFileName: m.GetFileName(), MediaSize: int64(m.GetFileLength())}
+		ctx = m.GetContextInfo()
+	case msg.GetStickerMessage() != nil:
+		m := msg.GetStickerMessage()
+		content = messageContent{Type: "sticker", MediaType: m.GetMimetype(), MediaSize: int64(m.GetFileLength())}
+		ctx = m.GetContextInfo()
+	case msg.GetLocationMessage() != nil:
+		m := msg.GetLocationMessage()
+		content.Type = "location"
+		content.Text = strings.TrimSpace(fmt.Sprintf("%s %f,%f", m.GetName(), m.GetDegreesLatitude(), m.GetDegreesLongitude()))
+		ctx = m.GetContextInfo()
+	case msg.GetContactMessage() != nil:
+		m := msg.GetContactMessage()
+		content.Type = "contact"
+		content.Text = m.GetDisplayName()
+		ctx = m.GetContextInfo()
+	case msg.GetReactionMessage() != nil:
+		content.Type = "reaction"
+		content.Text = msg.GetReactionMessage().GetText()
+		content.QuotedId = msg.GetReactionMessage().GetKey().GetID()
+	case msg.GetButtonsMessage() != nil:
+		content.Type = "buttons"
+		content.Text = msg.GetButtonsMessage().GetContentText()
+	case msg.GetListMessage() != nil:
+		content.Type = "list"
+		content.Text = msg.GetListMessage().GetTitle()
+	case msg.GetTemplateMessage() != nil:
+		content.Type = "template"
+		content.Text = msg.GetTemplateMessage().GetHydratedTemplate().GetHydratedContentText()
+	case msg.GetPollCreationMessage() != nil:
+		content.Type = "poll"
+		content.Text = msg.GetPollCreationMessage().GetName()
+	default:
+		content.Type = "unknown"
+	}
+	if ctx != nil && ctx.GetStanzaID() != "" {
+		content.QuotedId = ctx.GetStanzaID()
+	}
+	return content
+}
+
+// Strips the wrappers used when sending (view once, edits) to get to the actual content
+func unwrapMessage(msg *waProto.Message) *waProto.Message {
+	for {
+		switch {
+		case msg.GetViewOnceMessage().GetMessage() != nil:
+			msg = msg.GetViewOnceMessage().GetMessage()
+		case msg.GetViewOnceMessageV2().GetMessage() != nil:
+			msg = msg.GetViewOnceMessageV2().GetMessage()
+		case msg.GetEphemeralMessage().GetMessage() != nil:
+			msg = msg.GetEphemeralMessage().GetMessage()
+		case msg.GetEditedMessage().GetMessage() != nil:
+			msg = msg.GetEditedMessage().GetMessage()
+		case msg.GetDocumentWithCaptionMessage().GetMessage() != nil:
+			msg = msg.GetDocumentWithCaptionMessage().GetMessage()
+		default:
+			return msg
+		}
+	}
+}
+
+// Stores a message, or applies it to the original message when it is an edit or a revoke
+func saveMessage(db sqlx.Execer, userID int, info types.MessageInfo, msg *waProto.Message, mediaPath string) error {
+	if msg == nil {
+		return nil
+	}
+	msg = unwrapMessage(msg)
+	chat := info.Chat.ToNonAD().String()
+
+	if pm := msg.GetProtocolMessage(); pm != nil {
+		target := pm.GetKey().GetID()
+		switch pm.GetType() {
+		case waProto.ProtocolMessage_REVOKE:
+			_, err := db.Exec("UPDATE messages SET deleted=TRUE WHERE user_id=$1 AND chat_jid=$2 AND message_id=$3", userID, chat, target)
+			return err
+		case waProto.ProtocolMessage_MESSAGE_EDIT:
+			content := describeMessage(pm.GetEditedMessage())
+			_, err := db.Exec("UPDATE messages SET text=$1, edited_at=$2 WHERE user_id=$3 AND chat_jid=$4 AND message_id=$5", content.Text, info.Timestamp, userID, chat, target)
+			return err
+		}
+		return nil
+	}
+
+	content := describeMessage(msg)
+	raw, err := proto.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`INSERT INTO messages (user_id, message_id, chat_jid, sender_jid, from_me, timestamp, type, text, media_type, media_file_name, media_size, media_path, quoted_id, raw)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		ON CONFLICT (user_id, chat_jid, message_id) DO UPDATE SET
+			sender_jid=EXCLUDED.sender_jid, from_me=EXCLUDED.from_me, timestamp=EXCLUDED.timestamp, type=EXCLUDED.type, text=EXCLUDED.text,
+			media_type=EXCLUDED.media_type, media_file_name=EXCLUDED.media_file_name, media_size=EXCLUDED.media_size,
+			media_path=CASE WHEN EXCLUDED.media_path<>'' THEN EXCLUDED.media_path ELSE messages.media_path END,
+			quoted_id=EXCLUDED.quoted_id, raw=EXCLUDED.raw`,
+		userID, info.ID, chat, info.Sender.ToNonAD().String(), info.IsFromMe, info.Timestamp, content.Type, content.Text,
+		content.MediaType, content.MediaFileName, content.MediaSize, mediaPath, content.QuotedId, raw)
+	return err
+}
+
+// Sets the path of the downloaded media of a stored message
+func saveMessageMediaPath(db *sqlx.DB, userID int, info types.MessageInfo, mediaPath string) error {
+	_, err := db.Exec("UPDATE messages SET media_path=$1 WHERE user_id=$2 AND chat_jid=$3 AND message_id=$4", mediaPath, userID, info.Chat.ToNonAD().String(), info.ID)
+	return err
+}
+
+// Stores a message sent through the API
+func (s *server) saveSentMessage(userid int, chat types.JID, msgid string, timestamp time.Time, msg *waProto.Message) {
+	info := types.MessageInfo{
+		MessageSource: types.MessageSource{
+			Chat:     chat,
+			IsFromMe: true,
+			IsGroup:  chat.Server == types.GroupServer,
+		},
+		ID:        msgid,
+		Timestamp: timestamp,
+	}
+	if client := sessions.Get(userid); client != nil && client.Store.ID != nil {
+		info.Sender = *client.Store.ID
+	}
+	err := saveMessage(s.db, userid, info, msg, "")
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userid)).Str("id", msgid).Msg("Could not store sent message")
+	}
+	err = saveServerAck(s.db, userid, chat, msgid, timestamp)
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userid)).Str("id", msgid).Msg("Could not store message status")
+	}
+	err = updateChatActivity(s.db, userid, info, msg)
+	if err != nil {
+		log.Error().Err(err).Str("userid", strconv.Itoa(userid)).Str("chat", chat.String()).Msg("Could not update chat")
+	}
+}
+
+// Encodes the position of a message in the conversation as a pagination cursor
+func messageCursor(m storedMessage) string {
+	return strconv.FormatInt(m.Timestamp.UnixMicro(), 10) + "_" + strconv.FormatInt(m.Id, 10)
+}
+
+func parseMessageCursor(cursor string) (time.Time, int64, error) {
+	parts := strings.SplitN(cursor, "_", 2)
+	if len(parts) != 2 {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	micros, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid cursor")
+	}
+	return time.UnixMicro(micros), id, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	waProto "go.mau.fi/whatsmeow/binary/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestDescribeMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  *waProto.Message
+		want messageContent
+	}{
+		{
+			"conversation",
+			&waProto.Message{Conversation: proto.String("hello")},
+			messageContent{Type: "text", Text: "hello"},
+		},
+		{
+			"reply",
+			&waProto.Message{ExtendedTextMessage: &waProto.ExtendedTextMessage{
+				Text:        proto.String("sure"),
+				ContextInfo: &waProto.ContextInfo{StanzaID: proto.String("3EB0QUOTED")},
+			}},
+			messageContent{Type: "text", Text: "sure", QuotedId: "3EB0QUOTED"},
+		},
+		{
+			"image",
+			&waProto.Message{ImageMessage: &waProto.ImageMessage{
+				Caption:    proto.String("receipt"),
+				Mimetype:   proto.String("image/jpeg"),
+				FileLength: proto.Uint64(2048),
+			}},
+			messageContent{Type: "image", Text: "receipt", MediaType: "image/jpeg", MediaSize: 2048},
+		},
+		{
+			"document",
+			&waProto.Message{DocumentMessage: &waProto.DocumentMessage{
+				FileName:   proto.String("invoice.pdf"),
+				Mimetype:   proto.String("application/pdf"),
+				FileLength: proto.Uint64(4096),
+			}},
+			messageContent{Type: "document", MediaType: "application/pdf", MediaFileName: "invoice.pdf", MediaSize: 4096},
+		},
+		{
+			"reaction",
+			&waProto.Message{ReactionMessage: &waProto.ReactionMessage{
+				Text: proto.String("👍"),
+				Key:  &waProto.MessageKey{ID: proto.String("3EB0TARGET")},
+			}},
+			messageContent{Type: "reaction", Text: "👍", QuotedId: "3EB0TARGET"},
+		},
+		{
+			"view once",
+			unwrapMessage(&waProto.Message{ViewOnceMessage: &waProto.FutureProofMessage{
+				Message: &waProto.Message{VideoMessage: &waProto.VideoMessage{Mimetype: proto.String("video/mp4")}},
+			}}),
+			messageContent{Type: "video", MediaType: "video/mp4"},
+		},
+		{
+			"unknown",
+			&waProto.Message{},
+			messageContent{Type: "unknown"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describeMessage(tt.msg); got != tt.want {
+				t.Errorf("describeMessage() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageCursor(t *testing.T) {
+	m := storedMessage{Id: 42, Timestamp: time.UnixMicro(1700000000123456)}
+	timestamp, id, err := parseMessageCursor(messageCursor(m))
+	if err != nil {
+		t.Fatalf("parseMessageCursor() error = %v", err)
+	}
+	if !timestamp.Equal(m.Timestamp) || id != m.Id {
+		t.Errorf("parseMessageCursor() = %v, %d, want %v, %d", timestamp, id, m.Timestamp, m.Id)
+	}
+
+	for _, cursor := range []string{"", "1700000000123456", "abc_42", "1700000000123456_abc", "1700000000123456_"} {
+		if _, _, err := parseMessageCursor(cursor); err == nil {
+			t.Errorf("parseMessageCursor(%q) accepted an invalid cursor", cursor)
+		}
+	}
+}
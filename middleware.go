@@ -2,65 +2,44 @@ package main
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"net/http"
 	"strconv"
 	"strings"
 
-	"github.com/patrickmn/go-cache"
+	"github.com/gorilla/mux"
 )
 
-// validateToken verifica se o token é admin ou usuário e retorna o tipo e dados do usuário
-func (s *server) validateToken(token string) (bool, Values, error) {
+// validateToken verifica se o token é admin ou usuário e retorna o tipo, os dados do usuário e os escopos do token
+func (s *server) validateToken(token string) (bool, Values, tokenEntry, error) {
 	if token == "" {
-		return false, Values{}, errors.New("no token provided")
+		return false, Values{}, tokenEntry{}, errors.New("no token provided")
 	}
 
 	// Primeiro verifica se é token admin
 	if token == *adminToken {
-		return true, Values{}, nil
+		return true, Values{}, tokenEntry{}, nil
 	}
 
-	// Se não for admin, busca informações do usuário
-	var txtid = ""
-	var webhook = ""
-	var jid = ""
-	var events = ""
-
-	// Verifica cache primeiro
-	myuserinfo, found := userinfocache.Get(token)
-	if found {
-		return false, myuserinfo.(Values), nil
+	// Se não for admin, busca o token e as informações do usuário (cache ou banco)
+	entry, err := resolveToken(s.db, token)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, Values{}, tokenEntry{}, errors.New("invalid token")
 	}
-
-	// Busca no banco de dados
-	rows, err := s.db.Query("SELECT id,webhook,jid,events FROM users WHERE token=$1 LIMIT 1", token)
 	if err != nil {
-		return false, Values{}, err
+		return false, Values{}, tokenEntry{}, err
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		err = rows.Scan(&txtid, &webhook, &jid, &events)
-		if err != nil {
-			return false, Values{}, err
-		}
-		// Converte ID para garantir que é um número válido
-		if _, err := strconv.Atoi(txtid); err != nil {
-			return false, Values{}, errors.New("invalid user ID format")
-		}
-		v := Values{map[string]string{
-			"Id":      txtid,
-			"Jid":     jid,
-			"Webhook": webhook,
-			"Token":   token,
-			"Events":  events,
-		}}
-		userinfocache.Set(token, v, cache.NoExpiration)
-		return false, v, nil
+	v, err := getUserInfoByID(s.db, entry.UserID)
+	if err != nil {
+		return false, Values{}, tokenEntry{}, err
 	}
 
-	return false, Values{}, errors.New("invalid token")
+	// Contas suspensas ou expiradas não podem usar a API
+	if err := checkAccount(v); err != nil {
+		return false, Values{}, tokenEntry{}, err
+	}
+	return false, v, entry, nil
 }
 
 // Middleware unificado para autenticação
@@ -73,7 +52,11 @@ func (s *server) authMiddleware(next http.Handler) http.Handler {
 		}
 
 		// Valida o token
-		isAdmin, userInfo, err := s.validateToken(token)
+		isAdmin, userInfo, tokenInfo, err := s.validateToken(token)
+		if errors.Is(err, errAccountSuspended) || errors.Is(err, errAccountExpired) {
+			s.Respond(w, r, http.StatusForbidden, err)
+			return
+		}
 		if err != nil {
 			s.Respond(w, r, http.StatusUnauthorized, errors.New("Unauthorized"))
 			return
@@ -85,9 +68,18 @@ func (s *server) authMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Para rotas de usuário, adiciona informações ao contexto
+		// Para rotas de usuário, verifica os escopos e adiciona informações ao contexto
 		if !isAdmin {
+			if scope := requiredScope(r); !tokenInfo.allows(scope) {
+				if scope == "" {
+					s.Respond(w, r, http.StatusForbidden, errors.New("Only the main token can use this route"))
+				} else {
+					s.Respond(w, r, http.StatusForbidden, errors.New("Missing scope "+scope))
+				}
+				return
+			}
 			ctx := context.WithValue(r.Context(), "userinfo", userInfo)
+			ctx = context.WithValue(ctx, "tokeninfo", tokenInfo)
 			next.ServeHTTP(w, r.WithContext(ctx))
 			return
 		}
@@ -96,3 +88,37 @@ func (s *server) authMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// Executa rotas de usuário em nome do usuário {id} da rota admin
+func (s *server) asUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userid, err := strconv.Atoi(mux.Vars(r)["id"])
+		if err != nil {
+			s.Respond(w, r, http.StatusBadRequest, errors.New("Invalid user id"))
+			return
+		}
+		userInfo, err := getUserInfoByID(s.db, userid)
+		if errors.Is(err, sql.ErrNoRows) {
+			s.Respond(w, r, http.StatusNotFound, errors.New("User not found"))
+			return
+		}
+		if err != nil {
+			s.Respond(w, r, http.StatusInternalServerError, errors.New("Problem accessing DB"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), "userinfo", userInfo)
+		ctx = context.WithValue(ctx, "tokeninfo", tokenEntry{UserID: userid})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// Recusa a rota para contas suspensas ou expiradas
+func (s *server) activeAccountMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := checkAccount(r.Context().Value("userinfo").(Values)); err != nil {
+			s.Respond(w, r, http.StatusForbidden, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,2 @@
+-- migrations/0002_create_webhook_outbox_table.down.sql
+DROP TABLE webhook_outbox;
@@ -0,0 +1,3 @@
+-- migrations/0003_add_webhook_secret_to_users.down.sql
+ALTER TABLE users DROP COLUMN IF EXISTS webhook_include_token;
+ALTER TABLE users DROP COLUMN IF EXISTS webhook_secret;
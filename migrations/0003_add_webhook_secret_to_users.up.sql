@@ -0,0 +1,3 @@
+-- migrations/0003_add_webhook_secret_to_users.up.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS webhook_secret TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS webhook_include_token BOOLEAN NOT NULL DEFAULT FALSE;
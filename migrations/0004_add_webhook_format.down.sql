@@ -0,0 +1,3 @@
+-- migrations/0004_add_webhook_format.down.sql
+ALTER TABLE webhook_outbox DROP COLUMN IF EXISTS format;
+ALTER TABLE users DROP COLUMN IF EXISTS webhook_format;
@@ -0,0 +1,3 @@
+-- migrations/0004_add_webhook_format.up.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS webhook_format TEXT NOT NULL DEFAULT 'form';
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS format TEXT NOT NULL DEFAULT 'form';
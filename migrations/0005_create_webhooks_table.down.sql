@@ -0,0 +1,3 @@
+-- migrations/0005_create_webhooks_table.down.sql
+ALTER TABLE webhook_outbox DROP COLUMN IF EXISTS webhook_id;
+DROP TABLE webhooks;
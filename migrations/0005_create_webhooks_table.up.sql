@@ -0,0 +1,15 @@
+-- migrations/0005_create_webhooks_table.up.sql
+CREATE TABLE IF NOT EXISTS webhooks (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    events TEXT NOT NULL DEFAULT 'All',
+    enabled BOOLEAN NOT NULL DEFAULT TRUE,
+    format TEXT NOT NULL DEFAULT 'form',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_user_id_idx ON webhooks (user_id);
+
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS webhook_id INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- migrations/0006_create_webhook_deliveries_table.down.sql
+DROP TABLE webhook_deliveries;
+ALTER TABLE webhook_outbox DROP COLUMN IF EXISTS message_id;
+ALTER TABLE webhook_outbox DROP COLUMN IF EXISTS event_type;
@@ -0,0 +1,22 @@
+-- migrations/0006_create_webhook_deliveries_table.up.sql
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS event_type TEXT NOT NULL DEFAULT '';
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS message_id TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id BIGSERIAL PRIMARY KEY,
+    outbox_id BIGINT NOT NULL,
+    user_id INTEGER NOT NULL,
+    webhook_id INTEGER NOT NULL DEFAULT 0,
+    url TEXT NOT NULL,
+    event_type TEXT NOT NULL DEFAULT '',
+    message_id TEXT NOT NULL DEFAULT '',
+    attempt INTEGER NOT NULL,
+    status_code INTEGER NOT NULL DEFAULT 0,
+    latency_ms INTEGER NOT NULL DEFAULT 0,
+    response_body TEXT NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_user_id_idx ON webhook_deliveries (user_id, id DESC);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_message_id_idx ON webhook_deliveries (user_id, message_id);
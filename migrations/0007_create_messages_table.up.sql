@@ -0,0 +1,24 @@
+-- migrations/0007_create_messages_table.up.sql
+CREATE TABLE IF NOT EXISTS messages (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    sender_jid TEXT NOT NULL DEFAULT '',
+    from_me BOOLEAN NOT NULL DEFAULT FALSE,
+    timestamp TIMESTAMPTZ NOT NULL,
+    type TEXT NOT NULL DEFAULT '',
+    text TEXT NOT NULL DEFAULT '',
+    media_type TEXT NOT NULL DEFAULT '',
+    media_file_name TEXT NOT NULL DEFAULT '',
+    media_size BIGINT NOT NULL DEFAULT 0,
+    media_path TEXT NOT NULL DEFAULT '',
+    quoted_id TEXT NOT NULL DEFAULT '',
+    edited_at TIMESTAMPTZ,
+    deleted BOOLEAN NOT NULL DEFAULT FALSE,
+    raw BYTEA,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, chat_jid, message_id)
+);
+
+CREATE INDEX IF NOT EXISTS messages_chat_timestamp_idx ON messages (user_id, chat_jid, timestamp DESC, id DESC);
@@ -0,0 +1,3 @@
+-- migrations/0008_create_chats_and_history_sync_tables.down.sql
+DROP TABLE history_sync_status;
+DROP TABLE chats;
@@ -0,0 +1,3 @@
+-- migrations/0009_add_chat_muted_flag.down.sql
+DROP INDEX IF EXISTS chats_user_activity_idx;
+ALTER TABLE chats DROP COLUMN IF EXISTS muted;
@@ -0,0 +1,5 @@
+-- migrations/0009_add_chat_muted_flag.up.sql
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS muted BOOLEAN NOT NULL DEFAULT FALSE;
+UPDATE chats SET muted = TRUE WHERE muted_until IS NOT NULL;
+
+CREATE INDEX IF NOT EXISTS chats_user_activity_idx ON chats (user_id, pinned DESC, last_message_at DESC NULLS LAST, id DESC);
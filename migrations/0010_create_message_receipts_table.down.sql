@@ -0,0 +1,2 @@
+-- migrations/0010_create_message_receipts_table.down.sql
+DROP TABLE message_receipts;
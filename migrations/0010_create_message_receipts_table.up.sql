@@ -0,0 +1,14 @@
+-- migrations/0010_create_message_receipts_table.up.sql
+CREATE TABLE IF NOT EXISTS message_receipts (
+    id BIGSERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id TEXT NOT NULL,
+    chat_jid TEXT NOT NULL,
+    recipient_jid TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL,
+    timestamp TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, message_id, recipient_jid, status)
+);
+
+CREATE INDEX IF NOT EXISTS message_receipts_message_idx ON message_receipts (user_id, message_id);
@@ -0,0 +1,3 @@
+-- migrations/0011_add_proxy_to_users.down.sql
+ALTER TABLE users DROP COLUMN IF EXISTS proxy_webhooks;
+ALTER TABLE users DROP COLUMN IF EXISTS proxy_url;
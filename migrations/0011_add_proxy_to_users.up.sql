@@ -0,0 +1,3 @@
+-- migrations/0011_add_proxy_to_users.up.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS proxy_url TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS proxy_webhooks BOOLEAN NOT NULL DEFAULT FALSE;
@@ -0,0 +1,4 @@
+-- migrations/0012_add_device_identity_to_users.down.sql
+ALTER TABLE users DROP COLUMN IF EXISTS device_browser;
+ALTER TABLE users DROP COLUMN IF EXISTS device_platform;
+ALTER TABLE users DROP COLUMN IF EXISTS device_name;
@@ -0,0 +1,4 @@
+-- migrations/0012_add_device_identity_to_users.up.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS device_name TEXT NOT NULL DEFAULT 'Mac OS 10';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS device_platform TEXT NOT NULL DEFAULT 'UNKNOWN';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS device_browser TEXT NOT NULL DEFAULT 'Chrome';
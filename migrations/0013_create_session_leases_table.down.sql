@@ -0,0 +1,3 @@
+-- migrations/0013_create_session_leases_table.down.sql
+DROP TABLE IF EXISTS session_leases;
+DROP TABLE IF EXISTS replicas;
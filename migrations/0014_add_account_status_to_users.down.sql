@@ -0,0 +1,3 @@
+-- migrations/0014_add_account_status_to_users.down.sql
+ALTER TABLE users DROP COLUMN IF EXISTS expiry_warned_at;
+ALTER TABLE users DROP COLUMN IF EXISTS status;
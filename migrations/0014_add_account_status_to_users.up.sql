@@ -0,0 +1,3 @@
+-- migrations/0014_add_account_status_to_users.up.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS expiry_warned_at TIMESTAMPTZ;
@@ -0,0 +1,4 @@
+-- migrations/0015_create_user_tokens_table.down.sql
+-- Only the hashes are stored, the users need new tokens after going back
+ALTER TABLE users ADD COLUMN IF NOT EXISTS token TEXT NOT NULL DEFAULT '';
+DROP TABLE IF EXISTS user_tokens;
@@ -0,0 +1,25 @@
+-- migrations/0015_create_user_tokens_table.up.sql
+CREATE TABLE IF NOT EXISTS user_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    prefix TEXT NOT NULL,
+    salt TEXT NOT NULL,
+    hash TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS user_tokens_prefix_idx ON user_tokens (prefix);
+CREATE INDEX IF NOT EXISTS user_tokens_user_id_idx ON user_tokens (user_id);
+
+-- The tokens in clear are hashed and dropped, the prefix is computed as in tokenPrefix
+INSERT INTO user_tokens (user_id, prefix, salt, hash)
+SELECT id, prefix, salt, encode(sha256(convert_to(salt || token, 'UTF8')), 'hex')
+FROM (
+    SELECT id, token, md5(random()::text || id::text) AS salt,
+        CASE WHEN token LIKE 'wz\_%' AND length(token) >= 11 THEN left(token, 11) ELSE left(token, 4) END AS prefix
+    FROM users
+    WHERE token <> ''
+) AS legacy;
+
+ALTER TABLE users DROP COLUMN IF EXISTS token;
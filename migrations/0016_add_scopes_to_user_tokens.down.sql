@@ -0,0 +1,4 @@
+-- migrations/0016_add_scopes_to_user_tokens.down.sql
+DELETE FROM user_tokens WHERE scopes IS NOT NULL;
+ALTER TABLE user_tokens DROP COLUMN IF EXISTS scopes;
+ALTER TABLE user_tokens DROP COLUMN IF EXISTS label;
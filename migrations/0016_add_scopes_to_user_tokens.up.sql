@@ -0,0 +1,4 @@
+-- migrations/0016_add_scopes_to_user_tokens.up.sql
+-- Main tokens have no scopes, API keys a comma separated list of them
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS label TEXT NOT NULL DEFAULT '';
+ALTER TABLE user_tokens ADD COLUMN IF NOT EXISTS scopes TEXT;
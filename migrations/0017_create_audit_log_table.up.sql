@@ -0,0 +1,31 @@
+-- migrations/0017_create_audit_log_table.up.sql
+-- Admin and session actions, rows are never updated nor deleted
+CREATE TABLE IF NOT EXISTS audit_log (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    action TEXT NOT NULL,
+    actor TEXT NOT NULL,
+    token_id INTEGER,
+    token_prefix TEXT NOT NULL DEFAULT '',
+    user_id INTEGER,
+    ip TEXT NOT NULL DEFAULT '',
+    request_id TEXT NOT NULL DEFAULT '',
+    method TEXT NOT NULL DEFAULT '',
+    path TEXT NOT NULL DEFAULT '',
+    status INTEGER NOT NULL DEFAULT 0,
+    request JSONB,
+    diff JSONB
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_log_user ON audit_log (user_id, id);
+CREATE INDEX IF NOT EXISTS idx_audit_log_action ON audit_log (action);
+
+CREATE OR REPLACE FUNCTION audit_log_append_only() RETURNS TRIGGER AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS audit_log_append_only ON audit_log;
+CREATE TRIGGER audit_log_append_only BEFORE UPDATE OR DELETE ON audit_log
+    FOR EACH ROW EXECUTE FUNCTION audit_log_append_only();
@@ -0,0 +1,4 @@
+-- migrations/0018_add_user_fk_to_webhook_outbox.down.sql
+DROP INDEX IF EXISTS webhook_outbox_done_idx;
+DROP INDEX IF EXISTS webhook_outbox_user_id_idx;
+ALTER TABLE webhook_outbox DROP CONSTRAINT IF EXISTS webhook_outbox_user_id_fkey;
@@ -0,0 +1,7 @@
+-- migrations/0018_add_user_fk_to_webhook_outbox.up.sql
+-- Entries of deleted users go with them, done entries are purged by age
+DELETE FROM webhook_outbox WHERE user_id NOT IN (SELECT id FROM users);
+ALTER TABLE webhook_outbox ADD CONSTRAINT webhook_outbox_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS webhook_outbox_user_id_idx ON webhook_outbox (user_id);
+CREATE INDEX IF NOT EXISTS webhook_outbox_done_idx ON webhook_outbox (updated_at) WHERE status <> 'pending';
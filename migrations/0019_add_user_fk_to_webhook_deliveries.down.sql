@@ -0,0 +1,3 @@
+-- migrations/0019_add_user_fk_to_webhook_deliveries.down.sql
+DROP INDEX IF EXISTS webhook_deliveries_created_at_idx;
+ALTER TABLE webhook_deliveries DROP CONSTRAINT IF EXISTS webhook_deliveries_user_id_fkey;
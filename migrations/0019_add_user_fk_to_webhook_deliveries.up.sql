@@ -0,0 +1,6 @@
+-- migrations/0019_add_user_fk_to_webhook_deliveries.up.sql
+-- Attempts of deleted users go with them, the others are purged by age
+DELETE FROM webhook_deliveries WHERE user_id NOT IN (SELECT id FROM users);
+ALTER TABLE webhook_deliveries ADD CONSTRAINT webhook_deliveries_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_created_at_idx ON webhook_deliveries (created_at);
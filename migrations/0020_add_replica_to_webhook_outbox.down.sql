@@ -0,0 +1,2 @@
+-- migrations/0020_add_replica_to_webhook_outbox.down.sql
+ALTER TABLE webhook_outbox DROP COLUMN IF EXISTS replica;
@@ -0,0 +1,4 @@
+-- migrations/0020_add_replica_to_webhook_outbox.up.sql
+-- Media files are stored on the replica that received them, only it can send
+-- the entries that have one. Entries queued before have no replica.
+ALTER TABLE webhook_outbox ADD COLUMN IF NOT EXISTS replica TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,4 @@
+-- migrations/0021_add_message_ids_to_webhook_deliveries.down.sql
+CREATE INDEX IF NOT EXISTS webhook_deliveries_message_id_idx ON webhook_deliveries (user_id, message_id);
+DROP INDEX IF EXISTS webhook_deliveries_message_ids_idx;
+ALTER TABLE webhook_deliveries DROP COLUMN IF EXISTS message_ids;
@@ -0,0 +1,9 @@
+-- migrations/0021_add_message_ids_to_webhook_deliveries.up.sql
+-- Receipts cover several messages, their ids are kept one per array element
+-- so the deliveries of a message can be found through the GIN index.
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS message_ids TEXT[] NOT NULL DEFAULT '{}';
+
+UPDATE webhook_deliveries SET message_ids = string_to_array(message_id, ',') WHERE message_id <> '';
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_message_ids_idx ON webhook_deliveries USING GIN (message_ids);
+DROP INDEX IF EXISTS webhook_deliveries_message_id_idx;
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// Webhook deliveries are written to the webhook_outbox table and sent by a
+// pool of workers, so that a receiver outage does not lose events. Entries
+// are retried with exponential backoff until they succeed or run out of
+// attempts. Delivered and failed entries and the log of delivery attempts are
+// deleted after the retention. Entries with a media file are only sent by the
+// replica that stored the file.
+
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxFailed    = "failed"
+
+	outboxPollInterval = 1 * time.Second
+	outboxLease        = 5 * time.Minute
+	outboxBatchSize    = 50
+	outboxBaseDelay    = 5 * time.Second
+	outboxMaxDelay     = 1 * time.Hour
+	outboxSweepPeriod  = 1 * time.Hour
+	deliveryBodyLimit  = 2048
+)
+
+type outboxEntry struct {
+	Id        int64  `db:"id"`
+	UserId    int    `db:"user_id"`
+	WebhookId int    `db:"webhook_id"`
+	Url       string `db:"url"`
+	Payload   string `db:"payload"`
+	File      string `db:"file"`
+	Format    string `db:"format"`
+	EventType string `db:"event_type"`
+	MessageId string `db:"message_id"`
+	Attempts  int    `db:"attempts"`
+}
+
+type webhookOutbox struct {
+	db          *sqlx.DB
+	replica     string
+	workers     int
+	maxAttempts int
+	retention   time.Duration
+	notify      chan struct{}
+	jobs        chan outboxEntry
+	quit        chan struct{}
+	stopped     chan struct{}
+	active      sync.WaitGroup
+	inFlight    atomic.Int64
+}
+
+// What was left behind when the outbox stopped
+type outboxDrainReport struct {
+	InFlight int64 // deliveries still running at the deadline
+	Pending  int   // entries left in the outbox for the next start
+}
+
+// Entries older than retention are deleted once done, never if it is 0
+func newWebhookOutbox(db *sqlx.DB, replica string, workers int, maxAttempts int, retention time.Duration) *webhookOutbox {
+	if workers < 1 {
+		workers = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &webhookOutbox{
+		db:          db,
+		replica:     replica,
+		workers:     workers,
+		maxAttempts: maxAttempts,
+		retention:   retention,
+		notify:      make(chan struct{}, 1),
+		jobs:        make(chan outboxEntry),
+		quit:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// Starts the dispatcher and the delivery workers
+func (o *webhookOutbox) Start() {
+	for i := 0; i < o.workers; i++ {
+		go o.worker()
+	}
+	go o.dispatch()
+	if o.retention > 0 {
+		go o.sweep()
+	}
+	log.Info().Int("workers", o.workers).Int("maxAttempts", o.maxAttempts).Dur("retention", o.retention).Msg("Webhook outbox started")
+}
+
+// Deletes the entries done and the delivery attempts older than the
+// retention, until the outbox stops
+func (o *webhookOutbox) sweep() {
+	ticker := time.NewTicker(outboxSweepPeriod)
+	defer ticker.Stop()
+	for {
+		o.purge()
+		select {
+		case <-ticker.C:
+		case <-o.quit:
+			return
+		}
+	}
+}
+
+func (o *webhookOutbox) purge() {
+	retention := fmt.Sprintf("%d seconds", int(o.retention.Seconds()))
+	result, err := o.db.Exec("DELETE FROM webhook_outbox WHERE status<>$1 AND updated_at<NOW()-$2::interval", outboxPending, retention)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not purge webhook outbox")
+		return
+	}
+	if purged, _ := result.RowsAffected(); purged > 0 {
+		log.Info().Int64("entries", purged).Msg("Purged webhook outbox")
+	}
+
+	result, err = o.db.Exec("DELETE FROM webhook_deliveries WHERE created_at<NOW()-$1::interval", retention)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not purge webhook deliveries")
+		return
+	}
+	if purged, _ := result.RowsAffected(); purged > 0 {
+		log.Info().Int64("deliveries", purged).Msg("Purged webhook deliveries")
+	}
+}
+
+// Enqueue stores a webhook delivery in the outbox and wakes up the dispatcher
+func (o *webhookOutbox) Enqueue(entry outboxEntry, payload map[string]string) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not encode webhook payload: %w", err)
+	}
+	if entry.Format == "" {
+		entry.Format = webhookFormatForm
+	}
+	_, err = o.db.Exec("INSERT INTO webhook_outbox (user_id, webhook_id, url, format, payload, file, event_type, message_id, replica) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		entry.UserId, entry.WebhookId, entry.Url, entry.Format, string(data), entry.File, entry.EventType, entry.MessageId, o.replica)
+	if err != nil {
+		return fmt.Errorf("could not store webhook in outbox: %w", err)
+	}
+	o.wakeup()
+	return nil
+}
+
+// Requeue copies the payload of an earlier outbox entry into a new pending
+// entry, its file stays with the replica that stored it
+func (o *webhookOutbox) Requeue(userID int, outboxID int64) (int64, error) {
+	var id int64
+	err := o.db.Get(&id, `INSERT INTO webhook_outbox (user_id, webhook_id, url, format, payload, file, event_type, message_id, replica)
+		SELECT user_id, webhook_id, url, format, payload, file, event_type, message_id, replica FROM webhook_outbox WHERE id=$1 AND user_id=$2
+		RETURNING id`, outboxID, userID)
+	if err != nil {
+		return 0, err
+	}
+	o.wakeup()
+	return id, nil
+}
+
+func (o *webhookOutbox) wakeup() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (o *webhookOutbox) dispatch() {
+	defer close(o.stopped)
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-o.notify:
+		case <-o.quit:
+			return
+		}
+		for {
+			entries, err := o.claim(outboxBatchSize)
+			if err != nil {
+				log.Error().Err(err).Msg("Could not claim webhook outbox entries")
+				break
+			}
+			for i, entry := range entries {
+				o.active.Add(1)
+				o.inFlight.Add(1)
+				select {
+				case o.jobs <- entry:
+				case <-o.quit:
+					o.inFlight.Add(-1)
+					o.active.Done()
+					o.unclaim(entries[i:])
+					return
+				}
+			}
+			if len(entries) < outboxBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// Gives back claimed entries that were not handed to a worker, so they are
+// delivered right away on the next start instead of after the claim lease
+func (o *webhookOutbox) unclaim(entries []outboxEntry) {
+	ids := make([]int64, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.Id
+	}
+	query, args, err := sqlx.In("UPDATE webhook_outbox SET attempts=attempts-1, next_attempt_at=NOW(), updated_at=NOW() WHERE id IN (?)", ids)
+	if err == nil {
+		_, err = o.db.Exec(o.db.Rebind(query), args...)
+	}
+	if err != nil {
+		log.Error().Err(err).Int("entries", len(ids)).Msg("Could not release claimed webhook outbox entries")
+	}
+}
+
+// Drain delivers the webhooks that are due until none are left or ctx is done,
+// then stops the dispatcher and waits for the running deliveries. Entries
+// scheduled for a later retry stay in the outbox for the next start.
+func (o *webhookOutbox) Drain(ctx context.Context) outboxDrainReport {
+	ticker := time.NewTicker(200 * time.Millisecond)
+	defer ticker.Stop()
+	for ctx.Err() == nil {
+		due := 0
+		err := o.db.Get(&due, "SELECT COUNT(*) FROM webhook_outbox WHERE status=$1 AND next_attempt_at<=NOW() AND "+outboxClaimable,
+			outboxPending, o.replica)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not count due webhooks")
+			break
+		}
+		if due == 0 && o.inFlight.Load() == 0 {
+			break
+		}
+		o.wakeup()
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	close(o.quit)
+	<-o.stopped
+	finished := make(chan struct{})
+	go func() {
+		o.active.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+
+	report := outboxDrainReport{InFlight: o.inFlight.Load()}
+	err := o.db.Get(&report.Pending, "SELECT COUNT(*) FROM webhook_outbox WHERE status=$1", outboxPending)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not count pending webhooks")
+	}
+	return report
+}
+
+// The entries this replica can send, with the replica as the second argument:
+// those without a file and those whose file it stored
+const outboxClaimable = "(file='' OR replica='' OR replica=$2)"
+
+// claim leases due entries by pushing their next attempt into the future, so
+// an entry held by a crashed worker is picked up again once the lease expires
+func (o *webhookOutbox) claim(limit int) ([]outboxEntry, error) {
+	var entries []outboxEntry
+	err := o.db.Select(&entries, `UPDATE webhook_outbox SET attempts=attempts+1, next_attempt_at=NOW()+$3::interval, updated_at=NOW()
+		WHERE id IN (SELECT id FROM webhook_outbox WHERE status=$1 AND next_attempt_at<=NOW() AND `+outboxClaimable+`
+			ORDER BY id LIMIT $4 FOR UPDATE SKIP LOCKED)
+		RETURNING id, user_id, webhook_id, url, format, payload, file, event_type, message_id, attempts`,
+		outboxPending, o.replica, fmt.Sprintf("%d seconds", int(outboxLease.Seconds())), limit)
+	return entries, err
+}
+
+func (o *webhookOutbox) worker() {
+	for entry := range o.jobs {
+		o.deliver(entry)
+		o.inFlight.Add(-1)
+		o.active.Done()
+	}
+}
+
+func (o *webhookOutbox) deliver(entry outboxEntry) {
+	payload := make(map[string]string)
+	err := json.Unmarshal([]byte(entry.Payload), &payload)
+	if err != nil {
+		log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Invalid webhook payload in outbox")
+		o.markFailed(entry, err.Error())
+		return
+	}
+
+	// The endpoint may have been deleted or disabled since the entry was queued
+	if entry.WebhookId != 0 {
+		var enabled bool
+		err = o.db.Get(&enabled, "SELECT enabled FROM webhooks WHERE id=$1", entry.WebhookId)
+		if errors.Is(err, sql.ErrNoRows) {
+			o.markFailed(entry, "webhook endpoint deleted")
+			return
+		}
+		if err != nil {
+			log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Could not get webhook endpoint")
+			o.reschedule(entry, backoffDelay(entry.Attempts), err)
+			return
+		}
+		if !enabled {
+			o.markFailed(entry, "webhook endpoint disabled")
+			return
+		}
+	}
+
+	// The secret and proxy are read on every attempt so retries pick up new settings
+	var user struct {
+		Secret        string `db:"webhook_secret"`
+		ProxyURL      string `db:"proxy_url"`
+		ProxyWebhooks bool   `db:"proxy_webhooks"`
+	}
+	err = o.db.Get(&user, "SELECT webhook_secret, proxy_url, proxy_webhooks FROM users WHERE id=$1", entry.UserId)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			o.markFailed(entry, "user not found")
+			return
+		}
+		log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Could not get webhook settings")
+		o.reschedule(entry, backoffDelay(entry.Attempts), err)
+		return
+	}
+
+	start := time.Now()
+	client := webhookClient(entry.UserId, user.ProxyURL, user.ProxyWebhooks)
+	resp, err := sendWebhook(client, entry.Format, entry.Url, payload, entry.UserId, entry.File, user.Secret)
+	o.logDelivery(entry, resp, err, time.Since(start))
+
+	if err == nil && resp.IsSuccess() {
+		_, err = o.db.Exec("UPDATE webhook_outbox SET status=$1, last_error='', updated_at=NOW() WHERE id=$2", outboxDelivered, entry.Id)
+		if err != nil {
+			log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Could not mark webhook as delivered")
+		}
+		return
+	}
+
+	retryable := true
+	retryAfter := time.Duration(0)
+	if err == nil {
+		err = errors.New("unexpected status " + resp.Status())
+		retryable = isRetryableStatus(resp.StatusCode())
+		retryAfter = parseRetryAfter(resp.Header().Get("Retry-After"))
+	}
+
+	if !retryable || entry.Attempts >= o.maxAttempts {
+		log.Error().Err(err).Int64("outboxid", entry.Id).Int("attempts", entry.Attempts).Str("url", entry.Url).Msg("Giving up on webhook delivery")
+		o.markFailed(entry, err.Error())
+		return
+	}
+
+	delay := backoffDelay(entry.Attempts)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	log.Warn().Err(err).Int64("outboxid", entry.Id).Int("attempts", entry.Attempts).Dur("retryIn", delay).Str("url", entry.Url).Msg("Webhook delivery failed, will retry")
+	o.reschedule(entry, delay, err)
+}
+
+// Records a delivery attempt in webhook_deliveries, keeping only the start of the response body
+func (o *webhookOutbox) logDelivery(entry outboxEntry, resp *resty.Response, sendErr error, latency time.Duration) {
+	statusCode := 0
+	body := ""
+	errText := ""
+	if resp != nil {
+		statusCode = resp.StatusCode()
+		body = string(resp.Body())
+		if len(body) > deliveryBodyLimit {
+			body = strings.ToValidUTF8(body[:deliveryBodyLimit], "")
+		}
+	}
+	if sendErr != nil {
+		errText = sendErr.Error()
+	}
+	_, err := o.db.Exec(`INSERT INTO webhook_deliveries (outbox_id, user_id, webhook_id, url, event_type, message_id, message_ids, attempt, status_code, latency_ms, response_body, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		entry.Id, entry.UserId, entry.WebhookId, entry.Url, entry.EventType, entry.MessageId, pq.Array(deliveryMessageIDs(entry.MessageId)),
+		entry.Attempts, statusCode, latency.Milliseconds(), body, errText)
+	if err != nil {
+		log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Could not log webhook delivery")
+	}
+}
+
+// The ids of the messages an event is about, receipts carry several joined
+// with commas
+func deliveryMessageIDs(messageID string) []string {
+	if messageID == "" {
+		return []string{}
+	}
+	return strings.Split(messageID, ",")
+}
+
+func (o *webhookOutbox) reschedule(entry outboxEntry, delay time.Duration, reason error) {
+	_, err := o.db.Exec("UPDATE webhook_outbox SET next_attempt_at=NOW()+$1::interval, last_error=$2, updated_at=NOW() WHERE id=$3",
+		fmt.Sprintf("%d milliseconds", delay.Milliseconds()), reason.Error(), entry.Id)
+	if err != nil {
+		log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Could not reschedule webhook delivery")
+	}
+}
+
+func (o *webhookOutbox) markFailed(entry outboxEntry, reason string) {
+	_, err := o.db.Exec("UPDATE webhook_outbox SET status=$1, last_error=$2, updated_at=NOW() WHERE id=$3", outboxFailed, reason, entry.Id)
+	if err != nil {
+		log.Error().Err(err).Int64("outboxid", entry.Id).Msg("Could not mark webhook as failed")
+	}
+}
+
+// Gives up the pending entries of a webhook endpoint being deleted or disabled
+func failEndpointEntries(q sqlx.Execer, webhookID int, reason string) error {
+	_, err := q.Exec("UPDATE webhook_outbox SET status=$1, last_error=$2, updated_at=NOW() WHERE webhook_id=$3 AND status=$4",
+		outboxFailed, reason, webhookID, outboxPending)
+	return err
+}
+
+// Request timeouts, rate limiting and server errors are worth retrying, any
+// other client error will not get better by sending the same payload again
+func isRetryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// backoffDelay returns an exponential delay with jitter for the given attempt
+func backoffDelay(attempt int) time.Duration {
+	return jitteredBackoff(attempt, outboxBaseDelay, outboxMaxDelay)
+}
+
+// jitteredBackoff doubles base on every attempt up to max, and picks a random
+// delay in the upper half so retries of many clients do not line up
+func jitteredBackoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	delay := max
+	if attempt < 20 {
+		delay = base << uint(attempt-1)
+		if delay > max || delay <= 0 {
+			delay = max
+		}
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header (seconds or HTTP date)
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  time.Duration
+	}{
+		{"empty", "", 0},
+		{"seconds", "120", 120 * time.Second},
+		{"zero seconds", "0", 0},
+		{"negative seconds", "-5", 0},
+		{"garbage", "soon", 0},
+		{"past date", "Wed, 21 Oct 2015 07:28:00 GMT", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseRetryAfter(tt.value)
+			if tt.want == 0 && got > 0 {
+				t.Errorf("parseRetryAfter(%q) = %v, want no delay", tt.value, got)
+			} else if tt.want != 0 && got != tt.want {
+				t.Errorf("parseRetryAfter(%q) = %v, want %v", tt.value, got, tt.want)
+			}
+		})
+	}
+
+	future := time.Now().Add(90 * time.Second).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(future); got < 80*time.Second || got > 90*time.Second {
+		t.Errorf("parseRetryAfter(%q) = %v, want about 90s", future, got)
+	}
+}
+
+func TestJitteredBackoff(t *testing.T) {
+	base := 5 * time.Second
+	max := time.Hour
+	tests := []struct {
+		attempt int
+		ceiling time.Duration
+	}{
+		{1, 5 * time.Second},
+		{2, 10 * time.Second},
+		{3, 20 * time.Second},
+		{10, 2560 * time.Second},
+		{11, time.Hour},
+		{20, time.Hour},
+		{1000, time.Hour},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 50; i++ {
+			got := jitteredBackoff(tt.attempt, base, max)
+			if got < tt.ceiling/2 || got > tt.ceiling {
+				t.Fatalf("jitteredBackoff(%d) = %v, want between %v and %v", tt.attempt, got, tt.ceiling/2, tt.ceiling)
+			}
+		}
+	}
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	tests := []struct {
+		status int
+		want   bool
+	}{
+		{http.StatusBadRequest, false},
+		{http.StatusUnauthorized, false},
+		{http.StatusNotFound, false},
+		{http.StatusRequestTimeout, true},
+		{http.StatusTooManyRequests, true},
+		{http.StatusInternalServerError, true},
+		{http.StatusServiceUnavailable, true},
+	}
+	for _, tt := range tests {
+		if got := isRetryableStatus(tt.status); got != tt.want {
+			t.Errorf("isRetryableStatus(%d) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestDeliveryMessageIDs(t *testing.T) {
+	tests := []struct {
+		messageID string
+		want      []string
+	}{
+		{"", []string{}},
+		{"3EB0A1", []string{"3EB0A1"}},
+		{"3EB0A1,3EB0B2,3EB0C3", []string{"3EB0A1", "3EB0B2", "3EB0C3"}},
+	}
+	for _, tt := range tests {
+		if got := deliveryMessageIDs(tt.messageID); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("deliveryMessageIDs(%q) = %q, want %q", tt.messageID, got, tt.want)
+		}
+	}
+}
+
+// Runs against the scratch database in WUZAPI_TEST_DSN, which it migrates
+func TestOutboxClaimSkipsForeignFiles(t *testing.T) {
+	dsn := os.Getenv("WUZAPI_TEST_DSN")
+	if dsn == "" {
+		t.Skip("WUZAPI_TEST_DSN not set")
+	}
+	db, err := sqlx.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	runMigrations(db)
+
+	var userID int
+	err = db.Get(&userID, "INSERT INTO users (name, token) VALUES ('outbox test', 'outbox-test') RETURNING id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM users WHERE id=$1", userID)
+
+	local := newWebhookOutbox(db, "replica-1", 1, 1, 0)
+	foreign := newWebhookOutbox(db, "replica-2", 1, 1, 0)
+	for _, file := range []string{"", "files/user_1/image.jpg"} {
+		err = local.Enqueue(outboxEntry{UserId: userID, Url: "http://localhost", File: file}, map[string]string{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claimed, err := foreign.claim(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].File != "" {
+		t.Fatalf("foreign replica claimed %+v, want only the entry without a file", claimed)
+	}
+	claimed, err = local.claim(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(claimed) != 1 || claimed[0].File == "" {
+		t.Fatalf("owner replica claimed %+v, want the entry with a file", claimed)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"sync"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow"
+)
+
+// Each user can route its session through its own proxy. The proxy is used for
+// the whatsmeow websocket and media transfers, and optionally for webhook calls.
+
+// Checks that a proxy URL is an http, https or socks5 URL with a host,
+// an empty URL means no proxy
+func validateProxyURL(proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return errors.New("Invalid proxy URL")
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "socks5" {
+		return errors.New("Invalid proxy scheme, must be http, https or socks5")
+	}
+	if parsed.Host == "" {
+		return errors.New("Missing host in proxy URL")
+	}
+	return nil
+}
+
+// Hides the password of a proxy URL
+func redactProxyURL(proxyURL string) string {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil {
+		return ""
+	}
+	return parsed.Redacted()
+}
+
+// Webhook clients of the sessions not running here, by proxy URL
+var proxyHttpClients sync.Map
+
+// Returns a webhook client going through proxyURL
+func proxyHttpClient(proxyURL string) *resty.Client {
+	if client, ok := proxyHttpClients.Load(proxyURL); ok {
+		return client.(*resty.Client)
+	}
+	client := newHttpClient()
+	client.SetProxy(proxyURL)
+	actual, _ := proxyHttpClients.LoadOrStore(proxyURL, client)
+	return actual.(*resty.Client)
+}
+
+func getUserProxy(db *sqlx.DB, userID int) (string, bool, error) {
+	var settings struct {
+		Url      string `db:"proxy_url"`
+		Webhooks bool   `db:"proxy_webhooks"`
+	}
+	err := db.Get(&settings, "SELECT proxy_url, proxy_webhooks FROM users WHERE id=$1", userID)
+	return settings.Url, settings.Webhooks, err
+}
+
+// Applies the proxy of a user to its whatsmeow client and webhook http client.
+// The websocket only picks it up on the next connection.
+func applyProxy(client *whatsmeow.Client, httpClient *resty.Client, proxyURL string, webhooks bool) error {
+	if client != nil {
+		err := client.SetProxyAddress(proxyURL)
+		if err != nil {
+			return err
+		}
+	}
+	if httpClient != nil {
+		if proxyURL != "" && webhooks {
+			httpClient.SetProxy(proxyURL)
+		} else {
+			httpClient.RemoveProxy()
+		}
+	}
+	return nil
+}
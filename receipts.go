@@ -0,0 +1,85 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.mau.fi/whatsmeow/types"
+	"go.mau.fi/whatsmeow/types/events"
+)
+
+// The delivery status of sent messages is kept as a timeline in the
+// message_receipts table: one row per message, recipient and status. The server
+// ack has no recipient, delivered/read/played come from the receipts sent by
+// each recipient device, so group messages get one row per participant.
+
+const (
+	receiptStatusSent      = "sent"
+	receiptStatusDelivered = "delivered"
+	receiptStatusRead      = "read"
+	receiptStatusPlayed    = "played"
+)
+
+// Order of the statuses, a message that was read has also been delivered
+var receiptStatusRank = map[string]int{
+	receiptStatusSent:      1,
+	receiptStatusDelivered: 2,
+	receiptStatusRead:      3,
+	receiptStatusPlayed:    4,
+}
+
+type messageReceipt struct {
+	MessageId    string    `db:"message_id"`
+	ChatJid      string    `db:"chat_jid"`
+	RecipientJid string    `db:"recipient_jid"`
+	Status       string    `db:"status"`
+	Timestamp    time.Time `db:"timestamp"`
+}
+
+// Records the server ack of a message sent through the API
+func saveServerAck(db sqlx.Execer, userID int, chat types.JID, messageID string, timestamp time.Time) error {
+	_, err := db.Exec(`INSERT INTO message_receipts (user_id, message_id, chat_jid, recipient_jid, status, timestamp)
+		VALUES ($1, $2, $3, '', $4, $5) ON CONFLICT DO NOTHING`,
+		userID, messageID, chat.ToNonAD().String(), receiptStatusSent, timestamp)
+	return err
+}
+
+// Records a receipt sent by a recipient of our messages. Receipts about our own
+// reads on other devices, retries and sender receipts are not part of the timeline.
+func saveReceipt(db *sqlx.DB, userID int, evt *events.Receipt) error {
+	if evt.IsFromMe {
+		return nil
+	}
+	var status string
+	switch evt.Type {
+	case types.ReceiptTypeDelivered:
+		status = receiptStatusDelivered
+	case types.ReceiptTypeRead:
+		status = receiptStatusRead
+	case types.ReceiptTypePlayed:
+		status = receiptStatusPlayed
+	default:
+		return nil
+	}
+	for _, id := range evt.MessageIDs {
+		_, err := db.Exec(`INSERT INTO message_receipts (user_id, message_id, chat_jid, recipient_jid, status, timestamp)
+			VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT DO NOTHING`,
+			userID, id, evt.Chat.ToNonAD().String(), evt.Sender.ToNonAD().String(), status, evt.Timestamp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getMessageReceipts(db *sqlx.DB, userID int, messageID string, chat string) ([]messageReceipt, error) {
+	receipts := []messageReceipt{}
+	query := "SELECT message_id, chat_jid, recipient_jid, status, timestamp FROM message_receipts WHERE user_id=$1 AND message_id=$2"
+	args := []interface{}{userID, messageID}
+	if chat != "" {
+		query += " AND chat_jid=$3"
+		args = append(args, chat)
+	}
+	err := db.Select(&receipts, query+" ORDER BY timestamp, id", args...)
+	return receipts, err
+}
@@ -28,15 +28,43 @@ func (s *server) routes() {
 		log = zerolog.New(output).With().Timestamp().Str("role", filepath.Base(os.Args[0])).Str("host", *address).Logger()
 	}
 
+    // Só requisições assinadas por outra réplica mantêm os headers de encaminhamento
+    s.router.Use(s.peerMiddleware)
+
     // Usar o novo middleware unificado
     adminRoutes := s.router.PathPrefix("/admin").Subrouter()
     adminRoutes.Use(s.authMiddleware)
-    adminRoutes.Handle("/users", s.ListUsers()).Methods("GET")
-    adminRoutes.Handle("/users", s.AddUser()).Methods("POST")
-    adminRoutes.Handle("/users/{id}", s.DeleteUser()).Methods("DELETE")
+    // As ações admin são registradas no log de auditoria
+    adminChain := alice.New(hlog.NewHandler(log), hlog.RequestIDHandler("req_id", "Request-Id"))
+    admin := adminChain.Append(s.auditMiddleware)
+    adminRoutes.Handle("/users", admin.Then(s.ListUsers())).Methods("GET")
+    adminRoutes.Handle("/users", admin.Then(s.AddUser())).Methods("POST")
+    adminRoutes.Handle("/users/{id}", admin.Then(s.ShowUser())).Methods("GET")
+    adminRoutes.Handle("/users/{id}", admin.Then(s.UpdateUser())).Methods("PATCH")
+    adminRoutes.Handle("/users/{id}/proxy", admin.Then(s.SetUserProxy())).Methods("PUT")
+    adminRoutes.Handle("/users/{id}/device", admin.Then(s.SetUserDevice())).Methods("PUT")
+    adminRoutes.Handle("/users/{id}/rotate-token", admin.Then(s.RotateUserToken())).Methods("POST")
+    adminRoutes.Handle("/users/{id}/keys", admin.Then(s.ListUserKeys())).Methods("GET")
+    adminRoutes.Handle("/users/{id}/keys", admin.Then(s.AddUserKey())).Methods("POST")
+    adminRoutes.Handle("/users/{id}/keys/{keyid}", admin.Then(s.DeleteUserKey())).Methods("DELETE")
+    adminRoutes.Handle("/users/{id}/suspend", admin.Then(s.SuspendUser())).Methods("POST")
+    adminRoutes.Handle("/users/{id}/reactivate", admin.Then(s.ReactivateUser())).Methods("POST")
+    adminRoutes.Handle("/startup", admin.Then(s.GetStartup())).Methods("GET")
+    adminRoutes.Handle("/audit", admin.Then(s.GetAudit())).Methods("GET")
+
+    // Ações de sessão em nome de qualquer usuário, e a remoção do usuário, executadas e
+    // registradas na réplica dona da sessão
+    asUser := adminChain.Append(s.asUserMiddleware, s.forwardMiddleware, s.auditMiddleware)
+    adminRoutes.Handle("/users/{id}", asUser.Then(s.DeleteUser())).Methods("DELETE")
+    adminRoutes.Handle("/users/{id}/session/connect", asUser.Append(s.activeAccountMiddleware).Then(s.Connect())).Methods("POST")
+    adminRoutes.Handle("/users/{id}/session/disconnect", asUser.Then(s.Disconnect())).Methods("POST")
+    adminRoutes.Handle("/users/{id}/session/logout", asUser.Then(s.Logout())).Methods("POST")
+    adminRoutes.Handle("/users/{id}/session/status", asUser.Then(s.GetStatus())).Methods("GET")
+    adminRoutes.Handle("/users/{id}/session/qr", asUser.Then(s.GetQR())).Methods("GET")
 
 	// Cadeia de middlewares para rotas autenticadas
 	c := alice.New()
+	c = c.Append(s.drainMiddleware)
 	c = c.Append(s.authMiddleware)
 	c = c.Append(hlog.NewHandler(log))
 
@@ -54,6 +82,10 @@ func (s *server) routes() {
 	c = c.Append(hlog.UserAgentHandler("user_agent"))
 	c = c.Append(hlog.RefererHandler("referer"))
 	c = c.Append(hlog.RequestIDHandler("req_id", "Request-Id"))
+	// Encaminha para a réplica dona da sessão do usuário
+	c = c.Append(s.forwardMiddleware)
+	// Registra as ações auditadas na réplica que as executa
+	c = c.Append(s.auditMiddleware)
 
 	// Cadeia de middlewares para rotas públicas (sem autenticação)
 	publicChain := alice.New()
@@ -66,12 +98,31 @@ func (s *server) routes() {
 	s.router.Handle("/session/logout", c.Then(s.Logout())).Methods("POST")
 	s.router.Handle("/session/status", c.Then(s.GetStatus())).Methods("GET")
 	s.router.Handle("/session/qr", c.Then(s.GetQR())).Methods("GET")
+	s.router.Handle("/session/qr/stream", c.Then(s.StreamQR())).Methods("GET")
 	s.router.Handle("/session/pairphone", c.Then(s.PairPhone())).Methods("POST")
+	s.router.Handle("/session/proxy", c.Then(s.GetProxy())).Methods("GET")
+	s.router.Handle("/session/proxy", c.Then(s.SetProxy())).Methods("POST")
+	s.router.Handle("/session/device", c.Then(s.GetDevice())).Methods("GET")
+	s.router.Handle("/session/device", c.Then(s.SetDevice())).Methods("POST")
 
     s.router.Handle("/webhook", c.Then(s.SetWebhook())).Methods("POST")
     s.router.Handle("/webhook", c.Then(s.GetWebhook())).Methods("GET")
     s.router.Handle("/webhook", c.Then(s.DeleteWebhook())).Methods("DELETE")
     s.router.Handle("/webhook/update", c.Then(s.UpdateWebhook())).Methods("PUT")
+    s.router.Handle("/webhook/endpoints", c.Then(s.ListWebhookEndpoints())).Methods("GET")
+    s.router.Handle("/webhook/endpoints", c.Then(s.AddWebhookEndpoint())).Methods("POST")
+    s.router.Handle("/webhook/endpoints/{id:[0-9]+}", c.Then(s.GetWebhookEndpoint())).Methods("GET")
+    s.router.Handle("/webhook/endpoints/{id:[0-9]+}", c.Then(s.UpdateWebhookEndpoint())).Methods("PUT", "PATCH")
+    s.router.Handle("/webhook/endpoints/{id:[0-9]+}", c.Then(s.DeleteWebhookEndpoint())).Methods("DELETE")
+    s.router.Handle("/webhook/deliveries", c.Then(s.ListWebhookDeliveries())).Methods("GET")
+    s.router.Handle("/webhook/deliveries/{id:[0-9]+}/replay", c.Then(s.ReplayWebhookDelivery())).Methods("POST")
+
+	s.router.Handle("/events/stream", c.Then(s.StreamEvents())).Methods("GET")
+
+	// Chaves de API com escopos, só o token principal pode gerenciá-las
+	s.router.Handle("/keys", c.Then(s.ListKeys())).Methods("GET")
+	s.router.Handle("/keys", c.Then(s.AddKey())).Methods("POST")
+	s.router.Handle("/keys/{id:[0-9]+}", c.Then(s.DeleteKey())).Methods("DELETE")
 
 	s.router.Handle("/chat/send/text", c.Then(s.SendMessage())).Methods("POST")
 	s.router.Handle("/chat/send/edit", c.Then(s.SendEditMessage())).Methods("POST")
@@ -98,6 +149,10 @@ func (s *server) routes() {
 	s.router.Handle("/chat/downloadvideo", c.Then(s.DownloadVideo())).Methods("POST")
 	s.router.Handle("/chat/downloadaudio", c.Then(s.DownloadAudio())).Methods("POST")
 	s.router.Handle("/chat/downloaddocument", c.Then(s.DownloadDocument())).Methods("POST")
+	s.router.Handle("/chat/list", c.Then(s.ListChats())).Methods("GET")
+	s.router.Handle("/chat/messages", c.Then(s.GetMessages())).Methods("GET")
+	s.router.Handle("/chat/message/{id}/status", c.Then(s.GetMessageStatus())).Methods("GET")
+	s.router.Handle("/chat/history/status", c.Then(s.GetHistorySyncStatus())).Methods("GET")
 
 	s.router.Handle("/group/list", c.Then(s.ListGroups())).Methods("GET")
 	s.router.Handle("/group/info", c.Then(s.GetGroupInfo())).Methods("GET")
@@ -111,6 +166,10 @@ func (s *server) routes() {
 	s.router.Handle("/group/join", c.Then(s.GroupJoin())).Methods("POST")
 	s.router.Handle("/group/leave", c.Then(s.GroupLeave())).Methods("POST")
 
+	// Websocket, autenticado pelo próprio handler (header, query ou primeiro frame). Os comandos
+	// levam o request id do websocket no log de auditoria
+	s.router.Handle("/ws", publicChain.Append(hlog.RequestIDHandler("req_id", "Request-Id")).Then(s.WebSocket())).Methods("GET")
+
 	// Rota pública para o healthcheck do Docker
 	s.router.Handle("/health", publicChain.Then(s.GetHealth())).Methods("GET")
 
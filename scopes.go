@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// Besides its main token, a user can have API keys limited to some scopes.
+// Each authenticated route requires one scope; routes without one, such as
+// the key management itself, are only open to the main token.
+
+const (
+	scopeMessagesSend  = "messages:send"
+	scopeMessagesRead  = "messages:read"
+	scopeContactsRead  = "contacts:read"
+	scopeGroupsRead    = "groups:read"
+	scopeGroupsAdmin   = "groups:admin"
+	scopeSessionRead   = "session:read"
+	scopeSessionManage = "session:manage"
+	scopeWebhookManage = "webhook:manage"
+)
+
+var validScopes = []string{
+	scopeMessagesSend,
+	scopeMessagesRead,
+	scopeContactsRead,
+	scopeGroupsRead,
+	scopeGroupsAdmin,
+	scopeSessionRead,
+	scopeSessionManage,
+	scopeWebhookManage,
+}
+
+// Scope required by each route, by method and path template as in routes()
+var routeScopes = map[string]string{
+	"POST /session/connect":    scopeSessionManage,
+	"POST /session/disconnect": scopeSessionManage,
+	"POST /session/logout":     scopeSessionManage,
+	"GET /session/status":      scopeSessionRead,
+	"GET /session/qr":          scopeSessionRead,
+	"GET /session/qr/stream":   scopeSessionRead,
+	"POST /session/pairphone":  scopeSessionManage,
+	"GET /session/proxy":       scopeSessionRead,
+	"POST /session/proxy":      scopeSessionManage,
+	"GET /session/device":      scopeSessionRead,
+	"POST /session/device":     scopeSessionManage,
+
+	"POST /webhook":                               scopeWebhookManage,
+	"GET /webhook":                                scopeWebhookManage,
+	"DELETE /webhook":                             scopeWebhookManage,
+	"PUT /webhook/update":                         scopeWebhookManage,
+	"GET /webhook/endpoints":                      scopeWebhookManage,
+	"POST /webhook/endpoints":                     scopeWebhookManage,
+	"GET /webhook/endpoints/{id:[0-9]+}":          scopeWebhookManage,
+	"PUT /webhook/endpoints/{id:[0-9]+}":          scopeWebhookManage,
+	"PATCH /webhook/endpoints/{id:[0-9]+}":        scopeWebhookManage,
+	"DELETE /webhook/endpoints/{id:[0-9]+}":       scopeWebhookManage,
+	"GET /webhook/deliveries":                     scopeWebhookManage,
+	"POST /webhook/deliveries/{id:[0-9]+}/replay": scopeWebhookManage,
+
+	"GET /events/stream": scopeMessagesRead,
+
+	"POST /chat/send/text":     scopeMessagesSend,
+	"POST /chat/send/edit":     scopeMessagesSend,
+	"POST /chat/send/delete":   scopeMessagesSend,
+	"POST /chat/send/image":    scopeMessagesSend,
+	"POST /chat/send/audio":    scopeMessagesSend,
+	"POST /chat/send/document": scopeMessagesSend,
+	"POST /chat/send/video":    scopeMessagesSend,
+	"POST /chat/send/sticker":  scopeMessagesSend,
+	"POST /chat/send/location": scopeMessagesSend,
+	"POST /chat/send/contact":  scopeMessagesSend,
+	"POST /chat/react":         scopeMessagesSend,
+	"POST /chat/send/buttons":  scopeMessagesSend,
+	"POST /chat/send/list":     scopeMessagesSend,
+	"POST /chat/presence":      scopeMessagesSend,
+	"POST /chat/markread":      scopeMessagesSend,
+
+	"POST /user/info":    scopeContactsRead,
+	"POST /user/check":   scopeContactsRead,
+	"POST /user/avatar":  scopeContactsRead,
+	"GET /user/contacts": scopeContactsRead,
+
+	"POST /chat/downloadimage":      scopeMessagesRead,
+	"POST /chat/downloadvideo":      scopeMessagesRead,
+	"POST /chat/downloadaudio":      scopeMessagesRead,
+	"POST /chat/downloaddocument":   scopeMessagesRead,
+	"GET /chat/list":                scopeMessagesRead,
+	"GET /chat/messages":            scopeMessagesRead,
+	"GET /chat/message/{id}/status": scopeMessagesRead,
+	"GET /chat/history/status":      scopeMessagesRead,
+
+	"GET /group/list":                scopeGroupsRead,
+	"GET /group/info":                scopeGroupsRead,
+	"GET /group/invitelink":          scopeGroupsRead,
+	"POST /group/inviteinfo":         scopeGroupsRead,
+	"POST /group/photo":              scopeGroupsAdmin,
+	"POST /group/name":               scopeGroupsAdmin,
+	"POST /group/topic":              scopeGroupsAdmin,
+	"POST /group/updateparticipants": scopeGroupsAdmin,
+	"POST /group/announce":           scopeGroupsAdmin,
+	"POST /group/join":               scopeGroupsAdmin,
+	"POST /group/leave":              scopeGroupsAdmin,
+}
+
+// Scope required by each websocket command, receiving the events over the
+// websocket requires messages:read
+var wsActionScopes = map[string]string{
+	"send.text":     scopeMessagesSend,
+	"chat.markread": scopeMessagesSend,
+	"chat.presence": scopeMessagesSend,
+}
+
+// Returns the scope the matched route requires, empty if only the main token
+// can use it
+func requiredScope(r *http.Request) string {
+	return routeScopes[routeKey(r)]
+}
+
+// The method and path template of the matched route
+func routeKey(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		// Websocket commands run as the REST route they stand for
+		key, _ := r.Context().Value("routekey").(string)
+		return key
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return ""
+	}
+	return r.Method + " " + template
+}
+
+// Whether a token can use a route or command requiring scope. The main token
+// can use everything, an API key only what its scopes allow.
+func (t tokenEntry) allows(scope string) bool {
+	if t.Scopes == nil {
+		return true
+	}
+	return scope != "" && Find(t.Scopes, scope)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestTokenEntryAllows(t *testing.T) {
+	mainToken := tokenEntry{}
+	sendOnly := tokenEntry{Scopes: []string{scopeMessagesSend}}
+	noScopes := tokenEntry{Scopes: []string{}}
+	tests := []struct {
+		name  string
+		token tokenEntry
+		scope string
+		want  bool
+	}{
+		{"main token, scoped route", mainToken, scopeGroupsAdmin, true},
+		{"main token, main token only route", mainToken, "", true},
+		{"key with the scope", sendOnly, scopeMessagesSend, true},
+		{"key without the scope", sendOnly, scopeMessagesRead, false},
+		{"key, main token only route", sendOnly, "", false},
+		{"key without scopes", noScopes, scopeMessagesSend, false},
+	}
+	for _, tt := range tests {
+		if got := tt.token.allows(tt.scope); got != tt.want {
+			t.Errorf("%s: allows(%q) = %v, want %v", tt.name, tt.scope, got, tt.want)
+		}
+	}
+}
+
+func TestRequiredScope(t *testing.T) {
+	router := mux.NewRouter()
+	var got string
+	record := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = requiredScope(r)
+	})
+	router.Handle("/chat/send/text", record).Methods("POST")
+	router.Handle("/webhook/endpoints/{id:[0-9]+}", record).Methods("DELETE")
+	router.Handle("/keys", record).Methods("POST")
+
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"POST", "/chat/send/text", scopeMessagesSend},
+		{"DELETE", "/webhook/endpoints/12", scopeWebhookManage},
+		{"POST", "/keys", ""},
+	}
+	for _, tt := range tests {
+		got = "unset"
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(tt.method, tt.path, nil))
+		if got != tt.want {
+			t.Errorf("requiredScope(%s %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+
+	if scope := requiredScope(httptest.NewRequest("GET", "/", nil)); scope != "" {
+		t.Errorf("requiredScope without a matched route = %q, want none", scope)
+	}
+}
+
+// Every scoped route must exist, a renamed route would silently become main
+// token only
+func TestRouteScopesMatchRoutes(t *testing.T) {
+	s := &server{router: mux.NewRouter()}
+	s.routes()
+	registered := make(map[string]bool)
+	s.router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			registered[method+" "+template] = true
+		}
+		return nil
+	})
+	for key, scope := range routeScopes {
+		if !registered[key] {
+			t.Errorf("route %s with scope %s is not registered", key, scope)
+		}
+		if !Find(validScopes, scope) {
+			t.Errorf("route %s has unknown scope %s", key, scope)
+		}
+	}
+	for action := range wsActionScopes {
+		if _, ok := s.wsActions()[action]; !ok {
+			t.Errorf("websocket action %s with a scope does not exist", action)
+		}
+	}
+	// Websocket commands are audited and drained as their REST route
+	for action, a := range s.wsActions() {
+		if !registered[a.route] {
+			t.Errorf("websocket action %s runs as %s, which is not registered", action, a.route)
+		}
+		if wsActionScopes[action] != routeScopes[a.route] {
+			t.Errorf("websocket action %s has scope %q, its route %q", action, wsActionScopes[action], routeScopes[a.route])
+		}
+	}
+}
+
+func TestAPIKeyRequestValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		request apiKeyRequest
+		want    []string
+		wantErr bool
+	}{
+		{"one scope", apiKeyRequest{Scopes: []string{scopeMessagesSend}}, []string{scopeMessagesSend}, false},
+		{"duplicates and spaces", apiKeyRequest{Scopes: []string{scopeMessagesSend, " messages:send", scopeGroupsRead}}, []string{scopeMessagesSend, scopeGroupsRead}, false},
+		{"no scopes", apiKeyRequest{}, nil, true},
+		{"unknown scope", apiKeyRequest{Scopes: []string{"admin"}}, nil, true},
+		{"past expiration", apiKeyRequest{Scopes: []string{scopeMessagesSend}, Expiration: 1}, nil, true},
+		{"negative expiration", apiKeyRequest{Scopes: []string{scopeMessagesSend}, Expiration: -1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := tt.request
+			err := request.validate()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validate() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(request.Scopes) != len(tt.want) {
+				t.Fatalf("scopes = %v, want %v", request.Scopes, tt.want)
+			}
+			for i := range tt.want {
+				if request.Scopes[i] != tt.want[i] {
+					t.Fatalf("scopes = %v, want %v", request.Scopes, tt.want)
+				}
+			}
+		})
+	}
+}
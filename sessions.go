@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"go.mau.fi/whatsmeow"
+)
+
+// States of a session. A session waiting for the QR code to be scanned is
+// pairing, it is connecting until whatsmeow reports the connection and goes
+// back to connecting while whatsmeow reconnects after a connection loss.
+const (
+	sessionStatePairing      = "pairing"
+	sessionStateConnecting   = "connecting"
+	sessionStateConnected    = "connected"
+	sessionStateDisconnected = "disconnected"
+	sessionStateLoggedOut    = "logged_out"
+)
+
+// SessionManager owns the running whatsmeow sessions. Handlers, event handlers
+// and the session goroutines all go through it, so every access to the session
+// table is serialized.
+type SessionManager struct {
+	mu       sync.RWMutex
+	sessions map[int]*clientSession
+	running  sync.WaitGroup
+}
+
+type clientSession struct {
+	client     *whatsmeow.Client
+	http       *resty.Client
+	cancel     context.CancelFunc
+	state      string
+	stateSince time.Time
+	handoff    bool
+}
+
+func NewSessionManager() *SessionManager {
+	return &SessionManager{sessions: make(map[int]*clientSession)}
+}
+
+// Start registers a session for the user and runs it in its own goroutine.
+// run must return once ctx is cancelled, the session is removed when it
+// returns. It returns false if the user already has a session.
+func (m *SessionManager) Start(userID int, run func(ctx context.Context)) bool {
+	m.mu.Lock()
+	if _, ok := m.sessions[userID]; ok {
+		m.mu.Unlock()
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &clientSession{cancel: cancel, state: sessionStateConnecting, stateSince: time.Now()}
+	m.sessions[userID] = session
+	m.running.Add(1)
+	m.mu.Unlock()
+
+	go func() {
+		defer m.running.Done()
+		defer m.remove(userID, session)
+		defer cancel()
+		run(ctx)
+	}()
+	return true
+}
+
+// Stop cancels the session of the user. It does not wait for the session to
+// finish and returns false if the user has no session.
+func (m *SessionManager) Stop(userID int) bool {
+	m.mu.RLock()
+	session, ok := m.sessions[userID]
+	m.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	session.cancel()
+	return true
+}
+
+// Handoff cancels the session of the user so that another replica can take it
+// over. The session leaves the stored connection state untouched when it ends.
+// It returns false if the user has no session.
+func (m *SessionManager) Handoff(userID int) bool {
+	m.mu.Lock()
+	session, ok := m.sessions[userID]
+	if ok {
+		session.handoff = true
+	}
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+	session.cancel()
+	return true
+}
+
+// HandedOff reports whether the session of the user was stopped with Handoff
+func (m *SessionManager) HandedOff(userID int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if session, ok := m.sessions[userID]; ok {
+		return session.handoff
+	}
+	return false
+}
+
+// SetState records a state transition of the session and returns the previous
+// state. It returns false if the user has no session.
+func (m *SessionManager) SetState(userID int, state string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	session, ok := m.sessions[userID]
+	if !ok {
+		return "", false
+	}
+	previous := session.state
+	if previous != state {
+		session.state = state
+		session.stateSince = time.Now()
+	}
+	return previous, true
+}
+
+// State returns the state of the session of the user and since when it is in it
+func (m *SessionManager) State(userID int) (string, time.Time) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if session, ok := m.sessions[userID]; ok {
+		return session.state, session.stateSince
+	}
+	return sessionStateDisconnected, time.Time{}
+}
+
+// SetClient attaches the whatsmeow client and the webhook http client to a started session
+func (m *SessionManager) SetClient(userID int, client *whatsmeow.Client, httpClient *resty.Client) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[userID]; ok {
+		session.client = client
+		session.http = httpClient
+	}
+}
+
+// ClearClient detaches the whatsmeow client while the session is shutting down
+func (m *SessionManager) ClearClient(userID int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if session, ok := m.sessions[userID]; ok {
+		session.client = nil
+	}
+}
+
+// Get returns the whatsmeow client of the user, or nil if there is none
+func (m *SessionManager) Get(userID int) *whatsmeow.Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if session, ok := m.sessions[userID]; ok {
+		return session.client
+	}
+	return nil
+}
+
+// GetHTTP returns the webhook http client of the user, or nil if there is none
+func (m *SessionManager) GetHTTP(userID int) *resty.Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if session, ok := m.sessions[userID]; ok {
+		return session.http
+	}
+	return nil
+}
+
+// Running reports whether the user has a session, even if it has no client yet
+func (m *SessionManager) Running(userID int) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.sessions[userID]
+	return ok
+}
+
+// List returns the ids of the users with a session, in ascending order
+func (m *SessionManager) List() []int {
+	m.mu.RLock()
+	ids := make([]int, 0, len(m.sessions))
+	for id := range m.sessions {
+		ids = append(ids, id)
+	}
+	m.mu.RUnlock()
+	sort.Ints(ids)
+	return ids
+}
+
+// Wait waits for every session to finish or ctx to be done, and returns the
+// ids of the users whose session is still running
+func (m *SessionManager) Wait(ctx context.Context) []int {
+	finished := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+	case <-ctx.Done():
+	}
+	return m.List()
+}
+
+func (m *SessionManager) remove(userID int, session *clientSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions[userID] == session {
+		delete(m.sessions, userID)
+	}
+}
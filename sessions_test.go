@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+func TestSessionManagerStartStop(t *testing.T) {
+	m := NewSessionManager()
+	started := make(chan struct{})
+	if !m.Start(1, func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+	}) {
+		t.Fatal("Start returned false for a new session")
+	}
+	<-started
+	if m.Start(1, func(ctx context.Context) {}) {
+		t.Fatal("Start returned true for a running session")
+	}
+	if !m.Running(1) {
+		t.Fatal("session not running after Start")
+	}
+	if state, _ := m.State(1); state != sessionStateConnecting {
+		t.Fatalf("state = %q, want %q", state, sessionStateConnecting)
+	}
+
+	if !m.Stop(1) {
+		t.Fatal("Stop returned false for a running session")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if left := m.Wait(ctx); len(left) != 0 {
+		t.Fatalf("sessions still running after Stop: %v", left)
+	}
+	if m.Stop(1) {
+		t.Fatal("Stop returned true for a stopped session")
+	}
+	if state, _ := m.State(1); state != sessionStateDisconnected {
+		t.Fatalf("state after Stop = %q, want %q", state, sessionStateDisconnected)
+	}
+}
+
+func TestSessionManagerSetState(t *testing.T) {
+	m := NewSessionManager()
+	if _, ok := m.SetState(1, sessionStateConnected); ok {
+		t.Fatal("SetState succeeded without a session")
+	}
+	m.Start(1, func(ctx context.Context) { <-ctx.Done() })
+	defer m.Stop(1)
+
+	previous, ok := m.SetState(1, sessionStateConnected)
+	if !ok || previous != sessionStateConnecting {
+		t.Fatalf("SetState = %q, %v, want %q, true", previous, ok, sessionStateConnecting)
+	}
+	_, since := m.State(1)
+	previous, _ = m.SetState(1, sessionStateConnected)
+	if previous != sessionStateConnected {
+		t.Fatalf("previous state = %q, want %q", previous, sessionStateConnected)
+	}
+	if _, again := m.State(1); !again.Equal(since) {
+		t.Fatal("setting the same state changed its start time")
+	}
+}
+
+func TestSessionManagerHandoff(t *testing.T) {
+	m := NewSessionManager()
+	handedOff := make(chan bool, 1)
+	m.Start(1, func(ctx context.Context) {
+		<-ctx.Done()
+		handedOff <- m.HandedOff(1)
+	})
+	if !m.Handoff(1) {
+		t.Fatal("Handoff returned false for a running session")
+	}
+	if !<-handedOff {
+		t.Fatal("HandedOff is false in a session stopped with Handoff")
+	}
+	if m.Handoff(2) {
+		t.Fatal("Handoff returned true without a session")
+	}
+}
+
+// Run with -race: every access to the session table goes through the manager
+func TestSessionManagerConcurrentAccess(t *testing.T) {
+	m := NewSessionManager()
+	httpClient := resty.New()
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				userID := (worker + i) % 5
+				switch i % 6 {
+				case 0:
+					m.Start(userID, func(ctx context.Context) { <-ctx.Done() })
+				case 1:
+					m.SetState(userID, sessionStateConnected)
+					m.SetClient(userID, nil, httpClient)
+				case 2:
+					m.Get(userID)
+					m.GetHTTP(userID)
+					m.State(userID)
+				case 3:
+					m.Running(userID)
+					m.List()
+				case 4:
+					m.Stop(userID)
+				case 5:
+					m.Handoff(userID)
+					m.HandedOff(userID)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	for _, userID := range m.List() {
+		m.Stop(userID)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if left := m.Wait(ctx); len(left) != 0 {
+		t.Fatalf("sessions still running after Stop: %v", left)
+	}
+}
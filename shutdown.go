@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// On SIGTERM the server shuts down in order: new API requests are refused and
+// the running ones finish, the sessions disconnect from Whatsapp keeping their
+// stored connection state, and the webhooks already due are delivered. What
+// could not be finished before the deadlines is reported.
+
+// Set while the server shuts down, API requests and the healthcheck answer 503
+var draining atomic.Bool
+
+// Refuses new API requests while the server shuts down
+func (s *server) drainMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if draining.Load() {
+			w.Header().Set("Connection", "close")
+			s.Respond(w, r, http.StatusServiceUnavailable, errors.New("Server is shutting down"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stores whether each running session must be restored on the next start:
+// connected sessions and paired sessions still connecting are, sessions
+// waiting for a QR code scan are not
+func (s *server) persistSessionStates(userIDs []int) {
+	for _, userID := range userIDs {
+		state, _ := sessions.State(userID)
+		client := sessions.Get(userID)
+		paired := client != nil && client.Store.ID != nil
+		connected := 0
+		if state == sessionStateConnected || (state == sessionStateConnecting && paired) {
+			connected = 1
+		}
+		_, err := s.db.Exec("UPDATE users SET connected=$1 WHERE id=$2", connected, userID)
+		if err != nil {
+			log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Msg("Could not store session state")
+		}
+	}
+}
+
+// Shuts the server down in order, stopLeases stops the lease renewal so no
+// session is claimed while the others are being stopped
+func (s *server) shutdown(srv *http.Server, stopLeases context.CancelFunc, timeout time.Duration, webhookTimeout time.Duration) {
+	start := time.Now()
+	draining.Store(true)
+	stopLeases()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("Requests still running at the shutdown deadline")
+	}
+
+	running := sessions.List()
+	s.persistSessionStates(running)
+	for _, userID := range running {
+		sessions.Handoff(userID)
+	}
+	sessionsCtx, cancelSessions := context.WithTimeout(context.Background(), timeout)
+	defer cancelSessions()
+	abandoned := sessions.Wait(sessionsCtx)
+	for _, userID := range abandoned {
+		log.Warn().Str("userid", strconv.Itoa(userID)).Msg("Session still running at the shutdown deadline")
+	}
+	err = leases.retire()
+	if err != nil {
+		log.Error().Err(err).Msg("Could not remove replica")
+	}
+
+	webhookCtx, cancelWebhooks := context.WithTimeout(context.Background(), webhookTimeout)
+	defer cancelWebhooks()
+	report := webhookQueue.Drain(webhookCtx)
+
+	log.Info().
+		Int("sessions", len(running)).
+		Int("sessionsAbandoned", len(abandoned)).
+		Int64("webhooksAbandoned", report.InFlight).
+		Int("webhooksPending", report.Pending).
+		Dur("duration", time.Since(start)).
+		Msg("Shutdown complete")
+}
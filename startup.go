@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sessions to restore, on startup or when taken over from another replica, go
+// through a queue: a limited number of them connect at the same time, starts
+// are spaced out, and sessions failing to start are retried with backoff.
+// Sessions that ran out of attempts are left alone for a cooldown, then
+// restored again with new attempts.
+
+const (
+	startupPending    = "pending"
+	startupConnecting = "connecting"
+	startupRestored   = "restored"
+	startupFailed     = "failed"
+
+	// How long a start holds its slot waiting for the session to connect
+	startupConnectTimeout = 60 * time.Second
+	startupRetryBaseDelay = 5 * time.Second
+	startupRetryMaxDelay  = 5 * time.Minute
+	startupFailedCooldown = 30 * time.Minute
+)
+
+type startupEntry struct {
+	UserId      int        `json:"userId"`
+	Jid         string     `json:"jid"`
+	Status      string     `json:"status"`
+	Attempts    int        `json:"attempts"`
+	LastError   string     `json:"lastError,omitempty"`
+	NextRetryAt *time.Time `json:"nextRetryAt,omitempty"`
+	UpdatedAt   time.Time  `json:"updatedAt"`
+
+	subscriptions []string
+}
+
+type startupQueue struct {
+	concurrency int
+	stagger     time.Duration
+	maxAttempts int
+
+	mu        sync.Mutex
+	entries   map[int]*startupEntry
+	ready     []int
+	lastStart time.Time
+	notify    chan struct{}
+}
+
+func newStartupQueue(concurrency int, stagger time.Duration, maxAttempts int) *startupQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+	return &startupQueue{
+		concurrency: concurrency,
+		stagger:     stagger,
+		maxAttempts: maxAttempts,
+		entries:     make(map[int]*startupEntry),
+		notify:      make(chan struct{}, 1),
+	}
+}
+
+// Add queues the session of a user to be restored. Sessions already queued or
+// starting, and sessions that ran out of attempts less than the cooldown ago,
+// are left alone.
+func (q *startupQueue) Add(userID int, jid string, subscriptions []string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.entries[userID]; ok {
+		if entry.Status == startupPending || entry.Status == startupConnecting || entry.coolingDown(time.Now()) {
+			return false
+		}
+	}
+	q.entries[userID] = &startupEntry{
+		UserId:        userID,
+		Jid:           jid,
+		Status:        startupPending,
+		UpdatedAt:     time.Now(),
+		subscriptions: subscriptions,
+	}
+	q.push(userID)
+	return true
+}
+
+func (e *startupEntry) coolingDown(now time.Time) bool {
+	return e.Status == startupFailed && e.NextRetryAt != nil && now.Before(*e.NextRetryAt)
+}
+
+// CoolingDown returns the users whose sessions ran out of attempts and are
+// not to be restored yet
+func (q *startupQueue) CoolingDown() []int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	var users []int
+	for userID, entry := range q.entries {
+		if entry.coolingDown(now) {
+			users = append(users, userID)
+		}
+	}
+	return users
+}
+
+// Waiting returns how many sessions are queued and not running yet
+func (q *startupQueue) Waiting() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := 0
+	for _, entry := range q.entries {
+		if entry.Status == startupPending {
+			waiting++
+		}
+	}
+	return waiting
+}
+
+// List returns the sessions the queue handled, by user id
+func (q *startupQueue) List() []startupEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	list := make([]startupEntry, 0, len(q.entries))
+	for _, entry := range q.entries {
+		list = append(list, *entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].UserId < list[j].UserId })
+	return list
+}
+
+// Records the state changes of sessions the queue started, a session that
+// connects after its slot timed out, or that failed and was connected by
+// hand, is reported as restored
+func (q *startupQueue) observe(userID int, state string) {
+	if state != sessionStateConnected {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if entry, ok := q.entries[userID]; ok && (entry.Status == startupConnecting || entry.Status == startupFailed) {
+		entry.Status = startupRestored
+		entry.LastError = ""
+		entry.NextRetryAt = nil
+		entry.UpdatedAt = time.Now()
+	}
+}
+
+// Must be called with q.mu held
+func (q *startupQueue) push(userID int) {
+	q.ready = append(q.ready, userID)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for the next session to start, spacing the starts by the stagger delay
+func (q *startupQueue) next(ctx context.Context) (startupEntry, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.ready) > 0 {
+			userID := q.ready[0]
+			q.ready = q.ready[1:]
+			if len(q.ready) > 0 {
+				// Wake up another worker for the rest
+				select {
+				case q.notify <- struct{}{}:
+				default:
+				}
+			}
+			entry, ok := q.entries[userID]
+			if !ok || entry.Status != startupPending {
+				q.mu.Unlock()
+				continue
+			}
+			wait := time.Until(q.lastStart.Add(q.stagger))
+			if wait < 0 {
+				wait = 0
+			}
+			q.lastStart = time.Now().Add(wait)
+			entry.Status = startupConnecting
+			entry.Attempts++
+			entry.NextRetryAt = nil
+			entry.UpdatedAt = time.Now()
+			snapshot := *entry
+			q.mu.Unlock()
+
+			select {
+			case <-ctx.Done():
+				return snapshot, false
+			case <-time.After(wait):
+			}
+			return snapshot, true
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return startupEntry{}, false
+		case <-q.notify:
+		}
+	}
+}
+
+// Records a failed start and schedules a retry while attempts are left
+func (q *startupQueue) fail(userID int, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	entry, ok := q.entries[userID]
+	if !ok {
+		return
+	}
+	entry.LastError = err.Error()
+	entry.UpdatedAt = time.Now()
+	if entry.Attempts >= q.maxAttempts {
+		retryAt := time.Now().Add(startupFailedCooldown)
+		entry.Status = startupFailed
+		entry.NextRetryAt = &retryAt
+		log.Error().Err(err).Str("userid", strconv.Itoa(userID)).Int("attempts", entry.Attempts).Dur("retryIn", startupFailedCooldown).Msg("Giving up restoring session for now")
+		return
+	}
+	delay := jitteredBackoff(entry.Attempts, startupRetryBaseDelay, startupRetryMaxDelay)
+	retryAt := time.Now().Add(delay)
+	entry.Status = startupPending
+	entry.NextRetryAt = &retryAt
+	log.Warn().Err(err).Str("userid", strconv.Itoa(userID)).Int("attempts", entry.Attempts).Dur("retryIn", delay).Msg("Could not restore session, will retry")
+	time.AfterFunc(delay, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if current, ok := q.entries[userID]; ok && current == entry && entry.Status == startupPending {
+			q.push(userID)
+		}
+	})
+}
+
+// Drops the entry of a session that is no longer this replica's to restore
+func (q *startupQueue) forget(userID int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.entries, userID)
+}
+
+// Records the end of a session the queue started before it connected: a
+// failed start is retried, a session stopped on purpose is dropped
+func (q *startupQueue) exited(userID int, err error) {
+	q.mu.Lock()
+	entry, ok := q.entries[userID]
+	connecting := ok && entry.Status == startupConnecting
+	q.mu.Unlock()
+	if !connecting {
+		return
+	}
+	if err != nil {
+		q.fail(userID, err)
+	} else {
+		q.forget(userID)
+	}
+}
+
+// Runs the workers restoring the queued sessions until ctx is cancelled
+func (s *server) runStartup(ctx context.Context) {
+	for i := 0; i < startup.concurrency; i++ {
+		go func() {
+			for {
+				entry, ok := startup.next(ctx)
+				if !ok {
+					return
+				}
+				s.restoreSession(ctx, entry)
+			}
+		}()
+	}
+}
+
+// Starts a queued session and holds the slot until it connects, fails or the
+// connect timeout passes
+func (s *server) restoreSession(ctx context.Context, entry startupEntry) {
+	userID := entry.UserId
+	exited := make(chan struct{})
+	started, err := s.startSession(userID, entry.Jid, entry.subscriptions, func(err error) {
+		startup.exited(userID, err)
+		close(exited)
+	})
+	if errors.Is(err, errLeaseHeld) {
+		// Another replica restored it first
+		startup.forget(userID)
+		return
+	}
+	if err != nil {
+		startup.fail(userID, err)
+		return
+	}
+	if !started {
+		// Already running, e.g. connected by hand while queued
+		startup.observe(userID, sessionStateConnected)
+		return
+	}
+
+	timeout := time.NewTimer(startupConnectTimeout)
+	defer timeout.Stop()
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timeout.C:
+			log.Warn().Str("userid", strconv.Itoa(userID)).Msg("Session not connected yet, releasing startup slot")
+			return
+		case <-exited:
+			return
+		case <-ticker.C:
+			if state, _ := sessions.State(userID); state == sessionStateConnected {
+				startup.observe(userID, state)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Takes the next queued session as a worker would
+func startNext(t *testing.T, q *startupQueue) startupEntry {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	entry, ok := q.next(ctx)
+	if !ok {
+		t.Fatal("no session to start")
+	}
+	return entry
+}
+
+func startupStatus(q *startupQueue, userID int) startupEntry {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return *q.entries[userID]
+}
+
+func TestStartupQueueRetries(t *testing.T) {
+	q := newStartupQueue(1, 0, 2)
+	if !q.Add(1, "", nil) {
+		t.Fatal("Add() = false for a new session")
+	}
+	if q.Add(1, "", nil) {
+		t.Error("Add() = true for a session already queued")
+	}
+
+	entry := startNext(t, q)
+	if entry.Status != startupConnecting || entry.Attempts != 1 {
+		t.Fatalf("started %s with %d attempts, want connecting with 1", entry.Status, entry.Attempts)
+	}
+	if q.Add(1, "", nil) {
+		t.Error("Add() = true for a session connecting")
+	}
+
+	q.fail(1, errors.New("timeout"))
+	entry = startupStatus(q, 1)
+	if entry.Status != startupPending || entry.NextRetryAt == nil || entry.LastError != "timeout" {
+		t.Fatalf("after a failed attempt: %+v, want pending with a retry", entry)
+	}
+	if q.Waiting() != 1 {
+		t.Errorf("Waiting() = %d, want 1", q.Waiting())
+	}
+}
+
+func TestStartupQueueCooldown(t *testing.T) {
+	q := newStartupQueue(1, 0, 1)
+	q.Add(1, "", nil)
+	startNext(t, q)
+	q.fail(1, errors.New("timeout"))
+
+	entry := startupStatus(q, 1)
+	if entry.Status != startupFailed || entry.NextRetryAt == nil {
+		t.Fatalf("out of attempts: %+v, want failed with a retry time", entry)
+	}
+	if wait := time.Until(*entry.NextRetryAt); wait < startupFailedCooldown-time.Minute || wait > startupFailedCooldown {
+		t.Errorf("retry in %v, want the %v cooldown", wait, startupFailedCooldown)
+	}
+	if users := q.CoolingDown(); len(users) != 1 || users[0] != 1 {
+		t.Errorf("CoolingDown() = %v, want [1]", users)
+	}
+	if q.Add(1, "", nil) {
+		t.Error("Add() = true during the cooldown")
+	}
+
+	// Once the cooldown is over it is restored again with new attempts
+	q.mu.Lock()
+	past := time.Now().Add(-time.Second)
+	q.entries[1].NextRetryAt = &past
+	q.mu.Unlock()
+	if len(q.CoolingDown()) != 0 {
+		t.Error("still cooling down after the cooldown")
+	}
+	if !q.Add(1, "", nil) {
+		t.Fatal("Add() = false after the cooldown")
+	}
+	if entry := startupStatus(q, 1); entry.Status != startupPending || entry.Attempts != 0 {
+		t.Errorf("requeued: %+v, want pending with no attempts", entry)
+	}
+}
+
+// A failed session connected by hand is restored, and leaves the cooldown
+func TestStartupQueueObserve(t *testing.T) {
+	q := newStartupQueue(1, 0, 1)
+	q.Add(1, "", nil)
+	startNext(t, q)
+	q.fail(1, errors.New("timeout"))
+
+	q.observe(1, sessionStateConnecting)
+	if entry := startupStatus(q, 1); entry.Status != startupFailed {
+		t.Fatalf("status %s after connecting, want failed", entry.Status)
+	}
+	q.observe(1, sessionStateConnected)
+	entry := startupStatus(q, 1)
+	if entry.Status != startupRestored || entry.NextRetryAt != nil || entry.LastError != "" {
+		t.Fatalf("after connecting: %+v, want restored", entry)
+	}
+	if len(q.CoolingDown()) != 0 {
+		t.Error("restored session still cooling down")
+	}
+}
+
+func TestStartupQueueExited(t *testing.T) {
+	tests := []struct {
+		name    string
+		started bool
+		err     error
+		want    string // status of the entry, "" when dropped
+	}{
+		{"failed while connecting", true, errors.New("connection refused"), startupPending},
+		{"stopped while connecting", true, nil, ""},
+		{"exited while pending", false, errors.New("connection refused"), startupPending},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newStartupQueue(1, 0, 5)
+			q.Add(1, "", nil)
+			if tt.started {
+				startNext(t, q)
+			}
+			q.exited(1, tt.err)
+			q.mu.Lock()
+			entry, ok := q.entries[1]
+			q.mu.Unlock()
+			if tt.want == "" {
+				if ok {
+					t.Errorf("entry kept as %s, want it dropped", entry.Status)
+				}
+				return
+			}
+			if !ok || entry.Status != tt.want {
+				t.Errorf("entry %+v, want %s", entry, tt.want)
+			}
+		})
+	}
+}
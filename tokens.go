@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/patrickmn/go-cache"
+)
+
+// API tokens are only stored as a salted hash in user_tokens. A token looks
+// like wz_<8 characters>_<secret>; its first part is kept in clear as the
+// token prefix, to tell tokens apart and to find a token when it is used.
+// Tokens set before they were hashed keep working, their prefix is their
+// first 4 characters. A user has a main token and can have API keys, which
+// are tokens limited to a list of scopes.
+
+const (
+	tokenPrefixLen       = 11
+	legacyTokenPrefixLen = 4
+)
+
+// The user, scopes and expiry of a token, cached by the hash of the token.
+// Scopes is nil for the main token of the user.
+type tokenEntry struct {
+	UserID    int
+	TokenID   int
+	Prefix    string
+	Scopes    []string
+	ExpiresAt *time.Time
+}
+
+// An API key as listed to its user, the key itself is only known on creation
+type apiKey struct {
+	Id        int        `json:"id" db:"id"`
+	Label     string     `json:"label" db:"label"`
+	Prefix    string     `json:"prefix" db:"prefix"`
+	Scopes    []string   `json:"scopes" db:"-"`
+	CreatedAt time.Time  `json:"createdAt" db:"created_at"`
+	ExpiresAt *time.Time `json:"expiresAt" db:"expires_at"`
+
+	ScopeList string `json:"-" db:"scopes"`
+}
+
+func (t tokenEntry) expired(now time.Time) bool {
+	return t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)
+}
+
+// Generates a new API token
+func generateToken() (string, error) {
+	buf := make([]byte, 28)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "wz_" + hex.EncodeToString(buf[:4]) + "_" + base64.RawURLEncoding.EncodeToString(buf[4:]), nil
+}
+
+// The part of a token stored in clear, the migration of the legacy tokens
+// computes it the same way
+func tokenPrefix(token string) string {
+	if strings.HasPrefix(token, "wz_") && len(token) >= tokenPrefixLen {
+		return token[:tokenPrefixLen]
+	}
+	if len(token) < legacyTokenPrefixLen {
+		return token
+	}
+	return token[:legacyTokenPrefixLen]
+}
+
+func hashToken(salt string, token string) string {
+	sum := sha256.Sum256([]byte(salt + token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Key of a token in the cache, so tokens are not kept in memory in clear
+func tokenCacheKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Stores the hash of a new main token for a user, expiresAt may be nil
+func insertToken(q sqlx.Queryer, userID int, token string, expiresAt *time.Time) (int, error) {
+	return insertKey(q, userID, token, "", nil, expiresAt)
+}
+
+// Stores the hash of a new token, an API key when scopes is not nil
+func insertKey(q sqlx.Queryer, userID int, token string, label string, scopes []string, expiresAt *time.Time) (int, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return 0, err
+	}
+	salt := hex.EncodeToString(buf)
+	var id int
+	var scopeList sql.NullString
+	if scopes != nil {
+		scopeList = sql.NullString{String: strings.Join(scopes, ","), Valid: true}
+	}
+	err := sqlx.Get(q, &id, "INSERT INTO user_tokens (user_id, prefix, salt, hash, label, scopes, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
+		userID, tokenPrefix(token), salt, hashToken(salt, token), label, scopeList, expiresAt)
+	return id, err
+}
+
+// Returns the user owning a valid token, sql.ErrNoRows if there is none
+func resolveToken(db *sqlx.DB, token string) (tokenEntry, error) {
+	now := time.Now()
+	key := tokenCacheKey(token)
+	if cached, found := tokencache.Get(key); found {
+		entry := cached.(tokenEntry)
+		if !entry.expired(now) {
+			return entry, nil
+		}
+		tokencache.Delete(key)
+		return tokenEntry{}, sql.ErrNoRows
+	}
+
+	var candidates []struct {
+		Id        int            `db:"id"`
+		UserId    int            `db:"user_id"`
+		Salt      string         `db:"salt"`
+		Hash      string         `db:"hash"`
+		Scopes    sql.NullString `db:"scopes"`
+		ExpiresAt sql.NullTime   `db:"expires_at"`
+	}
+	err := db.Select(&candidates, "SELECT id, user_id, salt, hash, scopes, expires_at FROM user_tokens WHERE prefix=$1 AND (expires_at IS NULL OR expires_at>$2)",
+		tokenPrefix(token), now)
+	if err != nil {
+		return tokenEntry{}, err
+	}
+	for _, candidate := range candidates {
+		if subtle.ConstantTimeCompare([]byte(hashToken(candidate.Salt, token)), []byte(candidate.Hash)) != 1 {
+			continue
+		}
+		entry := tokenEntry{UserID: candidate.UserId, TokenID: candidate.Id, Prefix: tokenPrefix(token)}
+		if candidate.Scopes.Valid {
+			entry.Scopes = strings.Split(candidate.Scopes.String, ",")
+		}
+		if candidate.ExpiresAt.Valid {
+			entry.ExpiresAt = &candidate.ExpiresAt.Time
+		}
+		tokencache.Set(key, entry, cache.DefaultExpiration)
+		return entry, nil
+	}
+	return tokenEntry{}, sql.ErrNoRows
+}
+
+// Gives a user a new main token. The main tokens it had stop working after
+// grace, right away if grace is 0, its API keys are left alone. The caller
+// invalidates the cached user info.
+func rotateToken(db *sqlx.DB, userID int, grace time.Duration) (string, *time.Time, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", nil, err
+	}
+	tx, err := db.Beginx()
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback()
+
+	var previousExpireAt *time.Time
+	if grace > 0 {
+		expiresAt := time.Now().Add(grace)
+		previousExpireAt = &expiresAt
+		_, err = tx.Exec("UPDATE user_tokens SET expires_at=$1 WHERE user_id=$2 AND scopes IS NULL AND (expires_at IS NULL OR expires_at>$1)", expiresAt, userID)
+	} else {
+		_, err = tx.Exec("DELETE FROM user_tokens WHERE user_id=$1 AND scopes IS NULL", userID)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	_, err = insertToken(tx, userID, token, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	return token, previousExpireAt, tx.Commit()
+}
+
+// Body to create an API key, expiration is a unix timestamp, 0 for never
+type apiKeyRequest struct {
+	Label      string   `json:"label"`
+	Scopes     []string `json:"scopes"`
+	Expiration int64    `json:"expiration"`
+}
+
+func (k *apiKeyRequest) validate() error {
+	if len(k.Scopes) == 0 {
+		return errors.New("Missing scopes")
+	}
+	var scopes []string
+	for _, scope := range k.Scopes {
+		scope = strings.TrimSpace(scope)
+		if !Find(validScopes, scope) {
+			return errors.New("Invalid scope: " + scope)
+		}
+		if !Find(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	k.Scopes = scopes
+	if k.Expiration < 0 || (k.Expiration > 0 && k.Expiration <= time.Now().Unix()) {
+		return errors.New("Expiration must be in the future")
+	}
+	return nil
+}
+
+func (k apiKeyRequest) expiresAt() *time.Time {
+	if k.Expiration == 0 {
+		return nil
+	}
+	expiresAt := time.Unix(k.Expiration, 0)
+	return &expiresAt
+}
+
+// Creates an API key for a user, returning the key and its listing
+func createAPIKey(db *sqlx.DB, userID int, label string, scopes []string, expiresAt *time.Time) (string, apiKey, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", apiKey{}, err
+	}
+	id, err := insertKey(db, userID, token, label, scopes, expiresAt)
+	if err != nil {
+		return "", apiKey{}, err
+	}
+	key := apiKey{Id: id, Label: label, Prefix: tokenPrefix(token), Scopes: scopes, CreatedAt: time.Now(), ExpiresAt: expiresAt}
+	return token, key, nil
+}
+
+// Lists the API keys of a user still valid
+func listAPIKeys(db *sqlx.DB, userID int) ([]apiKey, error) {
+	keys := []apiKey{}
+	err := db.Select(&keys, `SELECT id, label, prefix, scopes, created_at, expires_at FROM user_tokens
+		WHERE user_id=$1 AND scopes IS NOT NULL AND (expires_at IS NULL OR expires_at>NOW()) ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i].Scopes = strings.Split(keys[i].ScopeList, ",")
+	}
+	return keys, nil
+}
+
+// Deletes an API key of a user, returns false if the user has no such key.
+// The caller invalidates the cached user info.
+func deleteAPIKey(db *sqlx.DB, userID int, keyID int) (bool, error) {
+	result, err := db.Exec("DELETE FROM user_tokens WHERE id=$1 AND user_id=$2 AND scopes IS NOT NULL", keyID, userID)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// Drops the cached tokens of a user on this replica
+func forgetUserTokens(userID int) {
+	for key, item := range tokencache.Items() {
+		if entry, ok := item.Object.(tokenEntry); ok && entry.UserID == userID {
+			tokencache.Delete(key)
+		}
+	}
+}
+
+// Removes the tokens past their grace period
+func purgeExpiredTokens(db *sqlx.DB) {
+	result, err := db.Exec("DELETE FROM user_tokens WHERE expires_at<NOW()")
+	if err != nil {
+		log.Error().Err(err).Msg("Could not remove expired tokens")
+		return
+	}
+	if purged, _ := result.RowsAffected(); purged > 0 {
+		log.Info().Int64("tokens", purged).Msg("Removed expired tokens")
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestTokenPrefix(t *testing.T) {
+	tests := []struct {
+		token string
+		want  string
+	}{
+		{"wz_0123abcd_c2VjcmV0c2VjcmV0c2VjcmV0", "wz_0123abcd"},
+		{"wz_0123abcd_", "wz_0123abcd"},
+		{"wz_01", "wz_0"},
+		{"1234ABCD", "1234"},
+		{"abc", "abc"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := tokenPrefix(tt.token); got != tt.want {
+			t.Errorf("tokenPrefix(%q) = %q, want %q", tt.token, got, tt.want)
+		}
+	}
+}
+
+func TestGenerateToken(t *testing.T) {
+	format := regexp.MustCompile(`^wz_[0-9a-f]{8}_[A-Za-z0-9_-]{32}$`)
+	token, err := generateToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !format.MatchString(token) {
+		t.Fatalf("generated token %q does not match %s", token, format)
+	}
+	if len(tokenPrefix(token)) != tokenPrefixLen {
+		t.Fatalf("prefix of %q is %q", token, tokenPrefix(token))
+	}
+	other, _ := generateToken()
+	if other == token {
+		t.Fatal("generated the same token twice")
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	tests := []struct {
+		salt  string
+		token string
+		want  string
+	}{
+		{"salt", "wz_0123abcd_secret", "fc5a93be3f1f1a934f1edcc661455cea528452a006841c70df2056bd47530bb4"},
+	}
+	for _, tt := range tests {
+		if got := hashToken(tt.salt, tt.token); got != tt.want {
+			t.Errorf("hashToken(%q, %q) = %s, want %s", tt.salt, tt.token, got, tt.want)
+		}
+	}
+	if hashToken("salt", "token") == hashToken("pepper", "token") {
+		t.Error("hash does not depend on the salt")
+	}
+	if tokenCacheKey("token") == "token" {
+		t.Error("cache key keeps the token in clear")
+	}
+}
+
+func TestTokenEntryExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Second)
+	future := now.Add(time.Second)
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		want      bool
+	}{
+		{"no expiry", nil, false},
+		{"expired", &past, true},
+		{"expires now", &now, true},
+		{"not expired yet", &future, false},
+	}
+	for _, tt := range tests {
+		if got := (tokenEntry{ExpiresAt: tt.expiresAt}).expired(now); got != tt.want {
+			t.Errorf("%s: expired() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// Webhook endpoint stored in the webhooks table, a user can have many of them
+// each with its own event subscriptions and body format
+type webhookEndpoint struct {
+	Id        int       `db:"id"`
+	UserId    int       `db:"user_id"`
+	Url       string    `db:"url"`
+	Events    string    `db:"events"`
+	Enabled   bool      `db:"enabled"`
+	Format    string    `db:"format"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+}
+
+// Subscribed reports whether the endpoint wants events of the given type
+func (e webhookEndpoint) Subscribed(eventType string) bool {
+	events := e.EventList()
+	return Find(events, "All") || Find(events, eventType)
+}
+
+func (e webhookEndpoint) EventList() []string {
+	events := []string{}
+	for _, event := range strings.Split(e.Events, ",") {
+		event = strings.TrimSpace(event)
+		if event != "" {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+func (e webhookEndpoint) toMap() map[string]interface{} {
+	return map[string]interface{}{
+		"id":        e.Id,
+		"url":       e.Url,
+		"events":    e.EventList(),
+		"enabled":   e.Enabled,
+		"format":    e.Format,
+		"createdAt": e.CreatedAt,
+		"updatedAt": e.UpdatedAt,
+	}
+}
+
+func getWebhookEndpoints(db *sqlx.DB, userID int) ([]webhookEndpoint, error) {
+	endpoints := []webhookEndpoint{}
+	err := db.Select(&endpoints, "SELECT id, user_id, url, events, enabled, format, created_at, updated_at FROM webhooks WHERE user_id=$1 ORDER BY id", userID)
+	return endpoints, err
+}
+
+func getWebhookEndpoint(db *sqlx.DB, userID int, id string) (webhookEndpoint, error) {
+	var endpoint webhookEndpoint
+	err := db.Get(&endpoint, "SELECT id, user_id, url, events, enabled, format, created_at, updated_at FROM webhooks WHERE user_id=$1 AND id=$2", userID, id)
+	return endpoint, err
+}
+
+// Validates a list of subscribed events and joins them for storage,
+// an empty list subscribes to all of them
+func validateWebhookEvents(events []string) (string, error) {
+	if len(events) == 0 {
+		return "All", nil
+	}
+	for _, event := range events {
+		if !Find(messageTypes, event) {
+			return "", errors.New("Invalid event: " + event)
+		}
+	}
+	return strings.Join(events, ","), nil
+}
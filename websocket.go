@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/justinas/alice"
+	"github.com/rs/zerolog/hlog"
+)
+
+// The websocket API delivers the session events in real time and accepts
+// commands as JSON frames. Commands are served by the same handlers as the
+// REST routes, the response envelope is sent back with the request id.
+
+const (
+	wsAuthTimeout  = 10 * time.Second
+	wsPingInterval = 30 * time.Second
+	wsPongTimeout  = 60 * time.Second
+	wsWriteTimeout = 10 * time.Second
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkWsOrigin,
+}
+
+// Browsers can open a websocket from the server's own origin or one listed in
+// -wsorigins, clients sending no origin are not browsers and are let through
+func checkWsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(*wsOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" || (allowed != "" && strings.EqualFold(allowed, origin)) {
+			return true
+		}
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, r.Host)
+}
+
+// Open sockets by user. They check their token again when the user changes,
+// as its token may have been revoked or its account suspended.
+type wsRegistry struct {
+	mu      sync.Mutex
+	sockets map[int]map[chan struct{}]struct{}
+}
+
+var wsSockets = &wsRegistry{sockets: make(map[int]map[chan struct{}]struct{})}
+
+func (reg *wsRegistry) register(userID int) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	reg.mu.Lock()
+	if reg.sockets[userID] == nil {
+		reg.sockets[userID] = make(map[chan struct{}]struct{})
+	}
+	reg.sockets[userID][ch] = struct{}{}
+	reg.mu.Unlock()
+	return ch, func() {
+		reg.mu.Lock()
+		delete(reg.sockets[userID], ch)
+		if len(reg.sockets[userID]) == 0 {
+			delete(reg.sockets, userID)
+		}
+		reg.mu.Unlock()
+	}
+}
+
+// Tells the sockets of a user to check their token, every user if userID is 0
+func (reg *wsRegistry) recheck(userID int) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for id, sockets := range reg.sockets {
+		if userID != 0 && id != userID {
+			continue
+		}
+		for ch := range sockets {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Frame sent by the client, data holds the same payload as the matching REST route
+type wsCommand struct {
+	Id     string          `json:"id"`
+	Action string          `json:"action"`
+	Token  string          `json:"token,omitempty"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsConn) writeJSON(v interface{}) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+func (c *wsConn) ping() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+}
+
+// A websocket command runs as the REST route it stands for, by method and
+// path template as in routes()
+type wsAction struct {
+	route   string
+	handler http.Handler
+}
+
+// Commands available over the websocket and the handlers serving them. They
+// go through the same drain check and audit recording as the REST routes.
+func (s *server) wsActions() map[string]wsAction {
+	chain := alice.New(s.drainMiddleware, s.auditMiddleware)
+	return map[string]wsAction{
+		"send.text":     {"POST /chat/send/text", chain.Then(s.SendMessage())},
+		"chat.markread": {"POST /chat/markread", chain.Then(s.MarkRead())},
+		"chat.presence": {"POST /chat/presence", chain.Then(s.ChatPresence())},
+	}
+}
+
+// Websocket endpoint. The token can be sent as header or query parameter on the
+// upgrade request, or in a first {"action":"auth","token":"..."} frame.
+func (s *server) WebSocket() http.HandlerFunc {
+	actions := s.wsActions()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get("token")
+		if token == "" {
+			token = r.URL.Query().Get("token")
+		}
+		var lastID uint64
+		if v := r.URL.Query().Get("lastEventId"); v != "" {
+			lastID, _ = strconv.ParseUint(v, 10, 64)
+		}
+
+		// The events of a session are only published on the replica running it
+		if token != "" && r.Header.Get(forwardedHeader) == "" {
+			if isAdmin, userinfo, _, err := s.validateToken(token); err == nil && !isAdmin {
+				userid, _ := strconv.Atoi(userinfo.Get("Id"))
+				if owner, found := s.remoteOwner(userid); found && *clusterSecret != "" {
+					if p, err := leases.proxy(owner.OwnerUrl); err == nil {
+						p.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+		}
+
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.Warn().Err(err).Msg("Websocket upgrade failed")
+			return
+		}
+		ws := &wsConn{conn: conn}
+		defer conn.Close()
+
+		if token == "" {
+			conn.SetReadDeadline(time.Now().Add(wsAuthTimeout))
+			var auth wsCommand
+			if err := conn.ReadJSON(&auth); err != nil || auth.Action != "auth" {
+				ws.writeJSON(wsResponse(auth.Id, http.StatusUnauthorized, errors.New("Unauthorized")))
+				return
+			}
+			token = auth.Token
+		}
+
+		userinfo, _, status, err := s.wsAuthorize(token)
+		if err != nil {
+			ws.writeJSON(wsResponse("", status, err))
+			return
+		}
+		txtid := userinfo.Get("Id")
+		userid, _ := strconv.Atoi(txtid)
+		if r.Header.Get(forwardedHeader) == "" {
+			if owner, found := s.remoteOwner(userid); found {
+				if *clusterSecret == "" {
+					ws.writeJSON(wsResponse("", http.StatusConflict, errLeaseHeld))
+					return
+				}
+				bridgeWebSocket(conn, owner, token, lastID)
+				return
+			}
+		}
+		log.Info().Str("userid", txtid).Msg("Websocket connected")
+		ws.writeJSON(map[string]interface{}{"type": "auth", "success": true})
+
+		backlog, events, cancel := eventStreams.Subscribe(userid, lastID)
+		defer cancel()
+		recheck, unregister := wsSockets.register(userid)
+		defer unregister()
+
+		// Ends with the request context, which is cancelled on server shutdown
+		ctx, stop := context.WithCancel(r.Context())
+		defer stop()
+
+		// Writes events and keepalive pings until the connection is closed
+		go func() {
+			defer conn.Close()
+			for _, evt := range backlog {
+				if ws.writeJSON(wsEvent(evt)) != nil {
+					return
+				}
+			}
+			ticker := time.NewTicker(wsPingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case evt, ok := <-events:
+					if !ok {
+						log.Warn().Str("userid", txtid).Msg("Websocket subscriber dropped")
+						return
+					}
+					if ws.writeJSON(wsEvent(evt)) != nil {
+						return
+					}
+				case <-recheck:
+					if _, _, status, err := s.wsAuthorize(token); err != nil {
+						ws.writeJSON(wsResponse("", status, err))
+						return
+					}
+				case <-ticker.C:
+					// Also catches the tokens and accounts expiring on their own
+					if _, _, status, err := s.wsAuthorize(token); err != nil {
+						ws.writeJSON(wsResponse("", status, err))
+						return
+					}
+					if ws.ping() != nil {
+						return
+					}
+				}
+			}
+		}()
+
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+		conn.SetPongHandler(func(string) error {
+			conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+			return nil
+		})
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+					log.Warn().Err(err).Str("userid", txtid).Msg("Websocket read failed")
+				}
+				log.Info().Str("userid", txtid).Msg("Websocket disconnected")
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+			var cmd wsCommand
+			if err := json.Unmarshal(message, &cmd); err != nil {
+				ws.writeJSON(wsResponse("", http.StatusBadRequest, errors.New("Could not decode frame")))
+				continue
+			}
+
+			action, ok := actions[cmd.Action]
+			if !ok {
+				ws.writeJSON(wsResponse(cmd.Id, http.StatusBadRequest, errors.New("Unknown action: "+cmd.Action)))
+				continue
+			}
+			userinfo, tokenInfo, status, err := s.wsAuthorize(token)
+			if err != nil {
+				ws.writeJSON(wsResponse(cmd.Id, status, err))
+				return
+			}
+			if scope := wsActionScopes[cmd.Action]; !tokenInfo.allows(scope) {
+				ws.writeJSON(wsResponse(cmd.Id, http.StatusForbidden, errors.New("Missing scope "+scope)))
+				continue
+			}
+			go func(cmd wsCommand) {
+				ws.writeJSON(s.runWsCommand(r, action, userinfo, tokenInfo, cmd))
+			}(cmd)
+		}
+	}
+}
+
+// Checks the token of a socket, on connection and again while it is open.
+// The socket needs messages:read to stay open.
+func (s *server) wsAuthorize(token string) (Values, tokenEntry, int, error) {
+	isAdmin, userinfo, tokenInfo, err := s.validateToken(token)
+	if errors.Is(err, errAccountSuspended) || errors.Is(err, errAccountExpired) {
+		return Values{}, tokenEntry{}, http.StatusForbidden, err
+	}
+	if err != nil || isAdmin {
+		return Values{}, tokenEntry{}, http.StatusUnauthorized, errors.New("Unauthorized")
+	}
+	if !tokenInfo.allows(scopeMessagesRead) {
+		return Values{}, tokenEntry{}, http.StatusForbidden, errors.New("Missing scope " + scopeMessagesRead)
+	}
+	return userinfo, tokenInfo, http.StatusOK, nil
+}
+
+// Runs a command through its REST handler and wraps the response envelope.
+// The request carries the route of the command and the request id of the
+// websocket, so the command is audited as the REST call would be.
+func (s *server) runWsCommand(r *http.Request, action wsAction, userinfo Values, tokenInfo tokenEntry, cmd wsCommand) map[string]interface{} {
+	data := cmd.Data
+	if len(data) == 0 {
+		data = json.RawMessage("{}")
+	}
+	ctx := context.WithValue(context.Background(), "userinfo", userinfo)
+	ctx = context.WithValue(ctx, "tokeninfo", tokenInfo)
+	ctx = context.WithValue(ctx, "routekey", action.route)
+	if id, ok := hlog.IDFromRequest(r); ok {
+		ctx = hlog.CtxWithID(ctx, id)
+	}
+	method, path, _ := strings.Cut(action.route, " ")
+	req, err := http.NewRequestWithContext(ctx, method, path, bytes.NewReader(data))
+	if err != nil {
+		return wsResponse(cmd.Id, http.StatusInternalServerError, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.RemoteAddr = r.RemoteAddr
+
+	rec := httptest.NewRecorder()
+	action.handler.ServeHTTP(rec, req)
+
+	response := make(map[string]interface{})
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		return wsResponse(cmd.Id, http.StatusInternalServerError, errors.New(strings.TrimSpace(rec.Body.String())))
+	}
+	response["type"] = "response"
+	response["id"] = cmd.Id
+	return response
+}
+
+// Relays the frames of a websocket authenticated in its first frame to the
+// replica running the session, until either side closes
+func bridgeWebSocket(conn *websocket.Conn, owner sessionLease, token string, lastID uint64) {
+	target, err := url.Parse(owner.OwnerUrl)
+	if err != nil {
+		conn.WriteJSON(wsResponse("", http.StatusInternalServerError, errors.New("Invalid replica URL")))
+		return
+	}
+	if target.Scheme == "https" {
+		target.Scheme = "wss"
+	} else {
+		target.Scheme = "ws"
+	}
+	target.Path = "/ws"
+	target.RawQuery = "lastEventId=" + strconv.FormatUint(lastID, 10)
+
+	header := http.Header{}
+	header.Set("token", token)
+	leases.signForwarded(header, http.MethodGet, target.RequestURI(), nil)
+	upstream, _, err := websocket.DefaultDialer.Dial(target.String(), header)
+	if err != nil {
+		log.Error().Err(err).Str("replica", owner.OwnerUrl).Msg("Could not forward websocket")
+		conn.WriteJSON(wsResponse("", http.StatusBadGateway, errors.New("Could not reach the replica running the session")))
+		return
+	}
+	defer upstream.Close()
+	conn.SetReadDeadline(time.Time{})
+
+	relay := func(dst *websocket.Conn, src *websocket.Conn, done chan<- struct{}) {
+		defer close(done)
+		for {
+			messageType, message, err := src.ReadMessage()
+			if err != nil {
+				return
+			}
+			if dst.WriteMessage(messageType, message) != nil {
+				return
+			}
+		}
+	}
+	fromClient := make(chan struct{})
+	fromUpstream := make(chan struct{})
+	go relay(upstream, conn, fromClient)
+	go relay(conn, upstream, fromUpstream)
+	select {
+	case <-fromClient:
+	case <-fromUpstream:
+	}
+}
+
+func wsResponse(id string, status int, err error) map[string]interface{} {
+	return map[string]interface{}{
+		"type":    "response",
+		"id":      id,
+		"code":    status,
+		"success": false,
+		"error":   err.Error(),
+	}
+}
+
+func wsEvent(evt hubEvent) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "event",
+		"id":    evt.Id,
+		"event": evt.Type,
+		"data":  json.RawMessage(evt.Data),
+	}
+}
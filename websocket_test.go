@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRunWsCommandRoute(t *testing.T) {
+	s := &server{}
+	var got string
+	action := wsAction{"POST /chat/markread", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = routeKey(r)
+		s.Respond(w, r, http.StatusOK, `{"Details":"Message(s) marked as read"}`)
+	})}
+	cmd := wsCommand{Id: "1", Action: "chat.markread"}
+	response := s.runWsCommand(httptest.NewRequest("GET", "/ws", nil), action, Values{}, tokenEntry{}, cmd)
+	if got != "POST /chat/markread" {
+		t.Errorf("routeKey() = %q, want the route of the command", got)
+	}
+	if response["id"] != "1" || response["success"] != true {
+		t.Errorf("response = %v, want a success for command 1", response)
+	}
+}
+
+func TestRunWsCommandDraining(t *testing.T) {
+	s := &server{}
+	draining.Store(true)
+	defer draining.Store(false)
+
+	action := s.wsActions()["send.text"]
+	response := s.runWsCommand(httptest.NewRequest("GET", "/ws", nil), action, Values{}, tokenEntry{}, wsCommand{Id: "1", Action: "send.text"})
+	if response["code"] != float64(http.StatusServiceUnavailable) {
+		t.Errorf("response = %v, want %d while draining", response, http.StatusServiceUnavailable)
+	}
+}
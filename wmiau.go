@@ -18,12 +18,12 @@ import (
 
 	"github.com/go-resty/resty/v2"
 	"github.com/jmoiron/sqlx" // Importação do sqlx
+	"github.com/lib/pq"
 	"github.com/mdp/qrterminal/v3"
 	"github.com/patrickmn/go-cache"
 	"github.com/skip2/go-qrcode"
 	"go.mau.fi/whatsmeow"
 	"go.mau.fi/whatsmeow/appstate"
-	waProto "go.mau.fi/whatsmeow/binary/proto"
 	"go.mau.fi/whatsmeow/store"
 	"go.mau.fi/whatsmeow/types"
 	"go.mau.fi/whatsmeow/types/events"
@@ -31,23 +31,44 @@ import (
 )
 
 //var wlog waLog.Logger
-var clientPointer = make(map[int]*whatsmeow.Client)
-var clientHttp = make(map[int]*resty.Client)
-var historySyncID int32
+var defaultHttpClient *resty.Client
 
 // Declaração do campo db como *sqlx.DB
 type MyClient struct {
 	WAClient       *whatsmeow.Client
 	eventHandlerID uint32
 	userID         int
-	token          string
 	subscriptions  []string
 	db             *sqlx.DB
+	reconnect      chan struct{}
+	bannedUntil    atomic.Int64
 }
 
-// Connects to Whatsapp Websocket on server startup if last state was connected
+// Backoff between reconnection attempts of a session
+const (
+	reconnectBaseDelay = 2 * time.Second
+	reconnectMaxDelay  = 5 * time.Minute
+)
+
+// Connects to Whatsapp Websocket on server startup if last state was connected,
+// taking this replica's share of the sessions no other replica owns
 func (s *server) connectOnStartup() {
-	rows, err := s.db.Queryx("SELECT id,token,jid,webhook,events FROM users WHERE connected=1")
+	s.claimSessions()
+}
+
+// Connects up to limit users whose last state was connected and whose session
+// lease is free, expired or already held by this replica. Sessions that ran
+// out of startup attempts are skipped until their cooldown ends.
+func (s *server) connectUnowned(limit int) {
+	coolingDown := []int64{}
+	for _, userID := range startup.CoolingDown() {
+		coolingDown = append(coolingDown, int64(userID))
+	}
+	rows, err := s.db.Queryx(`SELECT u.id,u.jid,u.webhook,u.events,u.webhook_include_token,u.webhook_format FROM users u
+		LEFT JOIN session_leases l ON l.user_id=u.id
+		WHERE u.connected=1 AND u.status='active' AND COALESCE(u.expiration,0) NOT BETWEEN 1 AND EXTRACT(EPOCH FROM NOW())
+		AND (l.user_id IS NULL OR l.expires_at<NOW() OR l.owner=$1) AND NOT (u.id = ANY($3))
+		ORDER BY random() LIMIT $2`, leases.replicaID, limit, pq.Array(coolingDown))
 	if err != nil {
 		log.Error().Err(err).Msg("DB Problem")
 		return
@@ -55,25 +76,21 @@ func (s *server) connectOnStartup() {
 	defer rows.Close()
 	for rows.Next() {
 		txtid := ""
-		token := ""
 		jid := ""
 		webhook := ""
 		events := ""
-		err = rows.Scan(&txtid, &token, &jid, &webhook, &events)
+		includeToken := false
+		format := ""
+		err = rows.Scan(&txtid, &jid, &webhook, &events, &includeToken, &format)
 		if err != nil {
 			log.Error().Err(err).Msg("DB Problem")
 			return
 		} else {
-			log.Info().Str("token", token).Msg("Connect to Whatsapp on startup")
-			v := Values{map[string]string{
-				"Id":      txtid,
-				"Jid":     jid,
-				"Webhook": webhook,
-				"Token":   token,
-				"Events":  events,
-			}}
-			userinfocache.Set(token, v, cache.NoExpiration)
 			userid, _ := strconv.Atoi(txtid)
+			if sessions.Running(userid) {
+				continue
+			}
+			log.Info().Str("userid", txtid).Msg("Connect to Whatsapp on startup")
 			// Gets and set subscription to webhook events
 			eventarray := strings.Split(events, ",")
 
@@ -95,8 +112,7 @@ func (s *server) connectOnStartup() {
 			}
 			eventstring := strings.Join(subscribedEvents, ",")
 			log.Info().Str("events", eventstring).Str("jid",jid).Msg("Attempt to connect")
-			killchannel[userid] = make(chan bool)
-			go s.startClient(userid, jid, token, subscribedEvents)
+			startup.Add(userid, jid, subscribedEvents)
 		}
 	}
 	err = rows.Err()
@@ -124,27 +140,23 @@ func parseJID(arg string) (types.JID, bool) {
 	}
 }
 
-func (s *server) startClient(userID int, textjid string, token string, subscriptions []string) {
+// Runs the session of the user until ctx is cancelled. It returns an error if
+// the session could not be set up or its first connection failed.
+func (s *server) startClient(ctx context.Context, userID int, textjid string, subscriptions []string) error {
 
 	log.Info().Str("userid", strconv.Itoa(userID)).Str("jid",textjid).Msg("Starting websocket connection to Whatsapp")
 
 	var deviceStore *store.Device
 	var err error
 
-	if clientPointer[userID] != nil {
-		isConnected := clientPointer[userID].IsConnected()
-		if isConnected == true {
-			return
-		}
-	}
-
 	if textjid != "" {
 		jid, _ := parseJID(textjid)
 		// If you want multiple sessions, remember their JIDs and use .GetDevice(jid) or .GetAllDevices() instead.
 		//deviceStore, err := container.GetFirstDevice()
 		deviceStore, err = container.GetDevice(jid)
 		if err != nil {
-			panic(err)
+			log.Error().Err(err).Str("userid",strconv.Itoa(userID)).Msg("Could not get device from store")
+			return fmt.Errorf("could not get device: %w", err)
 		}
 	} else {
 		log.Warn().Msg("No jid found. Creating new device")
@@ -156,13 +168,6 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 		deviceStore = container.NewDevice()
 	}
 
-	//store.CompanionProps.PlatformType = waProto.CompanionProps_CHROME.Enum()
-	//store.CompanionProps.Os = proto.String("Mac OS")
-
-	osName := "Mac OS 10"
-	store.DeviceProps.PlatformType = waProto.DeviceProps_UNKNOWN.Enum()
-	store.DeviceProps.Os = &osName
-
 	clientLog := waLog.Stdout("Client", *waDebug, *colorOutput)
 	var client *whatsmeow.Client
 	if(*waDebug!="") {
@@ -170,76 +175,92 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 	} else {
 		client = whatsmeow.NewClient(deviceStore, nil)
 	}
-	clientPointer[userID] = client
-	mycli := MyClient{client, 1, userID, token, subscriptions, s.db}
+	// Reconnections are supervised by the session below instead of whatsmeow
+	client.EnableAutoReconnect = false
+	device, err := getUserDevice(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid",strconv.Itoa(userID)).Msg("Could not get device identity, using defaults")
+		device = deviceIdentity{}
+		device.normalize()
+	}
+	client.GetClientPayload = clientPayloadFunc(client, device)
+	mycli := &MyClient{
+		WAClient:       client,
+		eventHandlerID: 1,
+		userID:         userID,
+		subscriptions:  subscriptions,
+		db:             s.db,
+		reconnect:      make(chan struct{}, 1),
+	}
 	mycli.eventHandlerID = mycli.WAClient.AddEventHandler(mycli.myEventHandler)
 
-	//clientHttp[userID] = resty.New().EnableTrace()
-	clientHttp[userID] = resty.New()
-	clientHttp[userID].SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
-	if *waDebug == "DEBUG" {
-		clientHttp[userID].SetDebug(true)
+	// A session with a proxy never connects without it, which would expose the host's address
+	httpClient := newHttpClient()
+	proxyURL, proxyWebhooks, err := getUserProxy(s.db, userID)
+	if err != nil {
+		log.Error().Err(err).Str("userid",strconv.Itoa(userID)).Msg("Could not get proxy settings")
+		return fmt.Errorf("could not get proxy settings: %w", err)
 	}
-	clientHttp[userID].SetTimeout(30 * time.Second)
-	clientHttp[userID].SetTLSClientConfig(&tls.Config{ InsecureSkipVerify: true })
-	clientHttp[userID].OnError(func(req *resty.Request, err error) {
-		if v, ok := err.(*resty.ResponseError); ok {
-			// v.Response contains the last response from the server
-			// v.Err contains the original error
-			log.Debug().Str("response",v.Response.String()).Msg("resty error")
-			log.Error().Err(v.Err).Msg("resty error")
-	  }
-	})
+	if proxyURL != "" {
+		err = applyProxy(client, httpClient, proxyURL, proxyWebhooks)
+		if err != nil {
+			log.Error().Err(err).Str("userid",strconv.Itoa(userID)).Msg("Could not set proxy")
+			return fmt.Errorf("could not set proxy: %w", err)
+		}
+		log.Info().Str("userid",strconv.Itoa(userID)).Bool("webhooks",proxyWebhooks).Msg("Using proxy")
+	}
+	sessions.SetClient(userID, client, httpClient)
 
+	var startErr error
 	if client.Store.ID == nil {
 		// No ID stored, new login
+		setSessionState(s.db, userID, sessionStatePairing)
 
-		qrChan, err := client.GetQRChannel(context.Background())
+		qrChan, err := client.GetQRChannel(ctx)
 		if err != nil {
 			// This error means that we're already logged in, so ignore it.
 			if !errors.Is(err, whatsmeow.ErrQRStoreContainsID) {
 				log.Error().Err(err).Msg("Failed to get QR channel")
+				startErr = fmt.Errorf("could not get QR channel: %w", err)
 			}
 		} else {
 			err = client.Connect() // Si no conectamos no se puede generar QR
 			if err != nil {
-				panic(err)
-			}
-			for evt := range qrChan {
-				if evt.Event == "code" {
-					// Display QR code in terminal (useful for testing/developing)
-					if(*logType!="json") {
-						qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
-						fmt.Println("QR code:\n", evt.Code)
-					}
-					// Store encoded/embeded base64 QR on database for retrieval with the /qr endpoint
-					image, _ := qrcode.Encode(evt.Code, qrcode.Medium, 256)
-					base64qrcode := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
-					sqlStmt := `UPDATE users SET qrcode=$1 WHERE id=$2`
-					_, err := s.db.Exec(sqlStmt, base64qrcode, userID)
-					if err != nil {
-						log.Error().Err(err).Msg(sqlStmt)
-					}
-				} else if evt.Event == "timeout" {
-					// Clear QR code from DB on timeout
-					sqlStmt := `UPDATE users SET qrcode=$1 WHERE id=$2`
-					_, err := s.db.Exec(sqlStmt, "", userID)
-					if err != nil {
-						log.Error().Err(err).Msg(sqlStmt)
-					}
-					log.Warn().Msg("QR timeout killing channel")
-					delete(clientPointer, userID)
-					killchannel[userID] <- true
-				} else if evt.Event == "success" {
-					log.Info().Msg("QR pairing ok!")
-					// Clear QR code after pairing
-					sqlStmt := `UPDATE users SET qrcode=$1, connected=1 WHERE id=$2`
-					_, err := s.db.Exec(sqlStmt, "", userID)
-					if err != nil {
-						log.Error().Err(err).Msg(sqlStmt)
+				log.Error().Err(err).Str("userid",strconv.Itoa(userID)).Msg("Failed to connect for pairing")
+				startErr = fmt.Errorf("could not connect: %w", err)
+			} else {
+				// The channel is closed when pairing ends or the session is cancelled
+				for evt := range qrChan {
+					if evt.Event == "code" {
+						// Display QR code in terminal (useful for testing/developing)
+						if(*logType!="json") {
+							qrterminal.GenerateHalfBlock(evt.Code, qrterminal.L, os.Stdout)
+							fmt.Println("QR code:\n", evt.Code)
+						}
+						// Store encoded/embeded base64 QR on database for retrieval with the /qr endpoint
+						image, _ := qrcode.Encode(evt.Code, qrcode.Medium, 256)
+						base64qrcode := "data:image/png;base64," + base64.StdEncoding.EncodeToString(image)
+						sqlStmt := `UPDATE users SET qrcode=$1 WHERE id=$2`
+						_, err := s.db.Exec(sqlStmt, base64qrcode, userID)
+						if err != nil {
+							log.Error().Err(err).Msg(sqlStmt)
+						}
+						publishQR(userID, "code", map[string]interface{}{"code": base64qrcode, "timeout": int(evt.Timeout.Seconds())})
+					} else if evt.Event == "timeout" {
+						log.Warn().Msg("QR timeout killing channel")
+						publishQR(userID, "timeout", nil)
+						sessions.Stop(userID)
+					} else if evt.Event == "success" {
+						log.Info().Msg("QR pairing ok!")
+						// Clear QR code after pairing
+						sqlStmt := `UPDATE users SET qrcode=$1 WHERE id=$2`
+						_, err := s.db.Exec(sqlStmt, "", userID)
+						if err != nil {
+							log.Error().Err(err).Msg(sqlStmt)
+						}
+					} else {
+						log.Info().Str("event",evt.Event).Msg("Login event")
 					}
-				} else {
-					log.Info().Str("event",evt.Event).Msg("Login event")
 				}
 			}
 		}
@@ -247,32 +268,147 @@ func (s *server) startClient(userID int, textjid string, token string, subscript
 	} else {
 		// Already logged in, just connect
 		log.Info().Msg("Already logged in, just connect")
+		setSessionState(s.db, userID, sessionStateConnecting)
 		err = client.Connect()
 		if err != nil {
-			panic(err)
+			log.Error().Err(err).Str("userid",strconv.Itoa(userID)).Msg("Failed to connect")
+			mycli.connectionEvent("disconnected", map[string]interface{}{"reason": "connect failed: " + err.Error()})
+			startErr = fmt.Errorf("could not connect: %w", err)
 		}
 	}
 
-	// Keep connected client live until disconnected/killed
-	for {
+	// Keep connected client live until the session is cancelled, reconnecting when the connection is lost
+	for startErr == nil && ctx.Err() == nil {
 		select {
-		case <-killchannel[userID]:
-			log.Info().Str("userid",strconv.Itoa(userID)).Msg("Received kill signal")
-			client.Disconnect()
-			delete(clientPointer, userID)
-			sqlStmt := `UPDATE users SET, qrcode=$1 connected=0 WHERE id=$1`
-			_, err := s.db.Exec(sqlStmt, "", userID)
-			if err != nil {
-				log.Error().Err(err).Msg(sqlStmt)
-			}
+		case <-ctx.Done():
+		case <-mycli.reconnect:
+			mycli.reconnectLoop(ctx)
+		}
+	}
+	log.Info().Str("userid",strconv.Itoa(userID)).Msg("Session cancelled")
+	client.Disconnect()
+	client.RemoveEventHandler(mycli.eventHandlerID)
+	sessions.ClearClient(userID)
+	if sessions.HandedOff(userID) {
+		// Another replica takes the session over, keep it marked as connected
+		sessions.SetState(userID, sessionStateDisconnected)
+		log.Info().Str("userid",strconv.Itoa(userID)).Msg("Session handed off")
+	} else if startErr != nil {
+		// The start can be retried, keep the stored state as it was
+		sessions.SetState(userID, sessionStateDisconnected)
+	} else if state, _ := sessions.State(userID); state != sessionStateLoggedOut {
+		setSessionState(s.db, userID, sessionStateDisconnected)
+	}
+	return startErr
+}
+
+// Asks the session to reconnect, requests made while one is pending are merged
+func (mycli *MyClient) requestReconnect() {
+	select {
+	case mycli.reconnect <- struct{}{}:
+	default:
+	}
+}
+
+// Reconnects with capped exponential backoff until connected or the session is
+// cancelled. While temporarily banned it waits for the ban to expire.
+func (mycli *MyClient) reconnectLoop(ctx context.Context) {
+	txtid := strconv.Itoa(mycli.userID)
+	for attempt := 1; ; attempt++ {
+		if mycli.WAClient.IsConnected() {
+			return
+		}
+		delay := jitteredBackoff(attempt, reconnectBaseDelay, reconnectMaxDelay)
+		if banned := time.Until(time.Unix(mycli.bannedUntil.Load(), 0)); banned > delay {
+			delay = banned
+		}
+		setSessionState(mycli.db, mycli.userID, sessionStateConnecting)
+		mycli.connectionEvent("reconnecting", map[string]interface{}{"attempt": attempt, "delay": int(delay.Seconds())})
+		log.Warn().Str("userid",txtid).Int("attempt",attempt).Str("delay",delay.String()).Msg("Reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		err := mycli.WAClient.Connect()
+		if err == nil || errors.Is(err, whatsmeow.ErrAlreadyConnected) {
 			return
-		default:
-			time.Sleep(1000 * time.Millisecond)
-			//log.Info().Str("jid",textjid).Msg("Loop the loop")
 		}
+		log.Error().Err(err).Str("userid",txtid).Int("attempt",attempt).Msg("Reconnect failed")
 	}
 }
 
+// Sends a Connection event to the webhooks and event streams of the user
+func (mycli *MyClient) connectionEvent(state string, details map[string]interface{}) {
+	event := map[string]interface{}{"state": state}
+	for k, v := range details {
+		event[k] = v
+	}
+	postmap := map[string]interface{}{"type": "Connection", "event": event}
+	mycli.dispatchEvent(postmap, "")
+}
+
+// Sends a pairing event to the QR streams of the user
+func publishQR(userID int, eventType string, data map[string]interface{}) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal QR event")
+		return
+	}
+	qrStreams.Publish(userID, eventType, jsonData)
+}
+
+// Records a session state transition and keeps the connected column of the
+// users table in sync, so only connected sessions are restored on startup
+func setSessionState(db *sqlx.DB, userID int, state string) {
+	previous, ok := sessions.SetState(userID, state)
+	if !ok || previous == state {
+		return
+	}
+	log.Info().Str("userid",strconv.Itoa(userID)).Str("from",previous).Str("to",state).Msg("Session state changed")
+	startup.observe(userID, state)
+
+	var sqlStmt string
+	switch state {
+	case sessionStateConnected:
+		sqlStmt = `UPDATE users SET connected=1 WHERE id=$1`
+	case sessionStateDisconnected, sessionStateLoggedOut:
+		sqlStmt = `UPDATE users SET qrcode='', connected=0 WHERE id=$1`
+	default:
+		return
+	}
+	_, err := db.Exec(sqlStmt, userID)
+	if err != nil {
+		log.Error().Err(err).Msg(sqlStmt)
+	}
+}
+
+// Creates the resty client used to call webhooks
+func newHttpClient() *resty.Client {
+	//client := resty.New().EnableTrace()
+	client := resty.New()
+	client.SetRedirectPolicy(resty.FlexibleRedirectPolicy(15))
+	if *waDebug == "DEBUG" {
+		client.SetDebug(true)
+	}
+	client.SetTimeout(30 * time.Second)
+	client.SetTLSClientConfig(&tls.Config{ InsecureSkipVerify: true })
+	client.OnError(func(req *resty.Request, err error) {
+		if v, ok := err.(*resty.ResponseError); ok {
+			// v.Response contains the last response from the server
+			// v.Err contains the original error
+			log.Debug().Str("response",v.Response.String()).Msg("resty error")
+			log.Error().Err(v.Err).Msg("resty error")
+	  }
+	})
+	return client
+}
+
 func fileToBase64(filepath string) (string, string, error) {
     data, err := os.ReadFile(filepath)
     if err != nil {
@@ -291,7 +427,8 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 
 	ex, err := os.Executable()
 	if err != nil {
-		panic(err)
+		log.Error().Err(err).Msg("Could not get executable path")
+		return
 	}
 	exPath := filepath.Dir(ex)
 
@@ -306,6 +443,11 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			}
 		}
 	case *events.Connected, *events.PushNameSetting:
+		if _, ok := rawEvt.(*events.Connected); ok {
+			setSessionState(mycli.db, mycli.userID, sessionStateConnected)
+			mycli.bannedUntil.Store(0)
+			mycli.connectionEvent("connected", nil)
+		}
 		if len(mycli.WAClient.Store.PushName) == 0 {
 			return
 		}
@@ -317,14 +459,36 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		} else {
 			log.Info().Msg("Marked self as available")
 		}
-		sqlStmt := `UPDATE users SET connected=1 WHERE id=$1`
-		_, err = mycli.db.Exec(sqlStmt, mycli.userID)
-		if err != nil {
-			log.Error().Err(err).Msg(sqlStmt)
-			return
+	case *events.Disconnected:
+		log.Warn().Str("userid",txtid).Msg("Connection lost")
+		mycli.connectionEvent("disconnected", map[string]interface{}{"reason": "connection lost"})
+		mycli.requestReconnect()
+	case *events.KeepAliveTimeout:
+		log.Warn().Str("userid",txtid).Int("errors",evt.ErrorCount).Msg("Keepalive timeout")
+		if time.Since(evt.LastSuccess) > whatsmeow.KeepAliveMaxFailTime {
+			// Without auto reconnect whatsmeow leaves the dead socket open
+			mycli.WAClient.Disconnect()
+			mycli.connectionEvent("disconnected", map[string]interface{}{"reason": "keepalive timeout"})
+			mycli.requestReconnect()
+		}
+	case *events.KeepAliveRestored:
+		log.Info().Str("userid",txtid).Msg("Keepalive restored")
+	case *events.ConnectFailure:
+		log.Warn().Str("userid",txtid).Str("reason",evt.Reason.String()).Str("message",evt.Message).Msg("Connect failure")
+		mycli.connectionEvent("disconnected", map[string]interface{}{"reason": evt.Reason.String(), "message": evt.Message})
+		mycli.requestReconnect()
+	case *events.TemporaryBan:
+		log.Warn().Str("userid",txtid).Str("ban",evt.String()).Msg("Temporarily banned")
+		details := map[string]interface{}{"code": evt.Code.String(), "expire": int(evt.Expire.Seconds())}
+		if evt.Expire > 0 {
+			expiresAt := time.Now().Add(evt.Expire)
+			mycli.bannedUntil.Store(expiresAt.Unix())
+			details["expiresAt"] = expiresAt
 		}
+		mycli.connectionEvent("banned", details)
+		mycli.requestReconnect()
 	case *events.PairSuccess:
-		log.Info().Str("userid",strconv.Itoa(mycli.userID)).Str("token",mycli.token).Str("ID",evt.ID.String()).Str("BusinessName",evt.BusinessName).Str("Platform",evt.Platform).Msg("QR Pair Success")
+		log.Info().Str("userid",strconv.Itoa(mycli.userID)).Str("ID",evt.ID.String()).Str("BusinessName",evt.BusinessName).Str("Platform",evt.Platform).Msg("QR Pair Success")
 		jid := evt.ID
 		sqlStmt := `UPDATE users SET jid=$1 WHERE id=$2`
 		_, err := mycli.db.Exec(sqlStmt, jid, mycli.userID)
@@ -333,18 +497,35 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			return
 		}
 
-		myuserinfo, found := userinfocache.Get(mycli.token)
+		// A new device gets the history again, so the sync starts over
+		err = resetHistorySyncStatus(mycli.db, mycli.userID)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not reset history sync status")
+		}
+		setSessionState(mycli.db, mycli.userID, sessionStateConnecting)
+		publishQR(mycli.userID, "success", map[string]interface{}{"jid": jid.String(), "businessName": evt.BusinessName, "platform": evt.Platform})
+		recordSessionAudit(mycli.db, mycli.userID, "session.paired", map[string]interface{}{"jid": jid.String(), "businessName": evt.BusinessName, "platform": evt.Platform})
+
+		txtid := strconv.Itoa(mycli.userID)
+		myuserinfo, found := userinfocache.Get(txtid)
 		if !found {
 			log.Warn().Msg("No user info cached on pairing?")
 		} else {
-			txtid := myuserinfo.(Values).Get("Id")
-			token := myuserinfo.(Values).Get("Token")
 			v := updateUserInfo(myuserinfo, "Jid", fmt.Sprintf("%s", jid))
-			userinfocache.Set(token, v, cache.NoExpiration)
-			log.Info().Str("jid",jid.String()).Str("userid",txtid).Str("token",token).Msg("User information set")
+			userinfocache.Set(txtid, v, cache.DefaultExpiration)
+			log.Info().Str("jid",jid.String()).Str("userid",txtid).Msg("User information set")
 		}
 	case *events.StreamReplaced:
+		// Another client took over the session, whatsmeow does not reconnect
 		log.Info().Msg("Received StreamReplaced event")
+		if owned, err := leases.Owns(mycli.userID); err == nil && !owned {
+			// The replica that took over the lease connected the session
+			sessions.Handoff(mycli.userID)
+			return
+		}
+		setSessionState(mycli.db, mycli.userID, sessionStateDisconnected)
+		mycli.connectionEvent("disconnected", map[string]interface{}{"reason": "stream replaced"})
+		sessions.Stop(mycli.userID)
 		return
 	case *events.Message:
 		postmap["type"] = "Message"
@@ -364,6 +545,15 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		}
 
 		log.Info().Str("id",evt.Info.ID).Str("source",evt.Info.SourceString()).Str("parts",strings.Join(metaParts,", ")).Msg("Message Received")
+
+		err = saveMessage(mycli.db, mycli.userID, evt.Info, evt.Message, "")
+		if err != nil {
+			log.Error().Err(err).Str("id",evt.Info.ID).Msg("Could not store message")
+		}
+		err = updateChatActivity(mycli.db, mycli.userID, evt.Info, evt.Message)
+		if err != nil {
+			log.Error().Err(err).Str("chat",evt.Info.Chat.String()).Msg("Could not update chat")
+		}
 	
 		// try to get Image if any
 		img := evt.Message.GetImageMessage()
@@ -534,19 +724,35 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 				// log.Debug().Str("path",path).Msg("Video converted to base64")
 			}
 
+		if path != "" {
+			err = saveMessageMediaPath(mycli.db, mycli.userID, evt.Info, path)
+			if err != nil {
+				log.Error().Err(err).Str("id",evt.Info.ID).Msg("Could not store message media path")
+			}
+		}
+
 	case *events.Receipt:
+		err := saveReceipt(mycli.db, mycli.userID, evt)
+		if err != nil {
+			log.Error().Err(err).Strs("id",evt.MessageIDs).Msg("Could not store receipt")
+		}
 		postmap["type"] = "ReadReceipt"
 		dowebhook = 1
 		if evt.Type == events.ReceiptTypeRead || evt.Type == events.ReceiptTypeReadSelf {
-			log.Info().Strs("id",evt.MessageIDs).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp)).Msg("Message was read")
+			log.Info().Strs("id",evt.MessageIDs).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp.Unix())).Msg("Message was read")
 			if evt.Type == events.ReceiptTypeRead {
 				postmap["state"] = "Read"
 			} else {
 				postmap["state"] = "ReadSelf"
+				// Read on another device of the same account
+				err := setChatUnreadCount(mycli.db, mycli.userID, evt.Chat, 0)
+				if err != nil {
+					log.Error().Err(err).Str("chat",evt.Chat.String()).Msg("Could not update chat")
+				}
 			}
 		} else if evt.Type == events.ReceiptTypeDelivered {
 			postmap["state"] = "Delivered"
-			log.Info().Str("id",evt.MessageIDs[0]).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp)).Msg("Message delivered")
+			log.Info().Str("id",evt.MessageIDs[0]).Str("source",evt.SourceString()).Str("timestamp",fmt.Sprintf("%d",evt.Timestamp.Unix())).Msg("Message delivered")
 		} else {
 			// Discard webhooks for inactive or other delivery types
 			return
@@ -559,7 +765,7 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 			if evt.LastSeen.IsZero() {
 				log.Info().Str("from",evt.From.String()).Msg("User is now offline")
 			} else {
-				log.Info().Str("from",evt.From.String()).Str("lastSeen",fmt.Sprintf("%d",evt.LastSeen)).Msg("User is now offline")
+				log.Info().Str("from",evt.From.String()).Str("lastSeen",fmt.Sprintf("%d",evt.LastSeen.Unix())).Msg("User is now offline")
 			}
 		} else {
 			postmap["state"] = "online"
@@ -569,44 +775,60 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 		postmap["type"] = "HistorySync"
 		dowebhook = 1
 
-		// check/creates user directory for files
-		userDirectory := filepath.Join(exPath, "files", "user_"+txtid)
-		_, err := os.Stat(userDirectory)
-		if os.IsNotExist(err) {
-			errDir := os.MkdirAll(userDirectory, 0751)
-			if errDir != nil {
-				log.Error().Err(errDir).Msg("Could not create user directory")
-				return
-			}
+		err := importHistorySync(mycli.db, mycli.WAClient, mycli.userID, evt.Data)
+		if err != nil {
+			log.Error().Err(err).Str("userid",txtid).Msg("Could not import history sync")
 		}
-
-		id := atomic.AddInt32(&historySyncID, 1)
-		fileName := filepath.Join(userDirectory, "history-"+strconv.Itoa(int(id))+".json")
-		file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE, 0600)
+	case *events.AppState:
+		log.Info().Str("index",fmt.Sprintf("%+v",evt.Index)).Str("actionValue",fmt.Sprintf("%+v",evt.SyncActionValue)).Msg("App state event received")
+	case *events.Archive:
+		err := setChatArchived(mycli.db, mycli.userID, evt.JID, evt.Action.GetArchived())
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to open file to write history sync")
-			return
+			log.Error().Err(err).Str("chat",evt.JID.String()).Msg("Could not update chat archive state")
 		}
-		enc := json.NewEncoder(file)
-		enc.SetIndent("", "  ")
-		err = enc.Encode(evt.Data)
+	case *events.Pin:
+		err := setChatPinned(mycli.db, mycli.userID, evt.JID, evt.Action.GetPinned())
 		if err != nil {
-			log.Error().Err(err).Msg("Failed to write history sync")
-			return
+			log.Error().Err(err).Str("chat",evt.JID.String()).Msg("Could not update chat pin state")
 		}
-		log.Info().Str("filename",fileName).Msg("Wrote history sync")
-		_ = file.Close()
-	case *events.AppState:
-		log.Info().Str("index",fmt.Sprintf("%+v",evt.Index)).Str("actionValue",fmt.Sprintf("%+v",evt.SyncActionValue)).Msg("App state event received")
-	case *events.LoggedOut:
-		log.Info().Str("reason",evt.Reason.String()).Msg("Logged out")
-		killchannel[mycli.userID] <- true
-		sqlStmt := `UPDATE users SET connected=0 WHERE id=$1`
-		_, err := mycli.db.Exec(sqlStmt, mycli.userID)
+	case *events.Mute:
+		var until *time.Time
+		// A negative end timestamp means muted forever
+		if ts := evt.Action.GetMuteEndTimestamp(); ts > 0 {
+			t := time.UnixMilli(ts)
+			until = &t
+		}
+		err := setChatMuted(mycli.db, mycli.userID, evt.JID, evt.Action.GetMuted(), until)
 		if err != nil {
-			log.Error().Err(err).Msg(sqlStmt)
-			return
+			log.Error().Err(err).Str("chat",evt.JID.String()).Msg("Could not update chat mute state")
+		}
+	case *events.MarkChatAsRead:
+		unread := 0
+		if !evt.Action.GetRead() {
+			unread = 1
 		}
+		err := setChatUnreadCount(mycli.db, mycli.userID, evt.JID, unread)
+		if err != nil {
+			log.Error().Err(err).Str("chat",evt.JID.String()).Msg("Could not update chat unread count")
+		}
+	case *events.GroupInfo:
+		if evt.Name != nil {
+			err := setChatName(mycli.db, mycli.userID, evt.JID, evt.Name.Name)
+			if err != nil {
+				log.Error().Err(err).Str("chat",evt.JID.String()).Msg("Could not update chat name")
+			}
+		}
+	case *events.JoinedGroup:
+		err := setChatName(mycli.db, mycli.userID, evt.JID, evt.GroupName.Name)
+		if err != nil {
+			log.Error().Err(err).Str("chat",evt.JID.String()).Msg("Could not update chat name")
+		}
+	case *events.LoggedOut:
+		log.Info().Str("reason",evt.Reason.String()).Msg("Logged out")
+		setSessionState(mycli.db, mycli.userID, sessionStateLoggedOut)
+		mycli.connectionEvent("logged_out", map[string]interface{}{"reason": evt.Reason.String(), "onConnect": evt.OnConnect})
+		recordSessionAudit(mycli.db, mycli.userID, "session.logged_out", map[string]interface{}{"reason": evt.Reason.String(), "onConnect": evt.OnConnect})
+		sessions.Stop(mycli.userID)
 	case *events.ChatPresence:
 		postmap["type"] = "ChatPresence"
 		dowebhook = 1
@@ -626,52 +848,89 @@ func (mycli *MyClient) myEventHandler(rawEvt interface{}) {
 	}
 
 	if dowebhook == 1 {
-		// call webhook
-		webhookurl := ""
-		myuserinfo, found := userinfocache.Get(mycli.token)
-		if !found {
-			log.Warn().Str("token",mycli.token).Msg("Could not call webhook as there is no user for this token")
+		mycli.dispatchEvent(postmap, path)
+	}
+}
+
+// Publishes the event to the event streams and queues it for the user webhook
+// and for every enabled webhook endpoint subscribed to its type
+func (mycli *MyClient) dispatchEvent(postmap map[string]interface{}, path string) {
+	eventType := postmap["type"].(string)
+	subscribed := Find(mycli.subscriptions, eventType) || Find(mycli.subscriptions, "All")
+
+	jsonData, err := json.Marshal(postmap)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
+		return
+	}
+
+	if subscribed {
+		eventStreams.Publish(mycli.userID, eventType, jsonData)
+	}
+
+	userinfo, err := getUserInfoByID(mycli.db, mycli.userID)
+	if err != nil {
+		log.Warn().Err(err).Str("userid",strconv.Itoa(mycli.userID)).Msg("Could not call webhook as there is no such user")
+		return
+	}
+
+	data := map[string]string{
+		"jsonData": string(jsonData),
+	}
+	// Only the token prefix is known, it is sent when the user opted in. It
+	// is not sent as token, receivers checking that field must not accept it.
+	if userinfo.Get("WebhookToken") == "true" {
+		data["tokenPrefix"] = userinfo.Get("TokenPrefix")
+	}
+	log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
+
+	messageID := ""
+	switch evt := postmap["event"].(type) {
+	case *events.Message:
+		messageID = evt.Info.ID
+	case *events.Receipt:
+		messageID = strings.Join(evt.MessageIDs, ",")
+	}
+
+	queued := 0
+	enqueue := func(webhookID int, webhookurl string, format string) {
+		log.Info().Str("url",webhookurl).Int("webhookid",webhookID).Msg("Calling webhook")
+		err := webhookQueue.Enqueue(outboxEntry{
+			UserId:    mycli.userID,
+			WebhookId: webhookID,
+			Url:       webhookurl,
+			Format:    format,
+			File:      path,
+			EventType: eventType,
+			MessageId: messageID,
+		}, data)
+		if err != nil {
+			log.Error().Err(err).Msg("Could not queue webhook")
+			return
+		}
+		queued++
+	}
+
+	webhookurl := userinfo.Get("Webhook")
+	if webhookurl != "" {
+		if !subscribed {
+			log.Warn().Str("type",eventType).Msg("Skipping webhook. Not subscribed for this type")
 		} else {
-			webhookurl = myuserinfo.(Values).Get("Webhook")
+			enqueue(0, webhookurl, userinfo.Get("WebhookFormat"))
 		}
+	}
 
-		if !Find(mycli.subscriptions, postmap["type"].(string)) && !Find(mycli.subscriptions, "All") {
-			log.Warn().Str("type",postmap["type"].(string)).Msg("Skipping webhook. Not subscribed for this type")
-			return
+	endpoints, err := getWebhookEndpoints(mycli.db, mycli.userID)
+	if err != nil {
+		log.Error().Err(err).Msg("Could not get webhook endpoints")
+	}
+	for _, endpoint := range endpoints {
+		if endpoint.Enabled && endpoint.Subscribed(eventType) {
+			enqueue(endpoint.Id, endpoint.Url, endpoint.Format)
 		}
+	}
 
-if webhookurl != "" {
-    log.Info().Str("url",webhookurl).Msg("Calling webhook")
-    jsonData, err := json.Marshal(postmap)
-    if err != nil {
-        log.Error().Err(err).Msg("Failed to marshal postmap to JSON")
-    } else {
-        data := map[string]string{
-            "jsonData": string(jsonData),
-            "token":    mycli.token,
-        }
-        
-        // Adicione este log
-        log.Debug().Interface("webhookData", data).Msg("Data being sent to webhook")
-
-        if path == "" {
-            go callHook(webhookurl, data, mycli.userID)
-        } else {
-            // Create a channel to capture error from the goroutine
-            errChan := make(chan error, 1)
-            go func() {
-                err := callHookFile(webhookurl, data, mycli.userID, path)
-                errChan <- err
-            }()
-    
-            // Optionally handle the error from the channel
-            if err := <-errChan; err != nil {
-                log.Error().Err(err).Msg("Error calling hook file")
-            }
-        }
-    }
-} else {
-    log.Warn().Str("userid",strconv.Itoa(mycli.userID)).Msg("No webhook set for user")
-}
+	if queued == 0 {
+		log.Warn().Str("userid",strconv.Itoa(mycli.userID)).Str("type",eventType).Msg("No webhook set for user")
 	}
 }